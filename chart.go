@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// PollChartName is the name of the chart attached to poll results, which their embeds show.
+const PollChartName = "results.png"
+
+// Chart layout, in pixels
+const (
+	chartWidth      = 800
+	chartPadding    = 24
+	chartHeader     = 64
+	chartRowHeight  = 36
+	chartBarHeight  = 24
+	chartLabelWidth = 220
+	chartValueWidth = 150
+	chartGap        = 12
+)
+
+// chartPalette is the colours of the bars, from the top of the chart down.
+var chartPalette = []int{DiscordBlurple, DiscordGreen, DiscordYellow, DiscordFuscha, DiscordRed}
+
+// chartFonts parses the fonts used in charts. Faces aren't safe for concurrent use, so each chart makes its own.
+var chartFonts = sync.OnceValues(func() ([2]*opentype.Font, error) {
+	regular, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return [2]*opentype.Font{}, fmt.Errorf("error parsing regular font: %w", err)
+	}
+	bold, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return [2]*opentype.Font{}, fmt.Errorf("error parsing bold font: %w", err)
+	}
+	return [2]*opentype.Font{regular, bold}, nil
+})
+
+// pollChartFiles renders a chart of the results of a poll to attach to a message, see PollChartName.
+// Nothing is returned if the chart can't be rendered, the results are still sent with text bars.
+func pollChartFiles(poll dbPoll) []*discordgo.File {
+	data, err := renderPollChart(poll)
+	if err != nil {
+		logger.Warn("Failed to render poll chart", "poll", poll.ID, "error", err)
+		return nil
+	}
+
+	return []*discordgo.File{
+		{
+			Name:        PollChartName,
+			ContentType: "image/png",
+			Reader:      bytes.NewReader(data),
+		},
+	}
+}
+
+// renderPollChart draws a horizontal bar chart of the votes for each option of a poll as a PNG, with the options sorted by
+// the number of votes. Ranked-choice polls show first preferences, like the rest of their results.
+func renderPollChart(poll dbPoll) ([]byte, error) {
+	fonts, err := chartFonts()
+	if err != nil {
+		return nil, err
+	}
+	title, err := opentype.NewFace(fonts[1], &opentype.FaceOptions{Size: 20, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("error creating font face: %w", err)
+	}
+	defer title.Close()
+	text, err := opentype.NewFace(fonts[0], &opentype.FaceOptions{Size: 15, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("error creating font face: %w", err)
+	}
+	defer text.Close()
+
+	counts := pollVoteCounts(poll)
+	totalVotes, highestVotes := 0, 0
+	for _, votes := range counts {
+		totalVotes += votes
+		if votes > highestVotes {
+			highestVotes = votes
+		}
+	}
+
+	order := make([]int, len(poll.Options))
+	for n := range order {
+		order[n] = n
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+
+	height := chartPadding*2 + chartHeader + len(order)*chartRowHeight
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(chartColour(DiscordWhite, 0xFF)), image.Point{}, draw.Src)
+
+	ink := image.NewUniform(chartColour(DiscordBlack, 0xFF))
+	faded := image.NewUniform(chartColour(DiscordBlack, 0x99))
+	track := image.NewUniform(chartColour(DiscordBlack, 0x14))
+
+	subtitle := fmt.Sprintf("%d vote%s", totalVotes, plural(totalVotes))
+	if poll.Mode == PollModeRanked {
+		subtitle = fmt.Sprintf("First preferences of %d voter%s", totalVotes, plural(totalVotes))
+	}
+	drawChartText(img, title, ink, poll.Question, chartPadding, chartPadding+20, chartWidth-chartPadding*2, false)
+	drawChartText(img, text, faded, subtitle, chartPadding, chartPadding+46, chartWidth-chartPadding*2, false)
+
+	barLeft := chartPadding + chartLabelWidth + chartGap
+	barWidth := chartWidth - chartPadding - chartValueWidth - chartGap - barLeft
+	for row, n := range order {
+		top := chartPadding + chartHeader + row*chartRowHeight
+		barTop := top + (chartRowHeight-chartBarHeight)/2
+		baseline := barTop + chartBarHeight/2 + 5
+
+		drawChartText(img, text, ink, poll.Options[n], chartPadding, baseline, chartLabelWidth, true)
+
+		draw.Draw(img, image.Rect(barLeft, barTop, barLeft+barWidth, barTop+chartBarHeight), track, image.Point{}, draw.Over)
+		if counts[n] > 0 {
+			// Bars are scaled to the highest number of votes, so small differences between the leaders are still visible
+			width := max(barWidth*counts[n]/highestVotes, 2)
+			bar := image.NewUniform(chartColour(chartPalette[row%len(chartPalette)], 0xFF))
+			draw.Draw(img, image.Rect(barLeft, barTop, barLeft+width, barTop+chartBarHeight), bar, image.Point{}, draw.Src)
+		}
+
+		value := fmt.Sprintf("%d%s", counts[n], formatVotePercentage(counts[n], totalVotes))
+		drawChartText(img, text, ink, value, barLeft+barWidth+chartGap, baseline, chartValueWidth, false)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("error encoding chart: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// drawChartText draws a line of text with its baseline at y, shortening it with an ellipsis if it is wider than width.
+// Right-aligned text ends at x+width. Characters the font doesn't have, like emoji, are left out rather than drawn as boxes.
+func drawChartText(img draw.Image, face font.Face, src image.Image, str string, x, y, width int, right bool) {
+	str = strings.Map(func(r rune) rune {
+		if _, ok := face.GlyphAdvance(r); !ok && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, str)
+	str = strings.Join(strings.Fields(str), " ")
+	limit := fixed.I(width)
+	if font.MeasureString(face, str) > limit {
+		runes := []rune(str)
+		for len(runes) > 0 && font.MeasureString(face, string(runes)+"…") > limit {
+			runes = runes[:len(runes)-1]
+		}
+		str = strings.TrimSpace(string(runes)) + "…"
+	}
+
+	drawer := font.Drawer{Dst: img, Src: src, Face: face, Dot: fixed.P(x, y)}
+	if right {
+		drawer.Dot.X = fixed.I(x+width) - drawer.MeasureString(str)
+	}
+	drawer.DrawString(str)
+}
+
+// chartColour converts one of the Discord colour constants to a colour with the given opacity.
+func chartColour(rgb int, alpha uint8) color.Color {
+	return color.NRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: alpha}
+}
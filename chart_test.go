@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// checkChart checks that a message has a chart of its poll's results in place of text bars.
+func checkChart(t *testing.T, message discordgo.Message) {
+	t.Helper()
+
+	if len(message.Attachments) != 1 || message.Attachments[0].Filename != PollChartName {
+		t.Fatalf("message has %d attachments, want just the chart", len(message.Attachments))
+	}
+	if _, err := png.Decode(strings.NewReader(message.Attachments[0].URL)); err != nil {
+		t.Errorf("chart isn't a PNG: %v", err)
+	}
+
+	embed := message.Embeds[0]
+	if embed.Image == nil || embed.Image.URL != "attachment://"+PollChartName {
+		t.Errorf("embed image = %+v, want the chart", embed.Image)
+	}
+	for _, field := range embed.Fields {
+		if strings.Contains(field.Value, "░") {
+			t.Errorf("field %q = %q, want the votes without a text bar", field.Name, field.Value)
+		}
+	}
+}
+
+func TestRenderPollChart(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0),
+		stringOption("question", "Best 🍕?"),
+		stringOption("options", "Margherita;Pepperoni;Hawaiian"),
+	)
+	vote(t, s, testMember("2", 0), poll, 1)
+	vote(t, s, testMember("3", 0), poll, 1)
+	vote(t, s, testMember("4", 0), poll, 2)
+	poll, _ = databasePollGet(poll.ID)
+
+	data, err := renderPollChart(poll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("chart isn't a PNG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != chartWidth || size.Y != chartPadding*2+chartHeader+3*chartRowHeight {
+		t.Errorf("chart is %v, want a row for each option", size)
+	}
+
+	// The options are sorted by votes, so the top bar is the leader's and fills the chart
+	top := chartPadding + chartHeader + chartRowHeight/2
+	right := chartWidth - chartPadding - chartValueWidth - chartGap - 1
+	if got := img.At(right, top); !sameColour(got, chartColour(chartPalette[0], 0xFF)) {
+		t.Errorf("colour at the end of the top bar = %v, want the first colour of the palette", got)
+	}
+	if got := img.At(right, top+2*chartRowHeight); sameColour(got, chartColour(chartPalette[2], 0xFF)) {
+		t.Error("bar of an option without votes isn't empty")
+	}
+}
+
+func TestRenderRankedPollChart(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0),
+		stringOption("options", "A;B;C"),
+		stringOption("mode", string(PollModeRanked)),
+	)
+	vote(t, s, testMember("2", 0), poll, 2)
+	vote(t, s, testMember("2", 0), poll, 0)
+	poll, _ = databasePollGet(poll.ID)
+
+	if _, err := renderPollChart(poll); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sameColour(a, b interface{ RGBA() (r, g, b, a uint32) }) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
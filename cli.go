@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const pollsUsage = `Usage: discordhelperbot [flags] polls <command> [arguments]
+
+Inspect and repair the polls in the database without connecting to Discord.
+It is safe to run these while the bot is running.
+
+Commands:
+  list [--status active|ended|all] [--guild ID]
+        list polls, active ones by default
+  show ID
+        show a poll with its votes
+  end [--notify] ID...
+        end polls now. With --notify the bot updates the poll messages and sends the results
+        when it next runs, otherwise the polls are ended quietly
+  delete ID...
+        remove polls along with their votes, for polls that should never have existed
+  export [--status active|ended|all] [--guild ID] [--output FILE] [--include-secrets] [ID...]
+        write polls and their votes as JSON, every poll by default. The salts of active anonymous
+        polls are left out unless --include-secrets is given, as they link votes to voters
+  import [FILE]
+        add polls written by export, reading standard input if no file is given. Active anonymous
+        polls exported without their salt get a new one, so people who voted can vote again
+`
+
+// runPollsCommand runs an admin command on the polls in the database and returns the exit code.
+func runPollsCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stderr, pollsUsage)
+		return 2
+	}
+
+	commands := map[string]func(args []string, stdout, stderr io.Writer) error{
+		"list":   pollsListCmd,
+		"show":   pollsShowCmd,
+		"end":    pollsEndCmd,
+		"delete": pollsDeleteCmd,
+		"export": pollsExportCmd,
+		"import": pollsImportCmd,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n\n%s", args[0], pollsUsage)
+		return 2
+	}
+
+	// Only warnings go to standard error, the bot's log is left alone
+	logger = slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	// Don't create an empty database when given the wrong path, except to import into
+	if config.Database.Driver == "sqlite" && args[0] != "import" && !fileExists(config.Database.URL) {
+		fmt.Fprintf(stderr, "Error: database %s doesn't exist\n", config.Database.URL)
+		return 1
+	}
+
+	var err error
+	store, err = openStore(config.Database.Driver, config.Database.URL)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error opening database:", err)
+		return 1
+	}
+	defer store.Close()
+	// Jobs are only scheduled here, the bot runs them
+	scheduler = newScheduler(store)
+
+	err = command(args[1:], stdout, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// pollsFlags creates the flag set for a command, printing errors and usage to stderr.
+func pollsFlags(name string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("polls "+name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	return flags
+}
+
+// checkPollIDs checks that every poll exists, and is active if active is set, before a command changes any of them.
+func checkPollIDs(ids []string, active bool) error {
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("poll %s is given more than once", id)
+		}
+		seen[id] = true
+
+		poll, err := databasePollGet(id)
+		if errors.Is(err, errPollNotFound) {
+			return fmt.Errorf("there is no poll %s", id)
+		} else if err != nil {
+			return err
+		}
+		if active && poll.Status != PollStatusActive {
+			return fmt.Errorf("poll %s has already ended", id)
+		}
+	}
+	return nil
+}
+
+// partialError reports that a command stopped partway through the polls it was given, saying which polls it had already changed.
+func partialError(err error, done []string, verb string) error {
+	if len(done) == 0 {
+		return fmt.Errorf("%w, no polls were %s", err, verb)
+	}
+	return fmt.Errorf("%w, polls %s were already %s and the rest were left as they were", err, strings.Join(done, ", "), verb)
+}
+
+// selectPolls gets the polls with a status in a guild, or in every guild if guildId is empty.
+func selectPolls(status, guildId string) ([]dbPoll, error) {
+	if status != "active" && status != "ended" && status != "all" {
+		return nil, fmt.Errorf("unknown status %q, use active, ended or all", status)
+	}
+
+	polls, err := databasePollAll()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []dbPoll{}
+	for _, poll := range polls {
+		if (status == "all" || string(poll.Status) == status) && (guildId == "" || poll.Guild == guildId) {
+			selected = append(selected, poll)
+		}
+	}
+	return selected, nil
+}
+
+func pollsListCmd(args []string, stdout, stderr io.Writer) error {
+	flags := pollsFlags("list", stderr)
+	status := flags.String("status", "active", "list `active`, ended or all polls")
+	guildId := flags.String("guild", "", "only list polls in the guild with this `ID`")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	polls, err := selectPolls(*status, *guildId)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tGUILD\tCREATOR\tENDS\tVOTERS\tQUESTION")
+	for _, poll := range polls {
+		ends := poll.EndTime
+		if poll.Status == PollStatusEnded {
+			ends = poll.EndedAt
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", poll.ID, poll.Status, poll.Guild, poll.Creator, ends.Local().Format(time.DateTime), pollVoterCount(poll), truncate(poll.Question, 50))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%d poll%s\n", len(polls), plural(len(polls)))
+	return nil
+}
+
+func pollsShowCmd(args []string, stdout, stderr io.Writer) error {
+	flags := pollsFlags("show", stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("give the ID of one poll to show")
+	}
+
+	poll, err := databasePollGet(flags.Arg(0))
+	if errors.Is(err, errPollNotFound) {
+		return fmt.Errorf("there is no poll %s", flags.Arg(0))
+	} else if err != nil {
+		return err
+	}
+
+	features := []string{fmt.Sprintf("%s, up to %d choice%s", poll.Mode, poll.MaxChoices, plural(poll.MaxChoices))}
+	if poll.Anonymous {
+		features = append(features, "anonymous")
+	}
+	if poll.HideResults {
+		features = append(features, "results hidden until it ends")
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", poll.ID)
+	fmt.Fprintf(w, "Question:\t%s\n", poll.Question)
+	fmt.Fprintf(w, "Status:\t%s\n", poll.Status)
+	fmt.Fprintf(w, "Type:\t%s\n", strings.Join(features, ", "))
+	fmt.Fprintf(w, "Guild:\t%s\n", poll.Guild)
+	fmt.Fprintf(w, "Message:\t%s\n", pollMessageURL(poll))
+	fmt.Fprintf(w, "Creator:\t%s\n", poll.Creator)
+	fmt.Fprintf(w, "Created:\t%s\n", poll.CreatedTime.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "Ends:\t%s\n", poll.EndTime.Local().Format(time.DateTime))
+	if poll.Status == PollStatusEnded {
+		fmt.Fprintf(w, "Ended:\t%s\n", poll.EndedAt.Local().Format(time.DateTime))
+	}
+	fmt.Fprintf(w, "Voters:\t%d\n", pollVoterCount(poll))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout)
+	counts := pollVoteCounts(poll)
+	w = tabwriter.NewWriter(stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for n, option := range poll.Options {
+		fmt.Fprintf(w, "%d.\t%d\t %s\n", n+1, counts[n], option)
+	}
+	return w.Flush()
+}
+
+func pollsEndCmd(args []string, stdout, stderr io.Writer) error {
+	flags := pollsFlags("end", stderr)
+	notify := flags.Bool("notify", false, "have the bot update the poll messages and send the results when it next runs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("give the IDs of the polls to end")
+	}
+
+	// Check every poll before ending any, so that a mistyped ID doesn't leave only some of them ended
+	if err := checkPollIDs(flags.Args(), true); err != nil {
+		return err
+	}
+
+	ended := []string{}
+	for _, id := range flags.Args() {
+		_, err := databasePollEnd(id)
+		if errors.Is(err, errPollNotFound) {
+			// The bot ended it since it was checked
+			return partialError(fmt.Errorf("poll %s has already ended", id), ended, "ended")
+		} else if err != nil {
+			return partialError(fmt.Errorf("error ending poll %s: %w", id, err), ended, "ended")
+		}
+		ended = append(ended, id)
+
+		// Stop the bot from ending the poll or sending reminders for it
+		if err := scheduler.Cancel(id); err != nil {
+			err = fmt.Errorf("error cancelling jobs for poll %s, the bot may still send its results: %w", id, err)
+			return partialError(err, ended, "ended")
+		}
+
+		if *notify {
+			// Ending an ended poll only updates its message, see endPoll, so the results are queued here
+			err := scheduler.Schedule(JobEndPoll, id, time.Now())
+			if err == nil {
+				err = schedulePollResults(id)
+			}
+			if err != nil {
+				err = fmt.Errorf("error scheduling results for poll %s, it has ended but the bot may not update its message or send its results: %w", id, err)
+				return partialError(err, ended, "ended")
+			}
+			fmt.Fprintf(stdout, "Ended poll %s, the bot will send the results.\n", id)
+		} else {
+			fmt.Fprintf(stdout, "Ended poll %s.\n", id)
+		}
+	}
+	return nil
+}
+
+func pollsDeleteCmd(args []string, stdout, stderr io.Writer) error {
+	flags := pollsFlags("delete", stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("give the IDs of the polls to delete")
+	}
+
+	// Check every poll before deleting any, like end
+	if err := checkPollIDs(flags.Args(), false); err != nil {
+		return err
+	}
+
+	deleted := []string{}
+	for _, id := range flags.Args() {
+		poll, err := databasePollGet(id)
+		if err == nil {
+			err = databasePollDelete(id)
+		}
+		if err != nil {
+			return partialError(fmt.Errorf("error deleting poll %s: %w", id, err), deleted, "deleted")
+		}
+		deleted = append(deleted, id)
+
+		fmt.Fprintf(stdout, "Deleted poll %s: %s\n", id, poll.Question)
+		if poll.Status == PollStatusActive {
+			fmt.Fprintf(stdout, "The poll message is left as is, votes on it will fail: %s\n", pollMessageURL(poll))
+		}
+	}
+	return nil
+}
+
+// PollExportVersion is the version of the export format, increased when it changes in a way older versions can't read.
+const PollExportVersion = 1
+
+// pollExport is the file written by polls export and read by polls import.
+type pollExport struct {
+	Version int            `json:"version"`
+	Polls   []exportedPoll `json:"polls"`
+}
+
+type exportedPoll struct {
+	ID          string    `json:"id"`
+	Guild       string    `json:"guild"`
+	Channel     string    `json:"channel"`
+	Message     string    `json:"message"`
+	Question    string    `json:"question"`
+	Options     []string  `json:"options"`
+	Creator     string    `json:"creator"`
+	CreatedTime time.Time `json:"created_time"`
+	EndTime     time.Time `json:"end_time"`
+	Mode        PollMode  `json:"mode"`
+	MaxChoices  int       `json:"max_choices"`
+	Anonymous   bool      `json:"anonymous"`
+	// Salt is only kept for active anonymous polls exported with --include-secrets,
+	// so that voters can still change their votes after an import.
+	Salt        string     `json:"salt,omitempty"`
+	HideResults bool       `json:"hide_results"`
+	Status      PollStatus `json:"status"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	Colour      int        `json:"colour"`
+	// Votes are by user ID, or by hashed user ID for anonymous polls.
+	Votes []exportedVote `json:"votes"`
+}
+
+type exportedVote struct {
+	User    string    `json:"user"`
+	Option  int       `json:"option"`
+	Rank    int       `json:"rank,omitempty"`
+	VotedAt time.Time `json:"voted_at"`
+}
+
+func pollsExportCmd(args []string, stdout, stderr io.Writer) error {
+	flags := pollsFlags("export", stderr)
+	status := flags.String("status", "all", "export active, ended or `all` polls")
+	guildId := flags.String("guild", "", "only export polls in the guild with this `ID`")
+	output := flags.String("output", "", "write to this `file` instead of standard output")
+	secrets := flags.Bool("include-secrets", false, "include the salts of active anonymous polls, which link votes to voters")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var polls []dbPoll
+	if flags.NArg() > 0 {
+		for _, id := range flags.Args() {
+			poll, err := databasePollGet(id)
+			if errors.Is(err, errPollNotFound) {
+				return fmt.Errorf("there is no poll %s", id)
+			} else if err != nil {
+				return err
+			}
+			polls = append(polls, poll)
+		}
+	} else {
+		var err error
+		if polls, err = selectPolls(*status, *guildId); err != nil {
+			return err
+		}
+	}
+
+	export := pollExport{Version: PollExportVersion, Polls: []exportedPoll{}}
+	for _, poll := range polls {
+		votes, err := databasePollVotes(poll.ID)
+		if err != nil {
+			return err
+		}
+		export.Polls = append(export.Polls, exportPoll(poll, votes, *secrets))
+	}
+
+	w := stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(export); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+
+	if *output != "" {
+		fmt.Fprintf(stdout, "Exported %d poll%s to %s.\n", len(polls), plural(len(polls)), *output)
+	}
+	return nil
+}
+
+// exportPoll converts a poll for an export, leaving out its salt unless secrets is set.
+func exportPoll(poll dbPoll, votes []dbVote, secrets bool) exportedPoll {
+	exported := exportedPoll{
+		ID:          poll.ID,
+		Guild:       poll.Guild,
+		Channel:     poll.Channel,
+		Message:     poll.Message,
+		Question:    poll.Question,
+		Options:     poll.Options,
+		Creator:     poll.Creator,
+		CreatedTime: poll.CreatedTime,
+		EndTime:     poll.EndTime,
+		Mode:        poll.Mode,
+		MaxChoices:  poll.MaxChoices,
+		Anonymous:   poll.Anonymous,
+		HideResults: poll.HideResults,
+		Status:      poll.Status,
+		Colour:      poll.Colour,
+		Votes:       []exportedVote{},
+	}
+	if secrets {
+		exported.Salt = poll.Salt
+	}
+	if !poll.EndedAt.IsZero() {
+		exported.EndedAt = ptr(poll.EndedAt)
+	}
+	for _, vote := range votes {
+		exported.Votes = append(exported.Votes, exportedVote{User: vote.User, Option: vote.Option, Rank: vote.Rank, VotedAt: vote.VotedAt})
+	}
+	return exported
+}
+
+// importPoll converts an exported poll back, checking that it makes sense.
+func importPoll(exported exportedPoll) (dbPoll, []dbVote, error) {
+	if exported.ID == "" {
+		return dbPoll{}, nil, fmt.Errorf("poll has no ID")
+	}
+	if len(exported.Options) == 0 {
+		return dbPoll{}, nil, fmt.Errorf("poll %s has no options", exported.ID)
+	}
+	if exported.Mode != PollModeSingle && exported.Mode != PollModeRanked {
+		return dbPoll{}, nil, fmt.Errorf("poll %s has unknown mode %q", exported.ID, exported.Mode)
+	}
+	if exported.Status != PollStatusActive && exported.Status != PollStatusEnded {
+		return dbPoll{}, nil, fmt.Errorf("poll %s has unknown status %q", exported.ID, exported.Status)
+	}
+	if exported.Status == PollStatusEnded && exported.EndedAt == nil {
+		return dbPoll{}, nil, fmt.Errorf("poll %s has ended but has no end time", exported.ID)
+	}
+
+	poll := dbPoll{
+		ID:          exported.ID,
+		Guild:       exported.Guild,
+		Channel:     exported.Channel,
+		Message:     exported.Message,
+		Question:    exported.Question,
+		Options:     exported.Options,
+		Creator:     exported.Creator,
+		CreatedTime: exported.CreatedTime,
+		EndTime:     exported.EndTime,
+		Mode:        exported.Mode,
+		MaxChoices:  max(exported.MaxChoices, 1),
+		Anonymous:   exported.Anonymous,
+		HideResults: exported.HideResults,
+		Status:      exported.Status,
+		Colour:      exported.Colour,
+	}
+	if poll.Status == PollStatusActive {
+		// The salt of an ended poll is discarded, see PollStore.EndPoll
+		poll.Salt = exported.Salt
+		if poll.Anonymous && poll.Salt == "" {
+			// Votes can't be matched to voters without the old salt, so a new one is made, see pollsImportCmd
+			salt, err := newPollSalt()
+			if err != nil {
+				return dbPoll{}, nil, err
+			}
+			poll.Salt = salt
+		}
+	} else {
+		poll.EndedAt = *exported.EndedAt
+	}
+
+	votes := make([]dbVote, 0, len(exported.Votes))
+	for _, vote := range exported.Votes {
+		if vote.Option < 0 || vote.Option >= len(poll.Options) {
+			return dbPoll{}, nil, fmt.Errorf("poll %s has a vote for option %d, which doesn't exist", poll.ID, vote.Option)
+		}
+		votes = append(votes, dbVote{Poll: poll.ID, User: vote.User, Option: vote.Option, Rank: vote.Rank, VotedAt: vote.VotedAt})
+	}
+	return poll, votes, nil
+}
+
+func pollsImportCmd(args []string, stdout, stderr io.Writer) error {
+	flags := pollsFlags("import", stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("give one file to import")
+	}
+
+	var r io.Reader = os.Stdin
+	if file := flags.Arg(0); file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var export pollExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("error reading export: %w", err)
+	}
+	if export.Version != PollExportVersion {
+		return fmt.Errorf("export is version %d, only version %d can be imported", export.Version, PollExportVersion)
+	}
+
+	// Check every poll before importing any, so that a bad export doesn't leave a partial import
+	polls := make([]dbPoll, len(export.Polls))
+	votes := make([][]dbVote, len(export.Polls))
+	for n, exported := range export.Polls {
+		var err error
+		if polls[n], votes[n], err = importPoll(exported); err != nil {
+			return err
+		}
+	}
+
+	imported, skipped := 0, 0
+	for n, poll := range polls {
+		if _, err := databasePollGet(poll.ID); err == nil {
+			fmt.Fprintf(stdout, "Skipped poll %s, it already exists.\n", poll.ID)
+			skipped++
+			continue
+		} else if !errors.Is(err, errPollNotFound) {
+			return err
+		}
+
+		if err := databasePollImport(poll, votes[n]); err != nil {
+			return fmt.Errorf("error importing poll %s: %w", poll.ID, err)
+		}
+		if poll.Status == PollStatusActive && poll.Anonymous && export.Polls[n].Salt == "" {
+			fmt.Fprintf(stderr, "Poll %s was exported without its salt, people who already voted on it can vote again.\n", poll.ID)
+		}
+		if poll.Status == PollStatusActive {
+			// The bot ends the poll on time, or straight away if its end has passed
+			if err := scheduler.Ensure(JobEndPoll, poll.ID, poll.EndTime); err != nil {
+				return fmt.Errorf("error scheduling end of poll %s: %w", poll.ID, err)
+			}
+		}
+		imported++
+	}
+
+	fmt.Fprintf(stdout, "Imported %d poll%s, skipped %d.\n", imported, plural(imported), skipped)
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollsExportImport(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	vote(t, s, testMember("2", 0), poll, 1)
+	ended := createTestPoll(t, s, testMember("3", 0))
+	vote(t, s, testMember("4", 0), ended, 0)
+	if err := endPoll(s, ended.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "polls.json")
+	var out bytes.Buffer
+	if err := pollsExportCmd([]string{"--output", file}, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Exported 2 polls to "+file+".\n" {
+		t.Errorf("export printed %q", out.String())
+	}
+
+	// Import into an empty database
+	setupTest(t)
+	out.Reset()
+	if err := pollsImportCmd([]string{file}, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Imported 2 polls, skipped 0.\n" {
+		t.Errorf("import printed %q", out.String())
+	}
+
+	imported, err := databasePollGet(poll.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Status != PollStatusActive || imported.Question != poll.Question || !imported.Votes[1].Has("2") || !imported.EndTime.Equal(poll.EndTime) {
+		t.Errorf("imported poll = %+v, want it to match %+v", imported, poll)
+	}
+	if imported, _ := databasePollGet(ended.ID); imported.Status != PollStatusEnded || imported.EndedAt.IsZero() || !imported.Votes[0].Has("4") {
+		t.Errorf("imported ended poll = %+v, want it to have ended with its vote", imported)
+	}
+
+	// The bot ends the imported active poll on time
+	job, ok, _ := store.NextJob()
+	if !ok || job.Kind != JobEndPoll || job.Target != poll.ID || !job.RunAt.Equal(poll.EndTime) {
+		t.Errorf("next job = %+v, want the imported poll to end at %s", job, poll.EndTime)
+	}
+
+	// Importing again skips the polls that exist
+	out.Reset()
+	if err := pollsImportCmd([]string{file}, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "Imported 0 polls, skipped 2.\n") {
+		t.Errorf("second import printed %q", out.String())
+	}
+}
+
+func TestPollsExportSalt(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0),
+		stringOption("question", "Secret?"),
+		stringOption("options", "Yes;No"),
+		boolOption("anonymous", true),
+	)
+	vote(t, s, testMember("2", 0), poll, 0)
+	poll, _ = databasePollGet(poll.ID)
+
+	dir := t.TempDir()
+	without, with := filepath.Join(dir, "without.json"), filepath.Join(dir, "with.json")
+	if err := pollsExportCmd([]string{"--output", without}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := pollsExportCmd([]string{"--output", with, "--include-secrets"}, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// The salt is left out unless it is asked for
+	if data, _ := os.ReadFile(without); strings.Contains(string(data), poll.Salt) {
+		t.Errorf("export has the salt without --include-secrets:\n%s", data)
+	}
+	if data, _ := os.ReadFile(with); !strings.Contains(string(data), poll.Salt) {
+		t.Errorf("export doesn't have the salt with --include-secrets:\n%s", data)
+	}
+
+	// Without the salt the poll gets a new one, and the voter can vote again
+	setupTest(t)
+	var stderr bytes.Buffer
+	if err := pollsImportCmd([]string{without}, io.Discard, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "can vote again") {
+		t.Errorf("import warned %q, want it to say that people can vote again", stderr.String())
+	}
+	imported, _ := databasePollGet(poll.ID)
+	if imported.Salt == "" || imported.Salt == poll.Salt {
+		t.Errorf("imported salt = %q, want a new one", imported.Salt)
+	}
+	if imported.Votes[0].Len() != 1 {
+		t.Errorf("imported poll has %d votes for Yes, want the exported vote", imported.Votes[0].Len())
+	}
+
+	// With the salt the poll is imported as it was
+	setupTest(t)
+	stderr.Reset()
+	if err := pollsImportCmd([]string{with}, io.Discard, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("import warned %q", stderr.String())
+	}
+	if imported, _ := databasePollGet(poll.ID); imported.Salt != poll.Salt {
+		t.Errorf("imported salt = %q, want %q", imported.Salt, poll.Salt)
+	}
+}
+
+func TestPollsImportInvalid(t *testing.T) {
+	setupTest(t)
+
+	tests := map[string]string{
+		"wrong version": `{"version": 2, "polls": []}`,
+		"bad option":    `{"version": 1, "polls": [{"id": "a", "options": ["x", "y"], "mode": "single", "status": "active", "votes": [{"user": "1", "option": 2}]}]}`,
+		"bad status":    `{"version": 1, "polls": [{"id": "a", "options": ["x", "y"], "mode": "single", "status": "paused"}]}`,
+	}
+	for name, export := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "polls.json")
+			if err := os.WriteFile(file, []byte(export), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := pollsImportCmd([]string{file}, &bytes.Buffer{}, io.Discard); err == nil {
+				t.Error("invalid export was imported")
+			}
+			if polls, _ := databasePollAll(); len(polls) != 0 {
+				t.Errorf("%d polls were imported from an invalid export", len(polls))
+			}
+		})
+	}
+}
+
+func TestPollsEnd(t *testing.T) {
+	s := setupTest(t)
+	quiet := createTestPoll(t, s, testMember("1", 0))
+	notified := createTestPoll(t, s, testMember("2", 0))
+
+	var out bytes.Buffer
+	if err := pollsEndCmd([]string{quiet.ID}, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := pollsEndCmd([]string{"--notify", notified.ID}, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{quiet.ID, notified.ID} {
+		if poll, _ := databasePollGet(id); poll.Status != PollStatusEnded {
+			t.Errorf("poll %s is %s, want it to have ended", id, poll.Status)
+		}
+	}
+
+	// Only the notified poll is left for the bot to finish off
+	job, ok, _ := store.NextJob()
+	if !ok || job.Kind != JobEndPoll || job.Target != notified.ID || time.Until(job.RunAt) > 0 {
+		t.Fatalf("next job = %+v, want the notified poll to be finished now", job)
+	}
+	scheduler.runDue()
+	if message, _ := s.message(notified.Message); len(message.Components) != 0 {
+		t.Error("notified poll's message wasn't updated")
+	}
+	if message, _ := s.message(quiet.Message); len(message.Components) == 0 {
+		t.Error("quietly ended poll's message was updated")
+	}
+	if dms := s.channelMessages("dm-2"); len(dms) != 1 {
+		t.Errorf("creator of the notified poll got %d DMs, want the results", len(dms))
+	}
+	if dms := s.channelMessages("dm-1"); len(dms) != 0 {
+		t.Errorf("creator of the quietly ended poll got %d DMs, want none", len(dms))
+	}
+
+	if err := pollsEndCmd([]string{quiet.ID}, &out, io.Discard); err == nil {
+		t.Error("ending an ended poll succeeded")
+	}
+}
+
+func TestPollsEndChecksEveryPoll(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	ended := createTestPoll(t, s, testMember("2", 0))
+	if err := endPoll(s, ended.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ids := range [][]string{{poll.ID, "missing"}, {poll.ID, ended.ID}, {poll.ID, poll.ID}} {
+		var out bytes.Buffer
+		if err := pollsEndCmd(ids, &out, io.Discard); err == nil {
+			t.Errorf("ending %v succeeded", ids)
+		}
+		if got, _ := databasePollGet(poll.ID); got.Status != PollStatusActive || out.Len() != 0 {
+			t.Errorf("ending %v ended the valid poll, printing %q", ids, out.String())
+		}
+	}
+}
+
+func TestPollsFlagErrors(t *testing.T) {
+	setupTest(t)
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Database.Driver = "memory"
+
+	var stdout, stderr bytes.Buffer
+	if code := runPollsCommand([]string{"list", "--colour"}, &stdout, &stderr); code == 0 {
+		t.Error("list with an unknown flag succeeded")
+	}
+	if !strings.Contains(stderr.String(), "flag provided but not defined: -colour") || !strings.Contains(stderr.String(), "-status") {
+		t.Errorf("stderr = %q, want the flag error and usage", stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("stdout = %q, want nothing", stdout.String())
+	}
+}
+
+func TestPollsDelete(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	vote(t, s, testMember("2", 0), poll, 0)
+
+	var out bytes.Buffer
+	if err := pollsDeleteCmd([]string{poll.ID}, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := databasePollGet(poll.ID); err == nil {
+		t.Error("poll still exists after being deleted")
+	}
+	if votes, _ := databasePollVotes(poll.ID); len(votes) != 0 {
+		t.Errorf("%d votes are left after the poll was deleted", len(votes))
+	}
+	if _, ok, _ := store.NextJob(); ok {
+		t.Error("jobs are left after the poll was deleted")
+	}
+
+	// The user can create a new poll
+	createTestPoll(t, s, testMember("1", 0))
+}
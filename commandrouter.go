@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// CommandHandler handles a slash command. Returning an error replies to the user with an ephemeral error message,
+// see commandErrorf for errors that should be shown to the user as is.
+type CommandHandler func(c *CommandContext) error
+
+// DeferMode is how a command acknowledges its interaction before its handler runs.
+type DeferMode int
+
+const (
+	// DeferNone leaves responding to the handler, which must do so within three seconds.
+	DeferNone DeferMode = iota
+	// DeferEphemeral shows a loading message only the user can see, which the handler's reply replaces.
+	DeferEphemeral
+	// DeferPublic shows a loading message everyone can see, which the handler's reply replaces.
+	DeferPublic
+)
+
+// Command is a slash command, subcommand group or subcommand, or a context menu command.
+// A command either has a handler and options, or subcommands that interactions are routed to by name.
+type Command struct {
+	// Type is the kind of a top level command, a slash command if it isn't set. Context menu commands
+	// have no description or options, and their names are shown in the menu as is, e.g. "Manage poll".
+	Type        discordgo.ApplicationCommandType
+	Name        string
+	Description string
+	Options     []*discordgo.ApplicationCommandOption
+	Subcommands []*Command
+	Handler     CommandHandler
+	Defer       DeferMode
+	// Permissions are the Discord permissions a member needs to use the command. For top level commands they are registered
+	// as the command's default member permissions, which Discord enforces and server admins can change in their integration settings.
+	// For subcommands they are checked before the handler runs, see checkCommandPermissions.
+	Permissions int64
+	// GuildOnly hides a top level command in DMs.
+	GuildOnly bool
+	// Guilds limits a top level command to being registered in these guilds instead of globally.
+	Guilds []string
+}
+
+// ApplicationCommand creates the definition of a top level command to register with Discord.
+func (c *Command) ApplicationCommand() *discordgo.ApplicationCommand {
+	command := &discordgo.ApplicationCommand{
+		Type:         c.Type,
+		Name:         c.Name,
+		Description:  c.Description,
+		Options:      c.applicationOptions(),
+		DMPermission: ptr(!c.GuildOnly),
+	}
+	if c.Permissions != 0 {
+		command.DefaultMemberPermissions = ptr(c.Permissions)
+	}
+	return command
+}
+
+func (c *Command) applicationOptions() []*discordgo.ApplicationCommandOption {
+	if len(c.Subcommands) == 0 {
+		return c.Options
+	}
+
+	options := make([]*discordgo.ApplicationCommandOption, 0, len(c.Subcommands))
+	for _, sub := range c.Subcommands {
+		optionType := discordgo.ApplicationCommandOptionSubCommand
+		if len(sub.Subcommands) > 0 {
+			optionType = discordgo.ApplicationCommandOptionSubCommandGroup
+		}
+
+		options = append(options, &discordgo.ApplicationCommandOption{
+			Type:        optionType,
+			Name:        sub.Name,
+			Description: sub.Description,
+			Options:     sub.applicationOptions(),
+		})
+	}
+	return options
+}
+
+// route finds the subcommand that options select. It returns the path of commands from c to the subcommand, along with the subcommand's options.
+func (c *Command) route(options []*discordgo.ApplicationCommandInteractionDataOption) ([]*Command, []*discordgo.ApplicationCommandInteractionDataOption, error) {
+	if len(c.Subcommands) == 0 {
+		return []*Command{c}, options, nil
+	}
+
+	for _, option := range options {
+		if option.Type != discordgo.ApplicationCommandOptionSubCommand && option.Type != discordgo.ApplicationCommandOptionSubCommandGroup {
+			continue
+		}
+
+		for _, sub := range c.Subcommands {
+			if sub.Name == option.Name {
+				path, options, err := sub.route(option.Options)
+				return append([]*Command{c}, path...), options, err
+			}
+		}
+		return nil, nil, fmt.Errorf("unknown subcommand %s %s", c.Name, option.Name)
+	}
+
+	return nil, nil, fmt.Errorf("no subcommand given for %s", c.Name)
+}
+
+// commandPathName gets the full name of the last command in a path, e.g. "poll create".
+func commandPathName(path []*Command) string {
+	names := make([]string, 0, len(path))
+	for _, command := range path {
+		names = append(names, command.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+// commandError is an error with a message meant for the user who ran a command.
+type commandError struct {
+	message string
+}
+
+func (e *commandError) Error() string {
+	return e.message
+}
+
+// commandErrorf creates an error that is shown to the user as is, for problems the user can fix such as invalid options.
+// It can be returned from component handlers too.
+// Other errors are logged and the user is shown a generic message.
+func commandErrorf(format string, args ...any) error {
+	return &commandError{message: fmt.Sprintf(format, args...)}
+}
+
+// genericErrorMessage is shown to the user when a handler fails for a reason they can't fix.
+const genericErrorMessage = "Something went wrong, please try again later."
+
+// interactionErrorMessage gets the message to show the user for an error returned by a handler.
+// Errors from commandErrorf are shown as is, anything else is replaced with a generic message.
+func interactionErrorMessage(err error) string {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.message
+	}
+	return genericErrorMessage
+}
+
+// CommandContext holds a command interaction being handled.
+type CommandContext struct {
+	// Context is cancelled once the interaction can no longer be responded to.
+	Context     context.Context
+	Session     Session
+	Interaction *discordgo.InteractionCreate
+	// Name is the full name of the command, including any subcommands, e.g. "poll create".
+	Name    string
+	Options CommandOptions
+
+	responded bool
+	ephemeral bool
+}
+
+// User gets the user who ran the command, both in a guild and in DMs.
+func (c *CommandContext) User() *discordgo.User {
+	if c.Interaction.Member != nil {
+		return c.Interaction.Member.User
+	}
+	return c.Interaction.User
+}
+
+// Defer acknowledges the interaction with a loading message. It does nothing if the interaction has already been responded to.
+func (c *CommandContext) Defer(ephemeral bool) error {
+	if c.responded {
+		return nil
+	}
+
+	response := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{},
+	}
+	if ephemeral {
+		response.Data.Flags = discordgo.MessageFlagsEphemeral
+	}
+
+	if err := c.Session.InteractionRespond(c.Interaction.Interaction, response); err != nil {
+		return fmt.Errorf("error deferring response: %w", err)
+	}
+
+	c.responded = true
+	c.ephemeral = ephemeral
+	return nil
+}
+
+// Respond replies to the command, replacing the loading message if the response was deferred.
+// Whether a deferred response is ephemeral was decided when it was deferred, so the ephemeral flag of data is ignored then.
+func (c *CommandContext) Respond(data *discordgo.InteractionResponseData) error {
+	if !c.responded {
+		err := c.Session.InteractionRespond(c.Interaction.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: data,
+		})
+		if err != nil {
+			return fmt.Errorf("error responding: %w", err)
+		}
+
+		c.responded = true
+		c.ephemeral = data.Flags&discordgo.MessageFlagsEphemeral != 0
+		return nil
+	}
+
+	edit := &discordgo.WebhookEdit{
+		Content: &data.Content,
+	}
+	if len(data.Embeds) > 0 {
+		edit.Embeds = &data.Embeds
+	}
+	if len(data.Components) > 0 {
+		edit.Components = &data.Components
+	}
+	if len(data.Files) > 0 {
+		edit.Files = data.Files
+	}
+
+	if _, err := c.Session.InteractionResponseEdit(c.Interaction.Interaction, edit); err != nil {
+		return fmt.Errorf("error editing response: %w", err)
+	}
+	return nil
+}
+
+// Reply replies to the command with a message.
+func (c *CommandContext) Reply(content string) error {
+	return c.Respond(&discordgo.InteractionResponseData{Content: content})
+}
+
+// ReplyEphemeral replies to the command with a message only the user can see.
+func (c *CommandContext) ReplyEphemeral(content string) error {
+	return c.Respond(&discordgo.InteractionResponseData{
+		Content: content,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+}
+
+// replyError shows an error message that only the user can see. If the response was deferred publicly,
+// the loading message is removed and the error is sent as an ephemeral followup instead.
+func (c *CommandContext) replyError(message string) error {
+	if !c.responded || c.ephemeral {
+		return c.ReplyEphemeral(message)
+	}
+
+	if err := c.Session.InteractionResponseDelete(c.Interaction.Interaction); err != nil {
+		loggerFrom(c.Context).Warn("Failed to delete response", "error", err)
+	}
+
+	_, err := c.Session.FollowupMessageCreate(c.Interaction.Interaction, false, &discordgo.WebhookParams{
+		Content: message,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+	return err
+}
+
+// runCommand routes a command interaction to the handler of its subcommand,
+// deferring the response if the subcommand asks for it. Any error the handler returns is shown to the user and then returned.
+func runCommand(ctx context.Context, s Session, i *discordgo.InteractionCreate, command *Command) error {
+	data := i.ApplicationCommandData()
+	c := &CommandContext{
+		Context:     ctx,
+		Session:     s,
+		Interaction: i,
+		Name:        data.Name,
+	}
+
+	var sub *Command
+	path, options, err := command.route(data.Options)
+	if err == nil {
+		sub = path[len(path)-1]
+		c.Name = commandPathName(path)
+		c.Options = newCommandOptions(options)
+
+		if command.GuildOnly && i.GuildID == "" {
+			err = commandErrorf("This command can only be used in a server.")
+		} else {
+			err = checkCommandPermissions(c, path)
+		}
+	}
+
+	if err == nil && sub.Defer != DeferNone {
+		err = c.Defer(sub.Defer == DeferEphemeral)
+	}
+	if err == nil {
+		err = sub.Handler(c)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if err := c.replyError(interactionErrorMessage(err)); err != nil {
+		loggerFrom(ctx).Warn("Failed to send error message", "error", err)
+	}
+	return err
+}
+
+// CommandOptions gives typed access to the options of a command by name. Each accessor takes the value to use if the option wasn't given.
+type CommandOptions map[string]*discordgo.ApplicationCommandInteractionDataOption
+
+func newCommandOptions(options []*discordgo.ApplicationCommandInteractionDataOption) CommandOptions {
+	o := CommandOptions{}
+	for _, option := range options {
+		o[option.Name] = option
+	}
+	return o
+}
+
+// Has checks if an option was given.
+func (o CommandOptions) Has(name string) bool {
+	_, ok := o[name]
+	return ok
+}
+
+func (o CommandOptions) String(name, def string) string {
+	if option, ok := o[name]; ok {
+		return option.StringValue()
+	}
+	return def
+}
+
+func (o CommandOptions) Int(name string, def int) int {
+	if option, ok := o[name]; ok {
+		return int(option.IntValue())
+	}
+	return def
+}
+
+func (o CommandOptions) Bool(name string, def bool) bool {
+	if option, ok := o[name]; ok {
+		return option.BoolValue()
+	}
+	return def
+}
+
+// Role gets the ID of a role option.
+func (o CommandOptions) Role(name, def string) string {
+	if option, ok := o[name]; ok {
+		return option.RoleValue(nil, "").ID
+	}
+	return def
+}
+
+// User gets the ID of a user option.
+func (o CommandOptions) User(name, def string) string {
+	if option, ok := o[name]; ok {
+		return option.UserValue(nil).ID
+	}
+	return def
+}
+
+// Channel gets the ID of a channel option.
+func (o CommandOptions) Channel(name, def string) string {
+	if option, ok := o[name]; ok {
+		return option.ChannelValue(nil).ID
+	}
+	return def
+}
+
+// Duration parses a string option as a duration such as 1h30m, see parseDuration.
+func (o CommandOptions) Duration(name string, def time.Duration) (time.Duration, error) {
+	option, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	return parseDuration(strings.TrimSpace(option.StringValue()))
+}
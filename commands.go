@@ -1,117 +1,391 @@
 package main
 
 import (
-	"os"
+	"fmt"
+	"strings"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-type Command struct {
-	ApplicationCommand *discordgo.ApplicationCommand
-	Handler            func(*discordgo.Session, *discordgo.InteractionCreate)
-}
-
-var commands = []Command{
+var commands = []*Command{
 	{
-		ApplicationCommand: &discordgo.ApplicationCommand{
-			Name:        "ping",
-			Description: "Ping the bot",
-		},
-		Handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-			s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-				Type: discordgo.InteractionResponseChannelMessageWithSource,
-				Data: &discordgo.InteractionResponseData{
-					Content: "Pong!",
-				},
-			})
+		Name:        "ping",
+		Description: "Ping the bot",
+		Handler: func(c *CommandContext) error {
+			return c.Reply("Pong!")
 		},
 	},
 	{
-		ApplicationCommand: &discordgo.ApplicationCommand{
-			Name:        "poll",
-			Description: "Poll commands",
-			Options: []*discordgo.ApplicationCommandOption{
-				{
-					Type:        discordgo.ApplicationCommandOptionSubCommand,
-					Name:        "create",
-					Description: "Create a poll",
-					Options: []*discordgo.ApplicationCommandOption{
-						{
-							Type:        discordgo.ApplicationCommandOptionString,
-							Name:        "question",
-							Description: "The question to ask",
-							Required:    true,
-						},
-						{
-							Type:        discordgo.ApplicationCommandOptionString,
-							Name:        "option1",
-							Description: "Name of an option that users can vote on",
-							Required:    true,
-							MaxLength:   80,
-						},
-						{
-							Type:        discordgo.ApplicationCommandOptionString,
-							Name:        "option2",
-							Description: "Name of an option that users can vote on",
-							Required:    true,
-							MaxLength:   80,
+		Name:        "poll",
+		Description: "Poll commands",
+		GuildOnly:   true,
+		Subcommands: []*Command{
+			{
+				Name:        "create",
+				Description: "Create a poll",
+				Defer:       DeferEphemeral,
+				Handler:     createPollCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "question",
+						Description: "The question to ask",
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "option1",
+						Description: "Name of an option that users can vote on",
+						Required:    false,
+						MaxLength:   80,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "option2",
+						Description: "Name of an option that users can vote on",
+						Required:    false,
+						MaxLength:   80,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "option3",
+						Description: "Name of an option that users can vote on",
+						Required:    false,
+						MaxLength:   80,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "option4",
+						Description: "Name of an option that users can vote on",
+						Required:    false,
+						MaxLength:   80,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "option5",
+						Description: "Name of an option that users can vote on",
+						Required:    false,
+						MaxLength:   80,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "options",
+						Description: "Options that users can vote on, separated by semicolons (up to 25)",
+						Required:    false,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "mode",
+						Description: "How votes are counted",
+						Required:    false,
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "Single choice", Value: string(PollModeSingle)},
+							{Name: "Ranked choice (instant runoff)", Value: string(PollModeRanked)},
 						},
-						{
-							Type:        discordgo.ApplicationCommandOptionString,
-							Name:        "option3",
-							Description: "Name of an option that users can vote on",
-							Required:    false,
-							MaxLength:   80,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "max_choices",
+						Description: "How many options each user may vote for",
+						Required:    false,
+						MinValue:    ptr(1.0),
+						MaxValue:    MaxPollOptions,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionBoolean,
+						Name:        "anonymous",
+						Description: "Don't store who voted for what",
+						Required:    false,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionBoolean,
+						Name:        "hide_results",
+						Description: "Only show the number of votes until the poll ends",
+						Required:    false,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "duration",
+						Description: "How long the poll should last",
+						Required:    false,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "remind_before",
+						Description: "How long before the poll ends to post a reminder, e.g. 10m",
+						Required:    false,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionRole,
+						Name:        "remind_role",
+						Description: "A role to ping with the reminder",
+						Required:    false,
+					},
+				},
+			},
+			{
+				Name:        "end",
+				Description: "End your poll, or any poll if you're a moderator",
+				Defer:       DeferEphemeral,
+				Handler:     endPollCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "poll",
+						Description: "A link to the poll's message, or the poll's ID, your latest poll by default",
+						Required:    false,
+					},
+				},
+			},
+			{
+				Name:        "cancel",
+				Description: "Stop a poll without results, discarding its votes",
+				Defer:       DeferEphemeral,
+				Handler:     cancelPollCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "poll",
+						Description: "A link to the poll's message, or the poll's ID",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Name:        "delete",
+				Description: "Delete a poll along with its votes and its message",
+				Defer:       DeferEphemeral,
+				Handler:     deletePollCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "poll",
+						Description: "A link to the poll's message, or the poll's ID",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Name:        "list",
+				Description: "List the polls running in this server",
+				Defer:       DeferEphemeral,
+				Handler:     listPollCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "page",
+						Description: "The page of the list to show",
+						Required:    false,
+						MinValue:    ptr(1.0),
+					},
+				},
+			},
+			{
+				Name:        "history",
+				Description: "Browse the polls that have ended in this server",
+				Defer:       DeferEphemeral,
+				Handler:     historyPollCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "page",
+						Description: "The page of the history to show",
+						Required:    false,
+						MinValue:    ptr(1.0),
+					},
+				},
+			},
+			{
+				Name:        "export",
+				Description: "Download the results of a poll for a spreadsheet",
+				Defer:       DeferEphemeral,
+				Handler:     exportPollCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "poll",
+						Description: "A link to the poll's message, or the poll's ID",
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "format",
+						Description: "The file format, CSV by default",
+						Required:    false,
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "CSV", Value: "csv"},
+							{Name: "JSON", Value: "json"},
 						},
-						{
-							Type:        discordgo.ApplicationCommandOptionString,
-							Name:        "option4",
-							Description: "Name of an option that users can vote on",
-							Required:    false,
-							MaxLength:   80,
+					},
+				},
+			},
+		},
+	},
+	{
+		Type:      discordgo.MessageApplicationCommand,
+		Name:      "Manage poll",
+		GuildOnly: true,
+		Defer:     DeferEphemeral,
+		Handler:   managePollMessageCmd,
+	},
+	{
+		Name:        "config",
+		Description: "Configure the bot for this server",
+		GuildOnly:   true,
+		Permissions: discordgo.PermissionManageServer,
+		Subcommands: []*Command{
+			{
+				Name:        "view",
+				Description: "Show this server's settings",
+				Defer:       DeferEphemeral,
+				Handler:     configViewCmd,
+			},
+			{
+				Name:        "set",
+				Description: "Change one of this server's settings",
+				Defer:       DeferEphemeral,
+				Handler:     configSetCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "setting",
+						Description: "The setting to change",
+						Required:    true,
+						Choices:     guildSettingChoices(),
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "value",
+						Description: "The new value, e.g. 2h, #FEE75C or #polls. Leave it out to clear a channel or role",
+						Required:    false,
+					},
+				},
+			},
+			{
+				Name:        "reset",
+				Description: "Put one or all of this server's settings back to their defaults",
+				Defer:       DeferEphemeral,
+				Handler:     configResetCmd,
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "setting",
+						Description: "The setting to reset, or leave empty to reset every setting",
+						Required:    false,
+						Choices:     guildSettingChoices(),
+					},
+				},
+			},
+			{
+				Name:        "permissions",
+				Description: "Control who can use commands and where",
+				Subcommands: []*Command{
+					{
+						Name:        "view",
+						Description: "Show the command permissions set up in this server",
+						Defer:       DeferEphemeral,
+						Handler:     configPermissionsViewCmd,
+					},
+					{
+						Name:        "allow",
+						Description: "Only let members with the allowed roles use a command, or only in the allowed channels",
+						Defer:       DeferEphemeral,
+						Handler:     configPermissionsAllowCmd,
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "command",
+								Description: "The full name of the command or subcommand, e.g. poll create",
+								Required:    true,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionRole,
+								Name:        "role",
+								Description: "A role to allow",
+								Required:    false,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionChannel,
+								Name:        "channel",
+								Description: "A channel to allow",
+								Required:    false,
+							},
 						},
-						{
-							Type:        discordgo.ApplicationCommandOptionString,
-							Name:        "option5",
-							Description: "Name of an option that users can vote on",
-							Required:    false,
-							MaxLength:   80,
+					},
+					{
+						Name:        "remove",
+						Description: "Remove an allowed role or channel from a command",
+						Defer:       DeferEphemeral,
+						Handler:     configPermissionsRemoveCmd,
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "command",
+								Description: "The full name of the command or subcommand, e.g. poll create",
+								Required:    true,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionRole,
+								Name:        "role",
+								Description: "A role to remove",
+								Required:    false,
+							},
+							{
+								Type:        discordgo.ApplicationCommandOptionChannel,
+								Name:        "channel",
+								Description: "A channel to remove",
+								Required:    false,
+							},
 						},
-						{
-							Type:        discordgo.ApplicationCommandOptionString,
-							Name:        "duration",
-							Description: "How long the poll should last",
-							Required:    false,
+					},
+					{
+						Name:        "reset",
+						Description: "Remove all the allowed roles and channels from a command",
+						Defer:       DeferEphemeral,
+						Handler:     configPermissionsResetCmd,
+						Options: []*discordgo.ApplicationCommandOption{
+							{
+								Type:        discordgo.ApplicationCommandOptionString,
+								Name:        "command",
+								Description: "The full name of the command or subcommand, e.g. poll create",
+								Required:    true,
+							},
 						},
 					},
 				},
-				{
-					Type:        discordgo.ApplicationCommandOptionSubCommand,
-					Name:        "end",
-					Description: "End your poll",
-				},
 			},
 		},
-		Handler: handlePollCmd,
 	},
 }
 
+// registeredCommands holds the commands that interactions are routed to, by name.
 var registeredCommands = make(map[string]*Command)
 
-func registerCommands(s *discordgo.Session) {
-	devGuild, dev := os.LookupEnv("DEV_GUILD")
-
+// registerCommands syncs the commands registered with Discord with commands, see commandScopes. sweep are the guilds to check for
+// commands left by earlier runs. Failures are reported rather than stopping the bot, as the commands registered by a previous run will usually still work.
+func registerCommands(s Session, appID string, sweep []string) error {
 	for _, command := range commands {
-		var err error
-		if dev {
-			_, err = s.ApplicationCommandCreate(s.State.User.ID, devGuild, command.ApplicationCommand)
-		} else {
-			_, err = s.ApplicationCommandCreate(s.State.User.ID, "", command.ApplicationCommand)
+		registeredCommands[command.Name] = command
+	}
+
+	failed := []string{}
+	for guildID, wanted := range commandScopes(commands, config.DevGuild, sweep) {
+		scope := "global scope"
+		if guildID != GlobalScope {
+			scope = "guild " + guildID
 		}
+
+		diff, err := syncCommands(s, appID, guildID, wanted)
 		if err != nil {
-			panic(err)
+			logger.Error("Failed to sync commands", "scope", scope, "error", err)
+			failed = append(failed, scope)
+		} else if !diff.empty() {
+			logger.Info("Synced commands", "scope", scope, "added", diff.Added, "updated", diff.Updated, "removed", diff.Removed)
 		}
+	}
 
-		registeredCommands[command.ApplicationCommand.Name] = &command
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to sync commands in %s", strings.Join(failed, ", "))
 	}
+	return nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// GlobalScope is the scope of commands registered in every guild and in DMs, as opposed to a single guild.
+const GlobalScope = ""
+
+// commandDiff is what a sync changes in a scope, by command name.
+type commandDiff struct {
+	Added   []string
+	Updated []string
+	Removed []string
+}
+
+func (d commandDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Removed) == 0
+}
+
+func (d commandDiff) String() string {
+	return fmt.Sprintf("%d added %v, %d updated %v, %d removed %v", len(d.Added), d.Added, len(d.Updated), d.Updated, len(d.Removed), d.Removed)
+}
+
+// commandScopes works out which commands should be registered in each scope.
+// With a dev guild every command is registered there and the global scope is left alone, so a development build
+// sharing an application with production doesn't remove its commands. Otherwise commands are registered globally
+// unless they are limited to some guilds, and the global scope is always synced so removed commands are cleaned up.
+// The guilds to sweep get a scope too, empty if none of its commands are wanted, so commands registered there by earlier runs
+// are removed, for example when a guild is dropped from Command.Guilds or was the dev guild. See Config.SweepGuildCommands.
+func commandScopes(commands []*Command, devGuild string, sweep []string) map[string][]*discordgo.ApplicationCommand {
+	scopes := map[string][]*discordgo.ApplicationCommand{}
+
+	if devGuild != "" {
+		scopes[devGuild] = []*discordgo.ApplicationCommand{}
+		for _, command := range commands {
+			scopes[devGuild] = append(scopes[devGuild], command.ApplicationCommand())
+		}
+		return scopes
+	}
+
+	scopes[GlobalScope] = []*discordgo.ApplicationCommand{}
+	for _, guild := range sweep {
+		scopes[guild] = []*discordgo.ApplicationCommand{}
+	}
+	for _, command := range commands {
+		if len(command.Guilds) == 0 {
+			scopes[GlobalScope] = append(scopes[GlobalScope], command.ApplicationCommand())
+		}
+		for _, guild := range command.Guilds {
+			scopes[guild] = append(scopes[guild], command.ApplicationCommand())
+		}
+	}
+	return scopes
+}
+
+// syncCommands makes the commands registered in a scope match the wanted commands. Nothing is sent to Discord if they already match,
+// otherwise the whole scope is replaced with a single bulk overwrite, which keeps the IDs of commands that still exist and removes stale ones.
+func syncCommands(s Session, appID, guildID string, wanted []*discordgo.ApplicationCommand) (commandDiff, error) {
+	current, err := s.ApplicationCommands(appID, guildID)
+	if err != nil {
+		return commandDiff{}, fmt.Errorf("error getting registered commands: %w", err)
+	}
+
+	diff := diffCommands(current, wanted, guildID == GlobalScope)
+	if diff.empty() {
+		return diff, nil
+	}
+
+	if _, err := s.ApplicationCommandBulkOverwrite(appID, guildID, wanted); err != nil {
+		return commandDiff{}, fmt.Errorf("error overwriting commands: %w", err)
+	}
+	return diff, nil
+}
+
+// diffCommands compares the commands registered in a scope against the wanted commands.
+func diffCommands(current, wanted []*discordgo.ApplicationCommand, global bool) commandDiff {
+	registered := map[string]string{}
+	for _, command := range current {
+		registered[command.Name] = canonicalCommand(command, global)
+	}
+
+	diff := commandDiff{}
+	for _, command := range wanted {
+		existing, ok := registered[command.Name]
+		if !ok {
+			diff.Added = append(diff.Added, command.Name)
+		} else if existing != canonicalCommand(command, global) {
+			diff.Updated = append(diff.Updated, command.Name)
+		}
+		delete(registered, command.Name)
+	}
+
+	for name := range registered {
+		diff.Removed = append(diff.Removed, name)
+	}
+	sort.Strings(diff.Removed)
+
+	return diff
+}
+
+type canonicalCommandOption struct {
+	Type         discordgo.ApplicationCommandOptionType
+	Name         string
+	Description  string
+	Required     bool
+	Autocomplete bool
+	ChannelTypes []discordgo.ChannelType
+	Choices      []string
+	MinValue     *float64
+	MaxValue     float64
+	MinLength    *int
+	MaxLength    int
+	Options      []canonicalCommandOption
+}
+
+// canonicalCommand describes the parts of a command that we set, in a form that is the same whether the command
+// was built by us or returned by Discord, which fills in IDs and defaults and leaves out empty lists.
+func canonicalCommand(command *discordgo.ApplicationCommand, global bool) string {
+	commandType := command.Type
+	if commandType == 0 {
+		commandType = discordgo.ChatApplicationCommand
+	}
+
+	// DM permission only applies to global commands, and defaults to allowed
+	var dmPermission *bool
+	if global {
+		dmPermission = ptr(command.DMPermission == nil || *command.DMPermission)
+	}
+
+	data, _ := json.Marshal(struct {
+		Type                     discordgo.ApplicationCommandType
+		Name                     string
+		Description              string
+		DefaultMemberPermissions *int64
+		DMPermission             *bool
+		Options                  []canonicalCommandOption
+	}{commandType, command.Name, command.Description, command.DefaultMemberPermissions, dmPermission, canonicalOptions(command.Options)})
+	return string(data)
+}
+
+func canonicalOptions(options []*discordgo.ApplicationCommandOption) []canonicalCommandOption {
+	if len(options) == 0 {
+		return nil
+	}
+
+	canonical := make([]canonicalCommandOption, 0, len(options))
+	for _, option := range options {
+		c := canonicalCommandOption{
+			Type:         option.Type,
+			Name:         option.Name,
+			Description:  option.Description,
+			Required:     option.Required,
+			Autocomplete: option.Autocomplete,
+			MinValue:     option.MinValue,
+			MaxValue:     option.MaxValue,
+			MinLength:    option.MinLength,
+			MaxLength:    option.MaxLength,
+			Options:      canonicalOptions(option.Options),
+		}
+
+		if len(option.ChannelTypes) > 0 {
+			c.ChannelTypes = append([]discordgo.ChannelType(nil), option.ChannelTypes...)
+			sort.Slice(c.ChannelTypes, func(i, j int) bool { return c.ChannelTypes[i] < c.ChannelTypes[j] })
+		}
+
+		// Discord returns numeric choice values as floats, so compare values by how they print
+		for _, choice := range option.Choices {
+			c.Choices = append(c.Choices, fmt.Sprintf("%s=%v", choice.Name, choice.Value))
+		}
+
+		canonical = append(canonical, c)
+	}
+	return canonical
+}
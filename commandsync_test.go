@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// syncTestScopes syncs the scopes of commands like registerCommands, sweeping the test guild.
+func syncTestScopes(t *testing.T, s *fakeSession, commands []*Command, devGuild string) {
+	t.Helper()
+
+	for guildID, wanted := range commandScopes(commands, devGuild, []string{testGuild}) {
+		if _, err := syncCommands(s, testApp, guildID, wanted); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncCommandsRemovedGuild(t *testing.T) {
+	s := setupTest(t)
+	beta := &Command{Name: "beta", Description: "A command being tried out", Guilds: []string{testGuild}}
+
+	syncTestScopes(t, s, []*Command{beta}, "")
+	if commands := s.commands[testGuild]; len(commands) != 1 || commands[0].Name != "beta" {
+		t.Fatalf("guild has commands %v, want beta", commands)
+	}
+
+	// The command is released to every guild, so the guild's copy is removed
+	beta.Guilds = nil
+	syncTestScopes(t, s, []*Command{beta}, "")
+	if commands := s.commands[testGuild]; len(commands) != 0 {
+		t.Errorf("guild still has %d commands after it was dropped from the command's guilds", len(commands))
+	}
+	if commands := s.commands[GlobalScope]; len(commands) != 1 || commands[0].Name != "beta" {
+		t.Errorf("global scope has commands %v, want beta", commands)
+	}
+}
+
+func TestSyncCommandsDevGuildUnset(t *testing.T) {
+	s := setupTest(t)
+	ping := &Command{Name: "ping", Description: "Ping the bot"}
+
+	syncTestScopes(t, s, []*Command{ping}, testGuild)
+	if commands := s.commands[testGuild]; len(commands) != 1 {
+		t.Fatalf("dev guild has %d commands, want ping", len(commands))
+	}
+
+	// Running without the dev guild removes the commands registered there
+	syncTestScopes(t, s, []*Command{ping}, "")
+	if commands := s.commands[testGuild]; len(commands) != 0 {
+		t.Errorf("former dev guild still has %d commands", len(commands))
+	}
+}
+
+func TestRegisterCommandsSweep(t *testing.T) {
+	s := setupTest(t)
+	s.commands[testGuild] = []*discordgo.ApplicationCommand{{Name: "stale", Description: "Left by an earlier run"}}
+	calls := s.countCalls("ApplicationCommands")
+
+	// Only the global scope is checked unless guilds are swept
+	if err := registerCommands(s, testApp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.countCalls("ApplicationCommands") - calls; got != 1 {
+		t.Errorf("checked %d scopes, want only the global scope", got)
+	}
+	if len(s.commands[testGuild]) != 1 {
+		t.Errorf("guild has %d commands, want them left alone without a sweep", len(s.commands[testGuild]))
+	}
+
+	if err := registerCommands(s, testApp, []string{testGuild}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.commands[testGuild]) != 0 {
+		t.Errorf("guild still has %d commands after it was swept", len(s.commands[testGuild]))
+	}
+}
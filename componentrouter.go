@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MaxCustomIDLength is the longest custom ID Discord accepts for a component.
+const MaxCustomIDLength = 100
+
+// Custom IDs are written as <prefix>@<version>|<field>|<field>..., for example poll@2|<poll ID>|vote|3.
+// Custom IDs from before versioning have no version and are treated as version 1, for example poll|<poll ID>|3.
+const (
+	customIDVersionSeparator = "@"
+	customIDFieldSeparator   = "|"
+)
+
+// ComponentRoute handles the components, buttons, select menus and modals, whose custom IDs start with a prefix.
+// The rest of the custom ID is a payload of type T, which the route encodes into fields and decodes back.
+type ComponentRoute[T any] struct {
+	Prefix string
+	// Version is written into every custom ID the route creates. Bump it when the fields change,
+	// and keep Decode handling the older versions since they stay attached to messages that were already sent.
+	Version int
+	Encode  func(payload T) []string
+	Decode  func(version int, fields []string) (T, error)
+
+	handler func(c *ComponentContext, payload T) error
+}
+
+// componentRoute lets routes with different payload types share the registry.
+type componentRoute interface {
+	run(c *ComponentContext, version int, fields []string) error
+}
+
+// componentRoutes holds the registered routes by prefix.
+var componentRoutes = map[string]componentRoute{}
+
+// Handle sets the handler of a route and registers it. Routes are registered from init functions,
+// since a route's handler usually builds custom IDs with the route itself.
+func (r *ComponentRoute[T]) Handle(handler func(c *ComponentContext, payload T) error) {
+	if _, ok := componentRoutes[r.Prefix]; ok {
+		panic("component route registered twice: " + r.Prefix)
+	}
+
+	r.handler = handler
+	componentRoutes[r.Prefix] = r
+}
+
+// CustomID creates the custom ID of a component for a payload.
+func (r *ComponentRoute[T]) CustomID(payload T) string {
+	fields := append([]string{r.Prefix + customIDVersionSeparator + strconv.Itoa(r.Version)}, r.Encode(payload)...)
+	return strings.Join(fields, customIDFieldSeparator)
+}
+
+func (r *ComponentRoute[T]) run(c *ComponentContext, version int, fields []string) error {
+	if version > r.Version {
+		return fmt.Errorf("custom ID %s is from a newer version (%d)", c.CustomID, version)
+	}
+
+	payload, err := r.Decode(version, fields)
+	if err != nil {
+		return fmt.Errorf("error decoding custom ID %s: %w", c.CustomID, err)
+	}
+
+	return r.handler(c, payload)
+}
+
+// parseCustomID splits a custom ID into its prefix, version and fields.
+func parseCustomID(customID string) (string, int, []string, error) {
+	fields := strings.Split(customID, customIDFieldSeparator)
+	prefix, versionString, versioned := strings.Cut(fields[0], customIDVersionSeparator)
+
+	version := 1
+	if versioned {
+		var err error
+		version, err = strconv.Atoi(versionString)
+		if err != nil || version < 1 {
+			return "", 0, nil, fmt.Errorf("custom ID %s has an invalid version", customID)
+		}
+	}
+
+	return prefix, version, fields[1:], nil
+}
+
+// errInvalidPayload is returned by decoders when the fields of a custom ID don't match the payload.
+var errInvalidPayload = errors.New("invalid payload")
+
+// ComponentContext holds a component or modal interaction being handled.
+type ComponentContext struct {
+	// Context is cancelled once the interaction can no longer be responded to.
+	Context     context.Context
+	Session     Session
+	Interaction *discordgo.InteractionCreate
+	CustomID    string
+
+	responded bool
+}
+
+// User gets the user who used the component, both in a guild and in DMs.
+func (c *ComponentContext) User() *discordgo.User {
+	if c.Interaction.Member != nil {
+		return c.Interaction.Member.User
+	}
+	return c.Interaction.User
+}
+
+// Values gets the options picked in a select menu.
+func (c *ComponentContext) Values() []string {
+	if c.Interaction.Type != discordgo.InteractionMessageComponent {
+		return nil
+	}
+	return c.Interaction.MessageComponentData().Values
+}
+
+// ModalValue gets the value of a text input in a submitted modal, or an empty string if there isn't one with the custom ID.
+func (c *ComponentContext) ModalValue(customID string) string {
+	if c.Interaction.Type != discordgo.InteractionModalSubmit {
+		return ""
+	}
+
+	for _, row := range c.Interaction.ModalSubmitData().Components {
+		row, ok := row.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, component := range row.Components {
+			if input, ok := component.(*discordgo.TextInput); ok && input.CustomID == customID {
+				return input.Value
+			}
+		}
+	}
+	return ""
+}
+
+// DeferUpdate acknowledges the interaction without changing the message, so it can be updated later with UpdateMessage.
+func (c *ComponentContext) DeferUpdate() error {
+	if c.responded {
+		return nil
+	}
+
+	err := c.Session.InteractionRespond(c.Interaction.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		return fmt.Errorf("error deferring response: %w", err)
+	}
+
+	c.responded = true
+	return nil
+}
+
+// UpdateMessage replaces the embeds and components of the message the component is on.
+func (c *ComponentContext) UpdateMessage(data *discordgo.InteractionResponseData) error {
+	if !c.responded {
+		err := c.Session.InteractionRespond(c.Interaction.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: data,
+		})
+		if err != nil {
+			return fmt.Errorf("error updating message: %w", err)
+		}
+
+		c.responded = true
+		return nil
+	}
+
+	edit := &discordgo.WebhookEdit{}
+	if data.Content != "" {
+		edit.Content = &data.Content
+	}
+	if data.Embeds != nil {
+		edit.Embeds = &data.Embeds
+	}
+	if data.Components != nil {
+		edit.Components = &data.Components
+	}
+
+	if _, err := c.Session.InteractionResponseEdit(c.Interaction.Interaction, edit); err != nil {
+		return fmt.Errorf("error updating message: %w", err)
+	}
+	return nil
+}
+
+// Respond sends a new message in reply to the interaction, or a followup if it has already been responded to.
+func (c *ComponentContext) Respond(data *discordgo.InteractionResponseData) error {
+	if c.responded {
+		_, err := c.Session.FollowupMessageCreate(c.Interaction.Interaction, false, &discordgo.WebhookParams{
+			Content:    data.Content,
+			Embeds:     data.Embeds,
+			Components: data.Components,
+			Files:      data.Files,
+			Flags:      data.Flags,
+		})
+		if err != nil {
+			return fmt.Errorf("error sending followup: %w", err)
+		}
+		return nil
+	}
+
+	err := c.Session.InteractionRespond(c.Interaction.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("error responding: %w", err)
+	}
+
+	c.responded = true
+	return nil
+}
+
+// ReplyEphemeral sends a message only the user can see.
+func (c *ComponentContext) ReplyEphemeral(content string) error {
+	return c.Respond(&discordgo.InteractionResponseData{
+		Content: content,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+}
+
+// ShowModal opens a modal for the user. The modal's custom ID should come from a route so that its submission is routed back.
+func (c *ComponentContext) ShowModal(customID, title string, components []discordgo.MessageComponent) error {
+	err := c.Session.InteractionRespond(c.Interaction.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID:   customID,
+			Title:      title,
+			Components: components,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error showing modal: %w", err)
+	}
+
+	c.responded = true
+	return nil
+}
+
+// runComponent routes a component or modal interaction to the route registered for the prefix of its custom ID.
+// Any error the handler returns is shown to the user and then returned.
+func runComponent(ctx context.Context, s Session, i *discordgo.InteractionCreate) error {
+	var customID string
+	if i.Type == discordgo.InteractionModalSubmit {
+		customID = i.ModalSubmitData().CustomID
+	} else {
+		customID = i.MessageComponentData().CustomID
+	}
+
+	c := &ComponentContext{
+		Context:     ctx,
+		Session:     s,
+		Interaction: i,
+		CustomID:    customID,
+	}
+
+	prefix, version, fields, err := parseCustomID(customID)
+	if err == nil {
+		route, ok := componentRoutes[prefix]
+		if !ok {
+			return fmt.Errorf("got unknown component interaction %s", customID)
+		}
+
+		err = route.run(c, version, fields)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if err := c.ReplyEphemeral(interactionErrorMessage(err)); err != nil {
+		loggerFrom(ctx).Warn("Failed to send error message", "error", err)
+	}
+	return err
+}
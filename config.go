@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the bot. Each setting is taken from the first of these that sets it:
+// command line flags, environment variables (including those in .env), the config file, and the defaults.
+type Config struct {
+	Token string `toml:"token" yaml:"token"`
+	// DevGuild registers every command in a single guild instead of globally, see commandScopes.
+	DevGuild string `toml:"dev_guild" yaml:"dev_guild"`
+	// SweepGuildCommands syncs the commands of every guild the bot is in at startup, removing ones left there by earlier runs.
+	// It costs a request per guild, so it is off unless commands need cleaning up, see commandScopes.
+	SweepGuildCommands bool `toml:"sweep_guild_commands" yaml:"sweep_guild_commands"`
+	// DataDir is the directory relative database and log paths are in. It is created if it doesn't exist.
+	DataDir  string         `toml:"data_dir" yaml:"data_dir"`
+	Database DatabaseConfig `toml:"database" yaml:"database"`
+	Log      LogConfig      `toml:"log" yaml:"log"`
+	Metrics  MetricsConfig  `toml:"metrics" yaml:"metrics"`
+	// ShutdownTimeout is how long the bot waits for interactions and jobs to finish when it is stopped, see Lifecycle.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" yaml:"shutdown_timeout"`
+}
+
+type DatabaseConfig struct {
+	// Driver is sqlite, postgres or memory, see openStore.
+	Driver string `toml:"driver" yaml:"driver"`
+	// URL is the file name for sqlite and the connection string for postgres.
+	URL string `toml:"url" yaml:"url"`
+}
+
+type LogConfig struct {
+	// File is where the log is written, or - for standard error.
+	File string `toml:"file" yaml:"file"`
+	// Level is the least important level logged: debug, info, warn or error.
+	Level string `toml:"level" yaml:"level"`
+	// MaxSizeMB is how many megabytes the log file can grow to before it is rotated, 0 for no limit.
+	MaxSizeMB int `toml:"max_size_mb" yaml:"max_size_mb"`
+	// RotateEvery starts a new log file at the start of each period, e.g. 24h for a file per day, 0 to only rotate by size.
+	RotateEvery time.Duration `toml:"rotate_every" yaml:"rotate_every"`
+	// MaxBackups is how many rotated log files are kept, 0 to keep them all.
+	MaxBackups int `toml:"max_backups" yaml:"max_backups"`
+	// MaxAge is how long rotated log files are kept, 0 to keep them forever.
+	MaxAge time.Duration `toml:"max_age" yaml:"max_age"`
+	// StderrJSON also writes the log to standard error as JSON, for log collectors.
+	StderrJSON bool `toml:"stderr_json" yaml:"stderr_json"`
+}
+
+type MetricsConfig struct {
+	// Listen is the address of the HTTP server for /metrics, /healthz and /readyz, e.g. :9090. The server is off if it is empty.
+	Listen string `toml:"listen" yaml:"listen"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		DataDir:         ".",
+		ShutdownTimeout: 20 * time.Second,
+		Database: DatabaseConfig{
+			Driver: "sqlite",
+			URL:    "database.db",
+		},
+		Log: LogConfig{
+			File:        "log.log",
+			Level:       "info",
+			MaxSizeMB:   10,
+			RotateEvery: 24 * time.Hour,
+			MaxBackups:  7,
+			MaxAge:      30 * 24 * time.Hour,
+		},
+	}
+}
+
+// config is the configuration of the bot, loaded in main.
+var config Config
+
+// configSettings are the settings that can be overridden by environment variables and flags.
+// Settings without a flag can only be set in the environment or the config file, which keeps the token out of process listings.
+var configSettings = []struct {
+	env   string
+	flag  string
+	usage string
+	field func(c *Config) *string
+}{
+	{"DISCORD_BOT_TOKEN", "", "", func(c *Config) *string { return &c.Token }},
+	{"DEV_GUILD", "dev-guild", "register every command in this guild only, for development", func(c *Config) *string { return &c.DevGuild }},
+	{"DATA_DIR", "data-dir", "directory that relative database and log paths are in", func(c *Config) *string { return &c.DataDir }},
+	{"DATABASE_DRIVER", "database-driver", "database to use: sqlite, postgres or memory", func(c *Config) *string { return &c.Database.Driver }},
+	{"DATABASE_URL", "database-url", "sqlite file name or postgres connection string", func(c *Config) *string { return &c.Database.URL }},
+	{"LOG_FILE", "log-file", "file to write the log to, or - for standard error", func(c *Config) *string { return &c.Log.File }},
+	{"LOG_LEVEL", "log-level", "least important level to log: debug, info, warn or error", func(c *Config) *string { return &c.Log.Level }},
+	{"METRICS_LISTEN", "metrics-listen", "address to serve /metrics, /healthz and /readyz on, e.g. :9090", func(c *Config) *string { return &c.Metrics.Listen }},
+}
+
+// loadConfig loads the configuration from the command line arguments, the environment and the config file given by the
+// --config flag or CONFIG_FILE. It returns the arguments after the flags, which name an admin command, and whether --print-config
+// was given. The configuration isn't validated, see Config.validate.
+func loadConfig(args []string, getenv func(string) string) (Config, []string, bool, error) {
+	flags := flag.NewFlagSet("bot", flag.ContinueOnError)
+	configFile := flags.String("config", getenv("CONFIG_FILE"), "TOML or YAML `file` to load the configuration from")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: discordhelperbot [flags] [polls <command>]\n\nRun the bot, or run discordhelperbot polls help for the admin commands.\n\nFlags:")
+		flags.PrintDefaults()
+	}
+	printConfig := flags.Bool("print-config", false, "print the configuration that would be used, with the token hidden, and exit")
+
+	flagValues := map[string]*string{}
+	for _, setting := range configSettings {
+		if setting.flag != "" {
+			flagValues[setting.flag] = flags.String(setting.flag, "", setting.usage)
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, false, err
+	}
+
+	c := defaultConfig()
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			return Config{}, nil, false, err
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value := getenv(setting.env); value != "" {
+			*setting.field(&c) = value
+		}
+	}
+
+	// Only flags that were given override the other sources
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.flag == f.Name {
+				*setting.field(&c) = *flagValues[f.Name]
+			}
+		}
+	})
+
+	c.resolvePaths()
+	return c, flags.Args(), *printConfig, nil
+}
+
+// loadFile loads a config file over c, picking the format from the file's extension. Unknown keys are errors, as they are usually typos.
+func (c *Config) loadFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("error parsing config file %s: %w", file, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("error parsing config file %s: unknown setting %q", file, undecoded[0].String())
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("error parsing config file %s: %w", file, err)
+		}
+	default:
+		return fmt.Errorf("config file %s should end in .toml, .yaml or .yml", file)
+	}
+	return nil
+}
+
+// resolvePaths makes the database and log paths relative to the data directory.
+func (c *Config) resolvePaths() {
+	if c.Database.Driver == "sqlite" && c.Database.URL != "" && c.Database.URL != ":memory:" && !strings.HasPrefix(c.Database.URL, "file:") {
+		c.Database.URL = resolvePath(c.DataDir, c.Database.URL)
+	}
+	if c.Log.File != "-" && c.Log.File != "" {
+		c.Log.File = resolvePath(c.DataDir, c.Log.File)
+	}
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// validate checks the configuration, listing every problem found. Offline skips the settings that are only needed to connect to Discord,
+// for admin commands that only use the database.
+func (c Config) validate(offline bool) error {
+	problems := []string{}
+	if c.Token == "" && !offline {
+		problems = append(problems, "no bot token is set, set DISCORD_BOT_TOKEN or token in the config file")
+	}
+	if c.DevGuild != "" && strings.Trim(c.DevGuild, "0123456789") != "" {
+		problems = append(problems, fmt.Sprintf("dev_guild %q is not a guild ID", c.DevGuild))
+	}
+	if c.DataDir == "" {
+		problems = append(problems, "data_dir is empty, use . for the working directory")
+	}
+
+	switch c.Database.Driver {
+	case "sqlite", "memory":
+	case "postgres":
+		if c.Database.URL == "" {
+			problems = append(problems, "database.url must be a connection string when database.driver is postgres")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("database.driver %q is unknown, use sqlite, postgres or memory", c.Database.Driver))
+	}
+
+	if c.Log.File == "" {
+		problems = append(problems, "log.file is empty, use - to log to standard error")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level %q is unknown, use debug, info, warn or error", c.Log.Level))
+	}
+	if c.Log.MaxSizeMB < 0 || c.Log.RotateEvery < 0 || c.Log.MaxBackups < 0 || c.Log.MaxAge < 0 {
+		problems = append(problems, "log.max_size_mb, log.rotate_every, log.max_backups and log.max_age can't be negative")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout must be more than 0")
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("metrics.listen %q is not an address, use host:port or :port", c.Metrics.Listen))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// print writes the configuration as TOML, with the paths resolved and the token and any database password hidden.
+func (c Config) print(w io.Writer) error {
+	if c.Token != "" {
+		c.Token = "<hidden>"
+	}
+	if c.Database.Driver == "postgres" {
+		c.Database.URL = hidePassword(c.Database.URL)
+	}
+	return toml.NewEncoder(w).Encode(c)
+}
+
+var connectionPasswordRegex = regexp.MustCompile(`password=('[^']*'|\S+)`)
+
+// hidePassword hides the password in a postgres connection string, which is either a URL or a list of key=value pairs.
+func hidePassword(source string) string {
+	if u, err := url.Parse(source); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return connectionPasswordRegex.ReplaceAllString(source, "password=<hidden>")
+}
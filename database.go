@@ -1,15 +1,9 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
-	"fmt"
-	"os"
 	"time"
 
 	"discordhelperbot/set"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type dbPoll struct {
@@ -23,321 +17,212 @@ type dbPoll struct {
 	Creator     string
 	CreatedTime time.Time
 	EndTime     time.Time
+	Mode        PollMode
+	// MaxChoices is the number of options each user may vote for at once.
+	MaxChoices int
+	// Rankings maps a user ID to the options they ranked, most preferred first.
+	// Only used by ranked-choice polls.
+	Rankings map[string][]int
+	// Anonymous polls store a salted hash of each voter's ID instead of the ID itself, see pollVoterKey.
+	Anonymous bool
+	Salt      string
+	// HideResults hides the tallies until the poll has ended.
+	HideResults bool
+	Status      PollStatus
+	// EndedAt is when the poll was actually ended, which may be before EndTime if it was ended early.
+	// It is the zero time while the poll is active.
+	EndedAt time.Time
+	// Colour is the colour of the poll's embed while it is active, taken from the guild's settings when it was created.
+	Colour int
 }
 
-var db *sql.DB
-
-func init() {
-	var err error
-	db, err = sql.Open("sqlite3", "database.db")
-	if err != nil {
-		fmt.Println("Error opening database: ", err)
-		os.Exit(1)
-	}
+// dbVote is a single row of the poll_votes table.
+type dbVote struct {
+	Poll   string
+	User   string
+	Option int
+	// Rank is the position of the option in the user's ranking, starting from 1.
+	// It is 0 for polls that aren't ranked-choice.
+	Rank    int
+	VotedAt time.Time
+}
 
-	// Drop the old table for testing
-	// _, err = db.Exec(`DROP TABLE IF EXISTS polls`)
-	// if err != nil {
-	// 	fmt.Println("Error dropping table: ", err)
-	// 	os.Exit(1)
-	// }
-
-	// Setup the database
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS polls (
-		id TEXT PRIMARY KEY,
-		guild TEXT,
-		channel TEXT,
-		message TEXT,
-		question TEXT,
-		options BLOB,
-		votes BLOB,
-		creator TEXT,
-		createdtime TIMESTAMP,
-		endtime TIMESTAMP
-	)`)
-	if err != nil {
-		fmt.Println("Error creating database: ", err)
-		os.Exit(1)
-	}
+// dbJob is a single row of the scheduled_jobs table.
+type dbJob struct {
+	Kind string
+	// Target is what the job acts on, usually a poll ID.
+	Target  string
+	Payload string
+	RunAt   time.Time
+	// Attempts is how many times the job has been started.
+	Attempts  int
+	LastError string
+	// Token changes whenever the job is scheduled, claimed or retried, so a worker can tell if the job was changed under it.
+	Token string
 }
 
-func databasePollCreate(poll dbPoll) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+// PermissionKind is what a command permission allows.
+type PermissionKind string
 
-	// Marshal the options into JSON and construct the votes array
-	optionsJSON, err := json.Marshal(poll.Options)
-	if err != nil {
-		return fmt.Errorf("error marshalling options: %w", err)
-	}
-
-	votes := make([]set.Set[string], len(poll.Options))
-	votesJSON, err := json.Marshal(votes)
-	if err != nil {
-		return fmt.Errorf("error marshalling votes: %w", err)
-	}
+const (
+	// PermissionKindRole allows members with a role to use a command.
+	PermissionKindRole PermissionKind = "role"
+	// PermissionKindChannel allows a command to be used in a channel.
+	PermissionKindChannel PermissionKind = "channel"
+)
 
-	logger.Printf("POLL: %s, %s, %s, %s, %s, %s, %s, %s, %s, %s",
-		poll.ID,
-		poll.Guild,
-		poll.Channel,
-		poll.Message,
-		poll.Question,
-		optionsJSON,
-		votesJSON,
-		poll.Creator,
-		poll.CreatedTime,
-		poll.EndTime)
-
-	// Add the poll to the database
-	_, err = tx.Exec(`INSERT INTO polls VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		poll.ID,
-		poll.Guild,
-		poll.Channel,
-		poll.Message,
-		poll.Question,
-		optionsJSON,
-		votesJSON,
-		poll.Creator,
-		poll.CreatedTime,
-		poll.EndTime,
-	)
-	if err != nil {
-		return fmt.Errorf("error adding poll to database: %w", err)
-	}
+// dbCommandPermission is a single row of the command_permissions table. A command with any role permissions can only be used by members
+// with one of the roles, and a command with any channel permissions can only be used in one of the channels.
+type dbCommandPermission struct {
+	Guild string
+	// Command is the full name of a command, e.g. "poll create". Permissions on a command also apply to its subcommands.
+	Command string
+	Kind    PermissionKind
+	// Target is the ID of the role or channel.
+	Target string
+}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("error committing transaction: %w", err)
-	}
+// store is the store used by the bot, opened in main.
+var store Store
 
-	return nil
+func databasePollCreate(poll dbPoll) error {
+	return store.CreatePoll(poll)
 }
 
 func databasePollGet(id string) (dbPoll, error) {
-	var (
-		pollId      string
-		guild       string
-		channel     string
-		message     string
-		question    string
-		optionsJSON []byte
-		votesJSON   []byte
-		creator     string
-		createdtime time.Time
-		endtime     time.Time
-	)
-
-	err := db.QueryRow(`SELECT * FROM polls WHERE id = ?`, id).Scan(&pollId, &guild, &channel, &message, &question, &optionsJSON, &votesJSON, &creator, &createdtime, &endtime)
-	if err != nil {
-		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
-	}
-
-	if pollId != id {
-		panic("pollId != id")
-	}
-
-	var options []string
-	err = json.Unmarshal(optionsJSON, &options)
-	if err != nil {
-		return dbPoll{}, fmt.Errorf("error unmarshalling options: %w", err)
-	}
-
-	var votes []set.Set[string]
-	err = json.Unmarshal(votesJSON, &votes)
-	if err != nil {
-		return dbPoll{}, fmt.Errorf("error unmarshalling votes: %w", err)
-	}
-
-	return dbPoll{
-		ID:          id,
-		Guild:       guild,
-		Channel:     channel,
-		Message:     message,
-		Question:    question,
-		Options:     options,
-		Votes:       votes,
-		Creator:     creator,
-		CreatedTime: createdtime,
-		EndTime:     endtime,
-	}, nil
+	return store.GetPoll(id)
 }
 
-func databasePollVote(pollId, userId string, option int) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	// Get the poll
-	var (
-		votesJSON []byte
-		endtime   time.Time
-	)
-
-	err = tx.QueryRow(`SELECT votes, endtime FROM polls WHERE id = ?`, pollId).Scan(&votesJSON, &endtime)
-	if err != nil {
-		return fmt.Errorf("error getting poll: %w", err)
-	}
-
-	// Unmarshal the votes
-	var votes []set.Set[string]
-	err = json.Unmarshal(votesJSON, &votes)
-	if err != nil {
-		return fmt.Errorf("error unmarshalling votes: %w", err)
-	}
-
-	// Check if the option is past the length of votes
-	if option >= len(votes) {
-		return fmt.Errorf("option %d is out of range", option)
-	}
+// databasePollVote records a user's vote for an option and returns how many options the user has voted for.
+// For single choice polls this replaces the user's previous vote, otherwise it toggles the user's vote for the option.
+func databasePollVote(pollId, userId string, option int) (int, error) {
+	return store.Vote(pollId, userId, option)
+}
 
-	// Check if the poll has ended
-	if endtime.Before(time.Now()) {
-		return fmt.Errorf("poll has ended")
-	}
+// databasePollSetVotes replaces all of a user's votes with votes for the given options and returns how many options the user has voted for.
+func databasePollSetVotes(pollId, userId string, options []int) (int, error) {
+	return store.SetVotes(pollId, userId, options)
+}
 
-	// Update the voting status for the user
-	for i := 0; i < len(votes); i++ {
-		if option == i {
-			votes[i].Add(userId)
-		} else {
-			votes[i].Remove(userId)
-		}
-	}
+// databasePollRank appends an option to the end of a user's ranking for a ranked-choice poll.
+// It returns the user's updated ranking.
+func databasePollRank(pollId, userId string, option int) ([]int, error) {
+	return store.Rank(pollId, userId, option)
+}
 
-	// Marshal the votes
-	votesJSON, err = json.Marshal(votes)
-	if err != nil {
-		return fmt.Errorf("error marshalling votes: %w", err)
-	}
+// databasePollClearRanking removes a user's ranking from a ranked-choice poll.
+func databasePollClearRanking(pollId, userId string) error {
+	return store.ClearRanking(pollId, userId)
+}
 
-	// Update the poll
-	_, err = tx.Exec(`UPDATE polls SET votes = ? WHERE id = ?`, votesJSON, pollId)
-	if err != nil {
-		return fmt.Errorf("error updating poll: %w", err)
-	}
+// databasePollEnd marks a poll as ended and returns it. The poll is kept in the database so it can be viewed in the history.
+func databasePollEnd(pollId string) (dbPoll, error) {
+	return store.EndPoll(pollId)
+}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("error committing transaction: %w", err)
-	}
-	return nil
+// databasePollDelete removes a poll along with its votes and jobs, leaving no trace of it.
+func databasePollDelete(pollId string) error {
+	return store.DeletePoll(pollId)
 }
 
-func databasePollEnd(pollId string) (dbPoll, error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return dbPoll{}, err
-	}
-	defer tx.Rollback()
+// databasePollImport adds a poll exactly as given, including its status and votes.
+func databasePollImport(poll dbPoll, votes []dbVote) error {
+	return store.ImportPoll(poll, votes)
+}
 
-	// Get the poll
-	poll, err := databasePollGet(pollId)
-	if err != nil {
-		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
-	}
+// databasePollVotes gets every vote cast in a poll, ordered by user and then by rank.
+func databasePollVotes(pollId string) ([]dbVote, error) {
+	return store.PollVotes(pollId)
+}
 
-	// Delete the poll
-	_, err = tx.Exec(`DELETE FROM polls WHERE id = ?`, pollId)
-	if err != nil {
-		return dbPoll{}, fmt.Errorf("error deleting poll: %w", err)
-	}
+// databasePollHistory gets a page of the ended polls in a guild, most recently ended first, along with the total number of ended polls.
+func databasePollHistory(guildId string, offset, limit int) ([]dbPoll, int, error) {
+	return store.PollHistory(guildId, offset, limit)
+}
 
-	if err := tx.Commit(); err != nil {
-		return dbPoll{}, fmt.Errorf("error committing transaction: %w", err)
-	}
-	return poll, nil
+// databasePollGuildActive gets a page of the active polls in a guild, ending soonest first, along with the total number of active polls.
+func databasePollGuildActive(guildId string, offset, limit int) ([]dbPoll, int, error) {
+	return store.GuildActivePolls(guildId, offset, limit)
 }
 
-// databasePollsGet gets all the polls in the database and returns a channel to range over
+// databasePollGetAll gets all the active polls in the database and returns a channel to range over
 func databasePollGetAll() <-chan dbPoll {
 	ch := make(chan dbPoll)
 
 	go func() {
 		defer close(ch)
 
-		rows, err := db.Query(`SELECT * FROM polls`)
+		polls, err := store.ActivePolls()
 		if err != nil {
-			logger.Printf("error getting polls: %v", err)
+			logger.Error("Failed to get active polls", "error", err)
 			return
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var (
-				pollId      string
-				guild       string
-				channel     string
-				message     string
-				question    string
-				optionsJSON []byte
-				votesJSON   []byte
-				creator     string
-				createdtime time.Time
-				endtime     time.Time
-			)
-
-			err := rows.Scan(&pollId, &guild, &channel, &message, &question, &optionsJSON, &votesJSON, &creator, &createdtime, &endtime)
-			if err != nil {
-				logger.Printf("error scanning poll: %v", err)
-				continue
-			}
-
-			var options []string
-			err = json.Unmarshal(optionsJSON, &options)
-			if err != nil {
-				logger.Printf("error unmarshalling options: %v", err)
-				continue
-			}
-
-			var votes []set.Set[string]
-			err = json.Unmarshal(votesJSON, &votes)
-			if err != nil {
-				logger.Printf("error unmarshalling votes: %v", err)
-				continue
-			}
-
-			ch <- dbPoll{
-				ID:          pollId,
-				Guild:       guild,
-				Channel:     channel,
-				Message:     message,
-				Question:    question,
-				Options:     options,
-				Votes:       votes,
-				Creator:     creator,
-				CreatedTime: createdtime,
-				EndTime:     endtime,
-			}
+
+		for _, poll := range polls {
+			ch <- poll
 		}
 	}()
 
 	return ch
 }
 
+// databasePollAll gets every poll in the database, active or ended, oldest first.
+func databasePollAll() ([]dbPoll, error) {
+	return store.AllPolls()
+}
+
+// databasePollGetMessage gets the poll posted as a message.
+func databasePollGetMessage(messageId string) (dbPoll, error) {
+	return store.MessagePoll(messageId)
+}
+
 func databasePollGetUser(userId, guildId string) (dbPoll, error) {
-	// Find a poll ID
-	var pollId string
-	err := db.QueryRow(`SELECT id FROM polls WHERE guild = ? AND creator = ?`, guildId, userId).Scan(&pollId)
-	if err != nil {
-		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
-	}
+	return store.UserPoll(userId, guildId)
+}
+
+// databasePollCountUser counts the active polls a user created in a guild.
+func databasePollCountUser(userId, guildId string) (int, error) {
+	return store.CountUserPolls(userId, guildId)
+}
 
-	// Get the poll
-	poll, err := databasePollGet(pollId)
+// databaseCommandPermissions gets the command permissions set up in a guild, ordered by command.
+func databaseCommandPermissions(guildId string) ([]dbCommandPermission, error) {
+	return store.CommandPermissions(guildId)
+}
+
+func databaseCommandPermissionAdd(permission dbCommandPermission) error {
+	return store.AddCommandPermission(permission)
+}
+
+// databaseCommandPermissionRemove removes a command permission and returns whether it existed.
+func databaseCommandPermissionRemove(permission dbCommandPermission) (bool, error) {
+	return store.RemoveCommandPermission(permission)
+}
+
+// databaseCommandPermissionsReset removes every permission for a command in a guild and returns how many there were.
+func databaseCommandPermissionsReset(guildId, command string) (int, error) {
+	return store.ResetCommandPermissions(guildId, command)
+}
+
+// databaseGuildSettings gets the settings of a guild, using the defaults for anything it hasn't changed.
+func databaseGuildSettings(guildId string) (GuildSettings, error) {
+	values, err := store.GuildSettings(guildId)
 	if err != nil {
-		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
+		return GuildSettings{}, err
 	}
+	return loadGuildSettings(values), nil
+}
+
+func databaseGuildSettingSet(guildId, key, value string) error {
+	return store.SetGuildSetting(guildId, key, value)
+}
 
-	return poll, nil
+// databaseGuildSettingReset puts a setting back to its default and returns whether it had been changed.
+func databaseGuildSettingReset(guildId, key string) (bool, error) {
+	return store.ResetGuildSetting(guildId, key)
 }
 
-// databasePollCheckUser checks if a user has already created a poll within a specified guild and returns true is they have.
-func databasePollCheckUser(userId, guildId string) bool {
-	var pollId string
-	err := db.QueryRow(`SELECT id FROM polls WHERE creator = ? AND guild = ?`, userId, guildId).Scan(&pollId)
-	return err == nil
+// databaseGuildSettingsReset puts every setting of a guild back to its default and returns how many had been changed.
+func databaseGuildSettingsReset(guildId string) (int, error) {
+	return store.ResetGuildSettings(guildId)
 }
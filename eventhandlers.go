@@ -1,109 +1,132 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strconv"
-	"strings"
-	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
 func eventReady(s *discordgo.Session, m *discordgo.Ready) {
-	// Handle currently running polls
-	startupPolls(s)
-
-	logger.Printf("Logged in as %v#%v\n", m.User.Username, m.User.Discriminator)
+	logger.Info("Logged in", "user", m.User.Username+"#"+m.User.Discriminator, "guilds", len(m.Guilds))
 }
 
-func startupPolls(s *discordgo.Session) {
-	for poll := range databasePollGetAll() {
-		if time.Now().After(poll.EndTime) {
-			endPoll(s, poll.ID)
-		}
-
-		// Queue the poll to be ended
-		time.AfterFunc(time.Until(poll.EndTime), func() {
-			endPoll(s, poll.ID)
-		})
-	}
+func eventInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	handler := chainInteractionMiddleware(dispatchInteraction, interactionMiddleware...)
+	handler(context.Background(), s, i)
 }
 
-func eventInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+// dispatchInteraction passes an interaction to the router for its type.
+func dispatchInteraction(ctx context.Context, s Session, i *discordgo.InteractionCreate) error {
 	switch i.Type {
 	case discordgo.InteractionApplicationCommand:
 		commandName := i.ApplicationCommandData().Name
 		if command, ok := registeredCommands[commandName]; ok {
-			command.Handler(s, i)
-		} else {
-			logger.Print("Got unknown command: ", commandName)
-		}
-	case discordgo.InteractionMessageComponent:
-		data := i.MessageComponentData()
-		if data.ComponentType == discordgo.ButtonComponent {
-			handleButton(s, i)
-			logger.Print("Message component interaction from ", i.MessageComponentData().CustomID)
+			return runCommand(ctx, s, i, command)
 		}
+		return fmt.Errorf("got unknown command %s", commandName)
+	case discordgo.InteractionMessageComponent, discordgo.InteractionModalSubmit:
+		return runComponent(ctx, s, i)
 	}
+	return nil
 }
 
-func handleButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	data := i.MessageComponentData()
-	buttonArgs := strings.Split(data.CustomID, "|")
-
-	if tryHandlePollButton(s, i, buttonArgs) {
-		return
-	} else {
-		logger.Print("Got unknown button interaction: ", data.CustomID)
+// handlePollComponent handles the buttons and select menu on a poll message.
+func handlePollComponent(c *ComponentContext, payload pollVotePayload) error {
+	if err := c.DeferUpdate(); err != nil {
+		return err
 	}
-}
 
-func tryHandlePollButton(s *discordgo.Session, i *discordgo.InteractionCreate, buttonArgs []string) bool {
-	if len(buttonArgs) != 3 {
-		return false
+	poll, err := databasePollGet(payload.Poll)
+	if err != nil {
+		return fmt.Errorf("error getting poll: %w", err)
 	}
 
-	if buttonArgs[0] != "poll" {
-		return false
+	voter := pollVoterKey(poll, c.User().ID)
+
+	// Work out which options were chosen
+	var choices []int
+	switch payload.Action {
+	case PollActionSelect:
+		for _, value := range c.Values() {
+			choice, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("got select menu interaction with invalid choice %q", value)
+			}
+			choices = append(choices, choice)
+		}
+	case PollActionVote:
+		choices = append(choices, payload.Option)
 	}
 
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseDeferredMessageUpdate,
-		Data: &discordgo.InteractionResponseData{
-			Flags: discordgo.MessageFlagsEphemeral,
-		},
-	})
+	if poll.Mode == PollModeRanked {
+		var ranking []int
+		if payload.Action == PollActionClear {
+			err = databasePollClearRanking(poll.ID, voter)
+		} else {
+			for _, choice := range choices {
+				ranking, err = databasePollRank(poll.ID, voter, choice)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if errors.Is(err, errPollEnded) {
+			return commandErrorf("This poll has ended.")
+		} else if err != nil {
+			return fmt.Errorf("error writing ranking: %w", err)
+		}
+		if payload.Action != PollActionClear {
+			votesCast.WithLabelValues(string(poll.Mode)).Inc()
+		}
 
-	// data := i.MessageComponentData()
+		// Show the voter their ranking so far
+		if err := c.ReplyEphemeral(formatRanking(poll, ranking)); err != nil {
+			loggerFrom(c.Context).Warn("Failed to send ranking", "poll", poll.ID, "error", err)
+		}
+	} else if len(choices) > 0 {
+		var picks int
+		if payload.Action == PollActionSelect {
+			picks, err = databasePollSetVotes(poll.ID, voter, choices)
+		} else {
+			picks, err = databasePollVote(poll.ID, voter, choices[0])
+		}
 
-	choice, err := strconv.ParseInt(buttonArgs[2], 10, 64)
-	if err != nil {
-		logger.Print("Got button interaction with invalid choice: ", buttonArgs[2])
-		return true
-	}
+		if errors.Is(err, errTooManyChoices) {
+			return commandErrorf("You have already used all %d of your picks. Click one of your picked options to take it back.", poll.MaxChoices)
+		} else if errors.Is(err, errPollEnded) {
+			return commandErrorf("This poll has ended.")
+		} else if err != nil {
+			return fmt.Errorf("error writing vote: %w", err)
+		}
 
-	err = databasePollVote(buttonArgs[1], i.Member.User.ID, int(choice))
-	if err != nil {
-		logger.Print("Failed to write vote to database: ", err)
+		votesCast.WithLabelValues(string(poll.Mode)).Inc()
+		if poll.MaxChoices > 1 {
+			// Let the voter know how many picks they have left
+			left := poll.MaxChoices - picks
+			if err := c.ReplyEphemeral(fmt.Sprintf("You have %d pick%s left.", left, plural(left))); err != nil {
+				loggerFrom(c.Context).Warn("Failed to send picks left", "poll", poll.ID, "error", err)
+			}
+		}
 	}
 
 	// Get the poll to build the embed from
-	poll, err := databasePollGet(buttonArgs[1])
+	poll, err = databasePollGet(payload.Poll)
 	if err != nil {
-		logger.Print("Failed to get poll from database: ", err)
-		return true
+		return fmt.Errorf("error getting poll: %w", err)
 	}
 
-	user, err := s.User(poll.Creator)
+	user, err := c.Session.User(poll.Creator)
 	if err != nil {
-		logger.Print("Failed to get user: ", err)
+		loggerFrom(c.Context).Warn("Failed to get poll creator", "poll", poll.ID, "user", poll.Creator, "error", err)
 		user = nil
 	}
 
-	s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-		Embeds: &[]*discordgo.MessageEmbed{
+	return c.UpdateMessage(&discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{
 			ptr(generatePollEmbed(poll, user)),
 		},
 	})
-
-	return true
 }
@@ -1,10 +1,27 @@
 module discordhelperbot
 
-go 1.19
+go 1.21
 
 require (
-	github.com/bwmarrin/discordgo v0.26.1
+	github.com/BurntSushi/toml v1.3.2
+	github.com/bwmarrin/discordgo v0.27.1
 	github.com/joho/godotenv v1.4.0
+	github.com/lib/pq v1.10.9
+	github.com/prometheus/client_golang v1.19.1
+	golang.org/x/image v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
 
 require (
@@ -12,5 +29,5 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/segmentio/ksuid v1.0.4
 	golang.org/x/crypto v0.0.0-20221005025214-4161e89ecf1b // indirect
-	golang.org/x/sys v0.0.0-20221006211917-84dc82d7e875 // indirect
+	golang.org/x/sys v0.17.0 // indirect
 )
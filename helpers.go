@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
+
+	"github.com/bwmarrin/discordgo"
 )
 
 // Discord colour constants
@@ -16,6 +21,12 @@ const (
 	DiscordBlack   = 0x000000
 )
 
+// Discord embed limits
+const (
+	MaxEmbedFields     = 25
+	MaxEmbedFieldValue = 1024
+)
+
 func plural(n int) string {
 	if n == 1 {
 		return ""
@@ -23,6 +34,15 @@ func plural(n int) string {
 	return "s"
 }
 
+// truncate shortens s to at most n characters, marking it with an ellipsis if it was shortened.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-3]) + "..."
+}
+
 func ptr[T interface{}](val T) *T {
 	return &val
 }
@@ -63,3 +83,34 @@ func parseDuration(s string) (time.Duration, error) {
 
 	return d, nil
 }
+
+// formatDuration formats a duration without the zero units time.Duration.String adds, e.g. 1h instead of 1h0m0s.
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// discordStatus gets the HTTP status code of an error returned by the Discord API, or 0 if it isn't one.
+func discordStatus(err error) int {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		return restErr.Response.StatusCode
+	}
+	return 0
+}
+
+// isDiscordNotFound checks if an error is Discord saying something doesn't exist.
+func isDiscordNotFound(err error) bool {
+	return discordStatus(err) == http.StatusNotFound
+}
+
+// isDiscordForbidden checks if an error is Discord saying the bot isn't allowed to do something.
+func isDiscordForbidden(err error) bool {
+	return discordStatus(err) == http.StatusForbidden
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Lifecycle shuts the bot down in order. Once shutdown starts new interactions are turned away, and the ones being handled
+// are given until the deadline to finish so that votes aren't left half recorded. Then the shutdown hooks run, the most recently
+// added first like deferred calls, so that resources are released in the reverse of the order they were set up in.
+type Lifecycle struct {
+	mu       sync.Mutex
+	stopping bool
+	inFlight sync.WaitGroup
+	// running and turnedAway count interactions, for the shutdown summary.
+	running    int
+	turnedAway int
+	hooks      []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// lifecycle is the lifecycle of the bot, shut down in main.
+var lifecycle = &Lifecycle{}
+
+// OnShutdown adds a hook that stops part of the bot. The context given to stop ends at the shutdown deadline.
+func (l *Lifecycle) OnShutdown(name string, stop func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, shutdownHook{name, stop})
+}
+
+// Stopping gets whether shutdown has started.
+func (l *Lifecycle) Stopping() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopping
+}
+
+// begin marks an interaction as being handled, returning false if it should be turned away because the bot is shutting down.
+// end must be called once the interaction has been handled.
+func (l *Lifecycle) begin() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopping {
+		l.turnedAway++
+		return false
+	}
+	// Adding under the lock means nothing is added once Shutdown starts waiting
+	l.inFlight.Add(1)
+	l.running++
+	return true
+}
+
+func (l *Lifecycle) end() {
+	l.mu.Lock()
+	l.running--
+	l.mu.Unlock()
+	l.inFlight.Done()
+}
+
+// Shutdown stops the bot, waiting up to timeout for the interactions being handled and then running the shutdown hooks.
+// Every hook is run even if the deadline has passed, and any that fail are returned together.
+func (l *Lifecycle) Shutdown(timeout time.Duration) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	l.mu.Lock()
+	l.stopping = true
+	inFlight := l.running
+	hooks := l.hooks
+	l.mu.Unlock()
+	logger.Info("Shutting down", "in_flight", inFlight, "timeout", timeout)
+
+	var errs []error
+	drained := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(drained)
+	}()
+	abandoned := 0
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		l.mu.Lock()
+		abandoned = l.running
+		l.mu.Unlock()
+		errs = append(errs, fmt.Errorf("%d interactions were still being handled after %s", abandoned, timeout))
+	}
+
+	for n := len(hooks) - 1; n >= 0; n-- {
+		hook := hooks[n]
+		hookStart := time.Now()
+		if err := hook.stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("error stopping %s: %w", hook.name, err))
+			continue
+		}
+		logger.Debug("Stopped", "part", hook.name, "duration", time.Since(hookStart).Round(time.Millisecond))
+	}
+
+	l.mu.Lock()
+	turnedAway := l.turnedAway
+	l.mu.Unlock()
+
+	err := errors.Join(errs...)
+	attrs := []any{
+		"duration", time.Since(start).Round(time.Millisecond),
+		"drained", inFlight - abandoned,
+		"abandoned", abandoned,
+		"turned_away", turnedAway,
+	}
+	if err != nil {
+		logger.Error("Shut down with errors", append(attrs, "error", err)...)
+	} else {
+		logger.Info("Shut down", attrs...)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsInteractions(t *testing.T) {
+	s := setupTest(t)
+
+	var stopped []string
+	for _, name := range []string{"database", "Discord session", "scheduler"} {
+		name := name
+		lifecycle.OnShutdown(name, func(ctx context.Context) error {
+			stopped = append(stopped, name)
+			return nil
+		})
+	}
+
+	// An interaction is being handled when the bot is stopped
+	if !lifecycle.begin() {
+		t.Fatal("interaction was turned away before shutdown")
+	}
+	done := make(chan error)
+	go func() {
+		done <- lifecycle.Shutdown(time.Minute)
+	}()
+	for !lifecycle.Stopping() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New interactions are turned away
+	i := commandInteraction(testMember("1", 0), "poll", subcommand("create", stringOption("question", "Q"), stringOption("options", "A;B")))
+	var cmdErr *commandError
+	if err := interact(s, i); !errors.As(err, &cmdErr) {
+		t.Errorf("got error %v, want the interaction to be turned away", err)
+	}
+	if reply := s.reply(i); reply != shuttingDownMessage {
+		t.Errorf("reply = %q, want %q", reply, shuttingDownMessage)
+	}
+	if _, err := databasePollGetUser("1", testGuild); err == nil {
+		t.Error("a poll was created during shutdown")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown finished with an interaction still being handled: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	lifecycle.end()
+	if err := <-done; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	// Hooks run in the reverse of the order they were added
+	if got := strings.Join(stopped, ", "); got != "scheduler, Discord session, database" {
+		t.Errorf("stopped %s, want the scheduler, then the Discord session, then the database", got)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	setupTest(t)
+
+	closed := false
+	lifecycle.OnShutdown("database", func(ctx context.Context) error {
+		closed = true
+		return nil
+	})
+	lifecycle.OnShutdown("scheduler", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// An interaction that never finishes
+	lifecycle.begin()
+
+	err := lifecycle.Shutdown(10 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "1 interactions were still being handled") || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want the abandoned interaction and the scheduler to be reported", err)
+	}
+	if !closed {
+		t.Error("the database wasn't closed after the deadline passed")
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	setupTest(t)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	scheduler.Handle("slow", func(job dbJob) error {
+		close(started)
+		<-release
+		return nil
+	})
+	if err := scheduler.Schedule("slow", "target", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	<-started
+
+	// The job is still running when the deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := scheduler.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want the running job to be reported", err)
+	}
+
+	// The job keeps its lease so it is run again after a restart
+	job, ok, _ := store.NextJob()
+	if !ok || time.Until(job.RunAt) < JobLease-time.Minute {
+		t.Errorf("next job = %+v, want the running job to still be leased", job)
+	}
+
+	// Let the worker finish before the test's store is closed
+	close(release)
+	<-scheduler.done
+}
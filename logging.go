@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger is the bot's logger, set up from the configuration in main. Messages are short and fixed,
+// with the details in key/value attributes, so that logs can be filtered by attributes like guild, user or poll.
+var logger = slog.Default()
+
+// setupLogger creates the logger described by the configuration. The returned closer closes the log file.
+func setupLogger(c LogConfig) (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level %q", c.Level)
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	handlers := []slog.Handler{}
+	// Closing the logger leaves standard error open
+	var closer io.Closer = io.NopCloser(os.Stderr)
+	if c.File == "-" {
+		handlers = append(handlers, slog.NewTextHandler(os.Stderr, options))
+	} else {
+		file, err := openRotatingFile(c.File, int64(c.MaxSizeMB)<<20, c.RotateEvery, c.MaxBackups, c.MaxAge)
+		if err != nil {
+			return nil, nil, err
+		}
+		handlers = append(handlers, slog.NewTextHandler(file, options))
+		closer = file
+	}
+
+	if c.StderrJSON {
+		handlers = append(handlers, slog.NewJSONHandler(os.Stderr, options))
+	}
+
+	if len(handlers) == 1 {
+		return slog.New(handlers[0]), closer, nil
+	}
+	return slog.New(multiHandler(handlers)), closer, nil
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// withLogger attaches a logger to a context, usually one with attributes describing what the context is for.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom gets the logger attached to a context, or the bot's logger if there isn't one.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// multiHandler sends every record to several handlers.
+type multiHandler []slog.Handler
+
+func (h multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var firstErr error
+	for _, handler := range h {
+		if !handler.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, record.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, 0, len(h))
+	for _, handler := range h {
+		handlers = append(handlers, handler.WithAttrs(attrs))
+	}
+	return handlers
+}
+
+func (h multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, 0, len(h))
+	for _, handler := range h {
+		handlers = append(handlers, handler.WithGroup(name))
+	}
+	return handlers
+}
+
+// rotatingFile is a log file that is appended to, and moved aside for a new file once it gets too big or a new period starts.
+// Old files are named after the file with the time they were rotated, e.g. log-20060102T150405.000.log, and removed once there
+// are too many of them or they get too old.
+type rotatingFile struct {
+	path string
+	// maxSize is the size in bytes the file can grow to before it is rotated, 0 for no limit.
+	maxSize int64
+	// every starts a new file at the start of each period of this length, 0 to only rotate by size.
+	every time.Duration
+	// maxBackups is how many old files are kept, 0 to keep them all.
+	maxBackups int
+	// maxAge is how long old files are kept, 0 to keep them forever.
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time
+}
+
+// rotatedTimeFormat is the format of the time in the names of rotated files, which sorts in time order.
+const rotatedTimeFormat = "20060102T150405.000"
+
+func openRotatingFile(path string, maxSize int64, every time.Duration, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		every:      every,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+// open opens the file for appending. A file left from a previous run is kept and belongs to the period it was last written in.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.period = f.periodOf(time.Now())
+	if f.size > 0 {
+		f.period = f.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+func (f *rotatingFile) periodOf(t time.Time) time.Time {
+	if f.every <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.every)
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	full := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	if full || f.periodOf(time.Now()) != f.period {
+		if err := f.rotate(); err != nil {
+			// Keep writing to the current file rather than losing messages
+			fmt.Fprintln(os.Stderr, "Error rotating log file:", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one. The caller must hold the lock.
+func (f *rotatingFile) rotate() error {
+	// The file is replaced whether or not it closes cleanly
+	f.file.Close()
+
+	ext := filepath.Ext(f.path)
+	name := fmt.Sprintf("%s-%s", strings.TrimSuffix(f.path, ext), time.Now().UTC().Format(rotatedTimeFormat))
+	rotated := name + ext
+	for n := 1; fileExists(rotated); n++ {
+		rotated = fmt.Sprintf("%s.%d%s", name, n, ext)
+	}
+	renameErr := os.Rename(f.path, rotated)
+
+	// Reopen the file even if it couldn't be moved, so logging carries on
+	if err := f.open(); err != nil {
+		f.file = nil
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	f.size = 0
+	f.period = f.periodOf(time.Now())
+	f.prune()
+	return nil
+}
+
+// prune removes the rotated files that are past the limits.
+func (f *rotatingFile) prune() {
+	ext := filepath.Ext(f.path)
+	rotated, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext)
+	if err != nil {
+		return
+	}
+
+	// Newest first, the names sort in time order
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	for n, file := range rotated {
+		expired := false
+		if f.maxAge > 0 {
+			if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				expired = true
+			}
+		}
+
+		if expired || (f.maxBackups > 0 && n >= f.maxBackups) {
+			if err := os.Remove(file); err != nil {
+				fmt.Fprintln(os.Stderr, "Error removing old log file:", err)
+			}
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,8 +16,6 @@ import (
 	"github.com/joho/godotenv"
 )
 
-var logger *log.Logger
-
 const (
 	DefaultDuration = time.Hour
 	MaxDuration     = 24 * time.Hour
@@ -23,39 +25,124 @@ func init() {
 	godotenv.Load()
 }
 
-func init() {
+func main() {
+	var (
+		args        []string
+		printConfig bool
+		err         error
+	)
+	config, args, printConfig, err = loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+		if err := config.print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error printing configuration:", err)
+			os.Exit(1)
+		}
+	}
+	if len(args) > 0 && args[0] != "polls" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, the only command is polls\n", args[0])
+		os.Exit(2)
+	}
+	if err := config.validate(len(args) > 0); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		return
+	}
+
+	if err := os.MkdirAll(config.DataDir, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating data directory:", err)
+		os.Exit(1)
+	}
+
+	// Admin commands work on the database without connecting to Discord
+	if len(args) > 0 {
+		os.Exit(runPollsCommand(args[1:], os.Stdout, os.Stderr))
+	}
+
 	// Initialise logger
-	logFile, err := os.Create("log.log")
+	var logCloser io.Closer
+	logger, logCloser, err = setupLogger(config.Log)
 	if err != nil {
-		fmt.Printf("WARNING: Error opening log file: %s, logging to standard error instead.\n", err)
-		logFile = os.Stderr
+		fmt.Fprintln(os.Stderr, "Error setting up logging:", err)
+		os.Exit(1)
 	}
-	logger = log.New(logFile, "bot", log.LstdFlags)
-}
+	defer logCloser.Close()
+	slog.SetDefault(logger)
 
-func main() {
-	season, err := discordgo.New("Bot " + os.Getenv("DISCORD_BOT_TOKEN"))
+	store, err = openStore(config.Database.Driver, config.Database.URL)
 	if err != nil {
-		logger.Fatal("Error creating Discord session: ", err)
+		fatal("Error opening database", "error", err)
+	}
+	lifecycle.OnShutdown("database", func(ctx context.Context) error { return store.Close() })
+
+	season, err := discordgo.New("Bot " + config.Token)
+	if err != nil {
+		fatal("Error creating Discord session", "error", err)
 	}
 
 	season.AddHandler(eventReady)
 	season.AddHandler(eventInteractionCreate)
+	gateway.track(season)
 
-	// season
+	// Serve metrics and health checks from before the bot connects, so that it shows as not ready while it starts
+	if config.Metrics.Listen != "" {
+		metricsServer, err := startMetricsServer(config.Metrics.Listen)
+		if err != nil {
+			fatal("Error starting metrics server", "error", err)
+		}
+		logger.Info("Serving metrics", "address", config.Metrics.Listen)
+		lifecycle.OnShutdown("metrics server", metricsServer.Shutdown)
+	}
+
+	// The scheduler is set up before the session opens, interactions can arrive while commands are registered
+	setupScheduler(season)
 
 	if err = season.Open(); err != nil {
-		logger.Fatal("Error opening Discord session: ", err)
+		fatal("Error opening Discord session", "error", err)
+	}
+	lifecycle.OnShutdown("Discord session", func(ctx context.Context) error { return season.Close() })
+
+	// Register slash commands, the guilds the bot is in are known once the session is open
+	sweep := []string{}
+	if config.SweepGuildCommands {
+		season.State.RLock()
+		for _, guild := range season.State.Guilds {
+			sweep = append(sweep, guild.ID)
+		}
+		season.State.RUnlock()
+	}
+	if err := registerCommands(season, season.State.User.ID, sweep); err != nil {
+		logger.Error("Error registering commands", "error", err)
 	}
 
-	// Register slash commands
-	registerCommands(season)
+	// Start ending polls, including any that ended while the bot was offline
+	startupPolls()
+	scheduler.Start()
+	lifecycle.OnShutdown("scheduler", scheduler.Stop)
 
+	logger.Info("Bot is running")
 	fmt.Println("Bot is now running.  Press CTRL-C to exit.")
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	<-exit
 
+	// A second signal stops the bot without waiting
+	go func() {
+		<-exit
+		fatal("Forced to exit while shutting down")
+	}()
+
 	fmt.Println("Exiting...")
-	season.Close()
+	if err := lifecycle.Shutdown(config.ShutdownTimeout); err != nil {
+		logCloser.Close()
+		os.Exit(1)
+	}
 }
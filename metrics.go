@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "discordhelperbot"
+	// GatewayUnhealthyAfter is how long the bot can be disconnected from the gateway before /healthz fails.
+	// discordgo reconnects by itself, so short disconnections only fail /readyz.
+	GatewayUnhealthyAfter = 5 * time.Minute
+	// healthCheckTimeout is how long the database has to answer a health check.
+	healthCheckTimeout = 2 * time.Second
+)
+
+// metricsRegistry holds the metrics served on /metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	interactionsHandled = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "interactions_total",
+		Help:      "Interactions handled, by type, command or component name, and result: ok, rejected or error.",
+	}, []string{"type", "name", "result"})
+
+	interactionDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "interaction_duration_seconds",
+		Help:      "How long interaction handlers took, by type and command or component name.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type", "name"})
+
+	votesCast = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "votes_total",
+		Help:      "Votes cast in polls, by poll mode. Changing or taking back a vote counts as a vote.",
+	}, []string{"mode"})
+
+	jobsRun = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_total",
+		Help:      "Scheduler jobs run, by kind and result: ok, retry or failed when the job was given up on.",
+	}, []string{"kind", "result"})
+
+	schedulerLag = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "scheduler_lag_seconds",
+		Help:      "How long after they were due scheduler jobs started running, by kind.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 30, 60, 300, 900, 3600},
+	}, []string{"kind"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_polls",
+			Help:      "Polls that haven't ended, in every guild.",
+		}, func() float64 {
+			count, err := store.CountActivePolls()
+			if err != nil {
+				logger.Warn("Failed to count active polls", "error", err)
+				return math.NaN()
+			}
+			return float64(count)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "gateway_connected",
+			Help:      "Whether the bot is connected to the Discord gateway.",
+		}, func() float64 {
+			if connected, _ := gateway.status(); connected {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "gateway_latency_seconds",
+			Help:      "Time between the last gateway heartbeat and its acknowledgement.",
+		}, func() float64 {
+			latency, ok := gateway.latency()
+			if !ok {
+				return math.NaN()
+			}
+			return latency.Seconds()
+		}),
+	)
+}
+
+// gatewayState tracks the bot's connection to the Discord gateway, for health checks and metrics.
+type gatewayState struct {
+	mu        sync.Mutex
+	session   *discordgo.Session
+	connected bool
+	// changed is when the bot last connected or disconnected, or when it started if it hasn't connected yet.
+	changed time.Time
+}
+
+// gateway is the state of the bot's connection, tracked from main.
+var gateway = &gatewayState{changed: time.Now()}
+
+// track follows the connection of a session. It must be called before the session is opened.
+func (g *gatewayState) track(s *discordgo.Session) {
+	g.mu.Lock()
+	g.session = s
+	g.mu.Unlock()
+
+	s.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) { g.set(true) })
+	s.AddHandler(func(s *discordgo.Session, r *discordgo.Resumed) { g.set(true) })
+	s.AddHandler(func(s *discordgo.Session, d *discordgo.Disconnect) { g.set(false) })
+}
+
+func (g *gatewayState) set(connected bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.connected != connected {
+		g.connected = connected
+		g.changed = time.Now()
+	}
+}
+
+// status gets whether the bot is connected, and how long it has been connected or disconnected for.
+func (g *gatewayState) status() (bool, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.connected, time.Since(g.changed)
+}
+
+// latency gets the latency of the last heartbeat, if the bot is connected and has had one acknowledged.
+func (g *gatewayState) latency() (time.Duration, bool) {
+	g.mu.Lock()
+	s, connected := g.session, g.connected
+	g.mu.Unlock()
+	if s == nil || !connected {
+		return 0, false
+	}
+
+	s.RLock()
+	latency := s.HeartbeatLatency()
+	s.RUnlock()
+	if latency < 0 {
+		// The last heartbeat hasn't been acknowledged yet
+		return 0, false
+	}
+	return latency, true
+}
+
+// startMetricsServer serves metrics and health checks on an address in the background.
+func startMetricsServer(addr string) (*http.Server, error) {
+	// Listen here rather than in the background so that a bad address stops the bot
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for metrics: %w", err)
+	}
+
+	server := &http.Server{
+		Handler:           metricsHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server stopped", "error", err)
+		}
+	}()
+	return server, nil
+}
+
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", healthCheck(false))
+	mux.HandleFunc("/readyz", healthCheck(true))
+	return mux
+}
+
+// healthCheck checks the bot can do its job, responding with 503 Service Unavailable if it can't and the result of each check as JSON.
+// The liveness check, /healthz, only fails once the gateway has been disconnected for GatewayUnhealthyAfter, as restarting the bot
+// won't fix a short disconnection or a database that is down. The readiness check, /readyz, fails as soon as either is unavailable,
+// and while the bot shuts down.
+func healthCheck(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{}
+		healthy := true
+
+		connected, since := gateway.status()
+		switch {
+		case connected:
+			checks["gateway"] = "ok"
+		case ready || since > GatewayUnhealthyAfter:
+			checks["gateway"] = fmt.Sprintf("disconnected for %s", since.Round(time.Second))
+			healthy = false
+		default:
+			checks["gateway"] = fmt.Sprintf("reconnecting for %s", since.Round(time.Second))
+		}
+
+		if ready && lifecycle.Stopping() {
+			checks["lifecycle"] = "shutting down"
+			healthy = false
+		}
+
+		if ready {
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			defer cancel()
+			if err := store.Ping(ctx); err != nil {
+				logger.Warn("Database health check failed", "error", err)
+				checks["database"] = "unreachable"
+				healthy = false
+			} else {
+				checks["database"] = "ok"
+			}
+		}
+
+		status := "ok"
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			status = "unavailable"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": checks})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setGatewayState sets whether the bot is connected and since when, until the end of the test.
+func setGatewayState(t *testing.T, connected bool, since time.Duration) {
+	gateway.mu.Lock()
+	oldConnected, oldChanged := gateway.connected, gateway.changed
+	gateway.connected = connected
+	gateway.changed = time.Now().Add(-since)
+	gateway.mu.Unlock()
+
+	t.Cleanup(func() {
+		gateway.mu.Lock()
+		gateway.connected, gateway.changed = oldConnected, oldChanged
+		gateway.mu.Unlock()
+	})
+}
+
+// unreachableStore is a store whose database can't be reached.
+type unreachableStore struct {
+	Store
+}
+
+func (s unreachableStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHealthChecks(t *testing.T) {
+	tests := []struct {
+		name       string
+		connected  bool
+		since      time.Duration
+		dbDown     bool
+		stopping   bool
+		wantHealth int
+		wantReady  int
+	}{
+		{"connected", true, time.Hour, false, false, http.StatusOK, http.StatusOK},
+		{"reconnecting", false, time.Minute, false, false, http.StatusOK, http.StatusServiceUnavailable},
+		{"disconnected", false, GatewayUnhealthyAfter + time.Minute, false, false, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"database down", true, time.Hour, true, false, http.StatusOK, http.StatusServiceUnavailable},
+		{"shutting down", true, time.Hour, false, true, http.StatusOK, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			setGatewayState(t, test.connected, test.since)
+			if test.dbDown {
+				store = unreachableStore{store}
+			}
+			if test.stopping {
+				lifecycle.stopping = true
+			}
+
+			handler := metricsHandler()
+			for path, want := range map[string]int{"/healthz": test.wantHealth, "/readyz": test.wantReady} {
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+				if response.Code != want {
+					t.Errorf("%s returned %d, want %d: %s", path, response.Code, want, response.Body)
+				}
+
+				var body struct {
+					Status string
+					Checks map[string]string
+				}
+				if err := json.NewDecoder(response.Body).Decode(&body); err != nil || body.Checks["gateway"] == "" {
+					t.Errorf("%s returned %q, want the result of each check", path, response.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := setupTest(t)
+	creator, voter := testMember("1", 0), testMember("2", 0)
+
+	created := interactionsHandled.WithLabelValues("ApplicationCommand", "poll create", "ok")
+	rejected := interactionsHandled.WithLabelValues("ApplicationCommand", "poll create", "rejected")
+	votes := votesCast.WithLabelValues(string(PollModeSingle))
+	before := []float64{testutil.ToFloat64(created), testutil.ToFloat64(rejected), testutil.ToFloat64(votes)}
+
+	poll := createTestPoll(t, s, creator)
+	interact(s, commandInteraction(creator, "poll", subcommand("create", stringOption("question", "Again?"), stringOption("options", "Yes;No"))))
+	vote(t, s, voter, poll, 0)
+	vote(t, s, voter, poll, 1)
+
+	after := []float64{testutil.ToFloat64(created), testutil.ToFloat64(rejected), testutil.ToFloat64(votes)}
+	for n, want := range []float64{1, 1, 2} {
+		if got := after[n] - before[n]; got != want {
+			t.Errorf("metric %d went up by %v, want %v", n, got, want)
+		}
+	}
+
+	response := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(response.Body.String(), "discordhelperbot_active_polls 1\n") {
+		t.Errorf("/metrics doesn't show the active poll:\n%s", response.Body)
+	}
+}
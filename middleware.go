@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// InteractionTokenLifetime is how long after an interaction is created Discord accepts responses to it.
+const InteractionTokenLifetime = 15 * time.Minute
+
+// shuttingDownMessage is shown to users whose interactions are turned away while the bot shuts down.
+const shuttingDownMessage = "The bot is restarting, try again in a moment."
+
+// InteractionHandler handles an interaction, returning any error it ran into after it has been shown to the user.
+type InteractionHandler func(ctx context.Context, s Session, i *discordgo.InteractionCreate) error
+
+// InteractionMiddleware wraps an InteractionHandler to run code around it.
+type InteractionMiddleware func(next InteractionHandler) InteractionHandler
+
+// interactionMiddleware is run around every interaction, the first being the outermost.
+var interactionMiddleware = []InteractionMiddleware{
+	logInteractions,
+	instrumentInteractions,
+	drainInteractions,
+	recoverInteractions,
+	interactionDeadline,
+}
+
+// chainInteractionMiddleware wraps a handler in middleware, the first being the outermost.
+func chainInteractionMiddleware(handler InteractionHandler, middleware ...InteractionMiddleware) InteractionHandler {
+	for n := len(middleware) - 1; n >= 0; n-- {
+		handler = middleware[n](handler)
+	}
+	return handler
+}
+
+// logInteractions attaches a logger describing the interaction to the context, see loggerFrom,
+// and logs every interaction with how long it waited before being handled and how long it took.
+func logInteractions(next InteractionHandler) InteractionHandler {
+	return func(ctx context.Context, s Session, i *discordgo.InteractionCreate) error {
+		l := logger.With(
+			"interaction", i.ID,
+			"type", i.Type.String(),
+			"name", interactionName(i),
+			"user", interactionUserID(i),
+			"guild", i.GuildID,
+			"channel", i.ChannelID,
+		)
+		ctx = withLogger(ctx, l)
+
+		start := time.Now()
+		err := next(ctx, s, i)
+		attrs := []any{"latency", time.Since(start).Round(time.Millisecond)}
+
+		// How long Discord and the gateway took to deliver the interaction
+		if created, err := discordgo.SnowflakeTimestamp(i.ID); err == nil {
+			attrs = append(attrs, "delay", start.Sub(created).Round(time.Millisecond))
+		}
+
+		var cmdErr *commandError
+		if errors.As(err, &cmdErr) {
+			l.Info("Interaction rejected", append(attrs, "reason", cmdErr.message)...)
+		} else if err != nil {
+			l.Error("Interaction failed", append(attrs, "error", err)...)
+		} else {
+			l.Info("Interaction handled", attrs...)
+		}
+		return err
+	}
+}
+
+// instrumentInteractions counts interactions by their result and records how long they took, see metrics.go.
+func instrumentInteractions(next InteractionHandler) InteractionHandler {
+	return func(ctx context.Context, s Session, i *discordgo.InteractionCreate) error {
+		start := time.Now()
+		err := next(ctx, s, i)
+
+		interactionType, name := i.Type.String(), interactionName(i)
+		interactionDuration.WithLabelValues(interactionType, name).Observe(time.Since(start).Seconds())
+
+		result := "ok"
+		var cmdErr *commandError
+		if errors.As(err, &cmdErr) {
+			result = "rejected"
+		} else if err != nil {
+			result = "error"
+		}
+		interactionsHandled.WithLabelValues(interactionType, name, result).Inc()
+		return err
+	}
+}
+
+// drainInteractions tracks the interactions being handled so that shutdown can wait for them, and turns new ones away once it has started.
+func drainInteractions(next InteractionHandler) InteractionHandler {
+	return func(ctx context.Context, s Session, i *discordgo.InteractionCreate) error {
+		if !lifecycle.begin() {
+			if err := replyInteractionError(s, i, shuttingDownMessage); err != nil {
+				loggerFrom(ctx).Warn("Failed to send shutting down message", "error", err)
+			}
+			return commandErrorf(shuttingDownMessage)
+		}
+		defer lifecycle.end()
+
+		return next(ctx, s, i)
+	}
+}
+
+// recoverInteractions turns a panic in a handler into an error, and tells the user that something went wrong.
+func recoverInteractions(next InteractionHandler) InteractionHandler {
+	return func(ctx context.Context, s Session, i *discordgo.InteractionCreate) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+
+			err = fmt.Errorf("panic: %v", r)
+			loggerFrom(ctx).Error("Panic handling interaction", "panic", r, "stack", string(debug.Stack()))
+
+			if err := replyInteractionError(s, i, genericErrorMessage); err != nil {
+				loggerFrom(ctx).Warn("Failed to send error message", "error", err)
+			}
+		}()
+
+		return next(ctx, s, i)
+	}
+}
+
+// interactionDeadline gives handlers a context that is cancelled once the interaction's token expires.
+func interactionDeadline(next InteractionHandler) InteractionHandler {
+	return func(ctx context.Context, s Session, i *discordgo.InteractionCreate) error {
+		created, err := discordgo.SnowflakeTimestamp(i.ID)
+		if err != nil {
+			created = time.Now()
+		}
+
+		ctx, cancel := context.WithDeadline(ctx, created.Add(InteractionTokenLifetime))
+		defer cancel()
+
+		err = next(ctx, s, i)
+		if err == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("handler finished after the interaction expired")
+		}
+		return err
+	}
+}
+
+// replyInteractionError shows the user an error message when it isn't known whether the interaction has been responded to.
+func replyInteractionError(s Session, i *discordgo.InteractionCreate, message string) error {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: message,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err == nil {
+		return nil
+	}
+
+	// The interaction has already been responded to
+	_, err = s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+		Content: message,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+	return err
+}
+
+// interactionName describes what an interaction is for: the full name of a command, or the prefix of a component's custom ID.
+func interactionName(i *discordgo.InteractionCreate) string {
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		data := i.ApplicationCommandData()
+		name := data.Name
+		options := data.Options
+		for len(options) > 0 && (options[0].Type == discordgo.ApplicationCommandOptionSubCommand || options[0].Type == discordgo.ApplicationCommandOptionSubCommandGroup) {
+			name += " " + options[0].Name
+			options = options[0].Options
+		}
+		return name
+	case discordgo.InteractionMessageComponent:
+		prefix, _, _ := strings.Cut(i.MessageComponentData().CustomID, customIDFieldSeparator)
+		return prefix
+	case discordgo.InteractionModalSubmit:
+		prefix, _, _ := strings.Cut(i.ModalSubmitData().CustomID, customIDFieldSeparator)
+		return prefix
+	}
+	return ""
+}
+
+// interactionUserID gets the ID of the user who caused an interaction, both in a guild and in DMs.
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
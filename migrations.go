@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"discordhelperbot/set"
+)
+
+// migrationFiles holds the schema migrations. Each file is named after the version it migrates to, e.g. 0002_add_settings.sql,
+// and versions must count up from 1 without gaps. Migrations that have been released must never be edited, add a new one instead.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the migrations for a SQL dialect, ordered by version.
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+
+	migrations := []migration{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", entry.Name())
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", entry.Name(), err)
+		}
+
+		contents, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", entry.Name(), err)
+		}
+
+		migrations = append(migrations, migration{
+			version: version,
+			name:    name,
+			sql:     string(contents),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	for n, m := range migrations {
+		if m.version != n+1 {
+			return nil, fmt.Errorf("expected migration %d but found %d_%s", n+1, m.version, m.name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// databaseMigrate brings the database schema up to date, applying each pending migration in its own transaction.
+// It refuses to touch a database that has been migrated by a newer version of the bot.
+func databaseMigrate(db *sql.DB, dialect string) error {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return err
+	}
+
+	// SQLite databases created before migrations were introduced need upgrading to the first migration by hand
+	if dialect == "sqlite" {
+		legacy, err := databaseIsLegacy(db)
+		if err != nil {
+			return err
+		}
+		if legacy {
+			if err := databaseUpgradeLegacy(db); err != nil {
+				return fmt.Errorf("error upgrading legacy database: %w", err)
+			}
+		}
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %w", err)
+	}
+
+	var current int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("error getting schema version: %w", err)
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d), refusing to start", current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		if err := applyMigration(db, dialect, m); err != nil {
+			return err
+		}
+		logger.Info("Applied database migration", "version", m.version, "name", m.name)
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, dialect string, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.sql); err != nil {
+		return fmt.Errorf("error applying migration %d_%s: %w", m.version, m.name, err)
+	}
+
+	_, err = tx.Exec(rebind(dialect, `INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`), m.version, m.name, time.Now())
+	if err != nil {
+		return fmt.Errorf("error recording migration %d_%s: %w", m.version, m.name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migration %d_%s: %w", m.version, m.name, err)
+	}
+	return nil
+}
+
+// databaseIsLegacy checks if a SQLite database was created before schema versioning, meaning it has a polls table but no schema_version table.
+func databaseIsLegacy(db *sql.DB) (bool, error) {
+	hasVersion, err := databaseHasTable(db, "schema_version")
+	if err != nil || hasVersion {
+		return false, err
+	}
+
+	return databaseHasTable(db, "polls")
+}
+
+func databaseHasTable(db *sql.DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking for table %s: %w", table, err)
+	}
+	return count > 0, nil
+}
+
+// databaseUpgradeLegacy upgrades a database from before schema versioning to the schema of the first migration.
+// Those databases may have any subset of the columns that were added over time, and may still store votes as JSON.
+func databaseUpgradeLegacy(db *sql.DB) error {
+	for _, column := range []struct{ name, definition string }{
+		{"mode", `TEXT NOT NULL DEFAULT 'single'`},
+		{"max_choices", `INTEGER NOT NULL DEFAULT 1`},
+		{"anonymous", `BOOLEAN NOT NULL DEFAULT 0`},
+		{"salt", `TEXT NOT NULL DEFAULT ''`},
+		{"hide_results", `BOOLEAN NOT NULL DEFAULT 0`},
+		{"status", `TEXT NOT NULL DEFAULT 'active'`},
+		{"ended_at", `TIMESTAMP`},
+	} {
+		if err := databaseAddColumn(db, "polls", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS poll_votes (
+		poll_id TEXT NOT NULL REFERENCES polls (id) ON DELETE CASCADE,
+		user_id TEXT NOT NULL,
+		option INTEGER NOT NULL,
+		rank INTEGER NOT NULL DEFAULT 0,
+		voted_at TIMESTAMP NOT NULL,
+		UNIQUE (poll_id, user_id, option)
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating poll_votes table: %w", err)
+	}
+
+	return databaseMigrateVoteBlobs(db)
+}
+
+// databaseHasColumn checks if a table has a column.
+func databaseHasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%s')`, table))
+	if err != nil {
+		return false, fmt.Errorf("error getting columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, fmt.Errorf("error scanning column: %w", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("error getting columns of %s: %w", table, err)
+	}
+	return false, nil
+}
+
+// databaseAddColumn adds a column to a table if it does not already exist.
+func databaseAddColumn(db *sql.DB, table, column, definition string) error {
+	exists, err := databaseHasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding column %s to %s: %w", column, table, err)
+	}
+	return nil
+}
+
+// databaseMigrateVoteBlobs moves the votes and rankings that older versions stored as JSON in the polls table into poll_votes.
+// Votes that are migrated didn't record when they were cast, so they are given the creation time of their poll.
+func databaseMigrateVoteBlobs(db *sql.DB) error {
+	hasVotes, err := databaseHasColumn(db, "polls", "votes")
+	if err != nil || !hasVotes {
+		return err
+	}
+
+	hasRankings, err := databaseHasColumn(db, "polls", "rankings")
+	if err != nil {
+		return err
+	}
+
+	rankingsColumn := `NULL`
+	if hasRankings {
+		rankingsColumn = `rankings`
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type legacyPoll struct {
+		id           string
+		votesJSON    []byte
+		rankingsJSON []byte
+		createdtime  time.Time
+	}
+
+	rows, err := tx.Query(`SELECT id, votes, ` + rankingsColumn + `, createdtime FROM polls`)
+	if err != nil {
+		return fmt.Errorf("error getting polls: %w", err)
+	}
+
+	polls := []legacyPoll{}
+	for rows.Next() {
+		var poll legacyPoll
+		if err := rows.Scan(&poll.id, &poll.votesJSON, &poll.rankingsJSON, &poll.createdtime); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning poll: %w", err)
+		}
+		polls = append(polls, poll)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error getting polls: %w", err)
+	}
+
+	for _, poll := range polls {
+		var votes []set.Set[string]
+		if len(poll.votesJSON) > 0 {
+			if err := json.Unmarshal(poll.votesJSON, &votes); err != nil {
+				return fmt.Errorf("error unmarshalling votes of poll %s: %w", poll.id, err)
+			}
+		}
+
+		rankings := map[string][]int{}
+		if len(poll.rankingsJSON) > 0 {
+			if err := json.Unmarshal(poll.rankingsJSON, &rankings); err != nil {
+				return fmt.Errorf("error unmarshalling rankings of poll %s: %w", poll.id, err)
+			}
+		}
+
+		for option, voters := range votes {
+			for _, user := range voters.Values() {
+				_, err := tx.Exec(`INSERT INTO poll_votes (poll_id, user_id, option, rank, voted_at) VALUES (?, ?, ?, 0, ?) ON CONFLICT DO NOTHING`, poll.id, user, option, poll.createdtime)
+				if err != nil {
+					return fmt.Errorf("error migrating vote: %w", err)
+				}
+			}
+		}
+
+		for user, ranking := range rankings {
+			for n, option := range ranking {
+				_, err := tx.Exec(`INSERT INTO poll_votes (poll_id, user_id, option, rank, voted_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`, poll.id, user, option, n+1, poll.createdtime)
+				if err != nil {
+					return fmt.Errorf("error migrating ranking: %w", err)
+				}
+			}
+		}
+	}
+
+	// Remove the old columns
+	if _, err := tx.Exec(`ALTER TABLE polls DROP COLUMN votes`); err != nil {
+		return fmt.Errorf("error dropping votes column: %w", err)
+	}
+	if hasRankings {
+		if _, err := tx.Exec(`ALTER TABLE polls DROP COLUMN rankings`); err != nil {
+			return fmt.Errorf("error dropping rankings column: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	logger.Info("Migrated votes to the poll_votes table", "polls", len(polls))
+	return nil
+}
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS polls (
+	id TEXT PRIMARY KEY,
+	guild TEXT,
+	channel TEXT,
+	message TEXT,
+	question TEXT,
+	options BYTEA,
+	creator TEXT,
+	createdtime TIMESTAMPTZ,
+	endtime TIMESTAMPTZ,
+	mode TEXT NOT NULL DEFAULT 'single',
+	max_choices INTEGER NOT NULL DEFAULT 1,
+	anonymous BOOLEAN NOT NULL DEFAULT FALSE,
+	salt TEXT NOT NULL DEFAULT '',
+	hide_results BOOLEAN NOT NULL DEFAULT FALSE,
+	status TEXT NOT NULL DEFAULT 'active',
+	ended_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+	poll_id TEXT NOT NULL REFERENCES polls (id) ON DELETE CASCADE,
+	user_id TEXT NOT NULL,
+	option INTEGER NOT NULL,
+	rank INTEGER NOT NULL DEFAULT 0,
+	voted_at TIMESTAMPTZ NOT NULL,
+	UNIQUE (poll_id, user_id, option)
+);
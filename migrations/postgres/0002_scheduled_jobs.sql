@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+	kind TEXT NOT NULL,
+	target TEXT NOT NULL,
+	payload TEXT NOT NULL DEFAULT '',
+	run_at TIMESTAMPTZ NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	token TEXT NOT NULL,
+	PRIMARY KEY (kind, target)
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_jobs_run_at ON scheduled_jobs (run_at);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS command_permissions (
+	guild_id TEXT NOT NULL,
+	command TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	target_id TEXT NOT NULL,
+	PRIMARY KEY (guild_id, command, kind, target_id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS guild_settings (
+	guild_id TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (guild_id, key)
+);
+
+-- Polls were always DiscordYellow before their colour could be set
+ALTER TABLE polls ADD COLUMN colour INTEGER NOT NULL DEFAULT 16705372;
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// checkCommandPermissions checks that the user may run a command before its handler runs.
+// path is the path of commands from the top level command to the subcommand being run, see Command.route.
+func checkCommandPermissions(c *CommandContext, path []*Command) error {
+	member := c.Interaction.Member
+	if member == nil {
+		// Permissions are only set up in guilds
+		return nil
+	}
+
+	// Discord checks the permissions of top level commands itself, taking the server's integration settings into account
+	for _, command := range path[1:] {
+		if member.Permissions&command.Permissions != command.Permissions {
+			return commandErrorf("You don't have permission to use `/%s`.", c.Name)
+		}
+	}
+
+	// Administrators can always use every command, so they can't lock themselves out
+	if member.Permissions&discordgo.PermissionAdministrator != 0 {
+		return nil
+	}
+
+	permissions, err := databaseCommandPermissions(c.Interaction.GuildID)
+	if err != nil {
+		return fmt.Errorf("error getting command permissions: %w", err)
+	}
+
+	// Permissions on a command apply to all of its subcommands too, so check every command along the path
+	for n := range path {
+		name := commandPathName(path[:n+1])
+
+		roles := []string{}
+		channels := []string{}
+		for _, permission := range permissions {
+			if permission.Command != name {
+				continue
+			}
+			switch permission.Kind {
+			case PermissionKindRole:
+				roles = append(roles, permission.Target)
+			case PermissionKindChannel:
+				channels = append(channels, permission.Target)
+			}
+		}
+
+		if len(roles) > 0 && !containsAny(member.Roles, roles) {
+			return commandErrorf("You need one of these roles to use `/%s`: %s", name, formatMentions(PermissionKindRole, roles))
+		}
+		if len(channels) > 0 && !containsAny([]string{c.Interaction.ChannelID}, channels) {
+			return commandErrorf("`/%s` can only be used in %s.", name, formatMentions(PermissionKindChannel, channels))
+		}
+	}
+
+	return nil
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatMentions formats a list of role or channel IDs as mentions.
+func formatMentions(kind PermissionKind, ids []string) string {
+	format := "<@&%s>"
+	if kind == PermissionKindChannel {
+		format = "<#%s>"
+	}
+
+	mentions := make([]string, 0, len(ids))
+	for _, id := range ids {
+		mentions = append(mentions, fmt.Sprintf(format, id))
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// findCommand finds a registered command by its full name, e.g. "poll create", "/poll create" or "Manage poll", and returns its normalised name.
+func findCommand(name string) (string, bool) {
+	name = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(name), "/"))
+
+	// Context menu commands have spaces and capitals in their names, so top level names are matched as a whole first
+	for registered := range registeredCommands {
+		if strings.EqualFold(registered, name) {
+			return registered, true
+		}
+	}
+
+	names := strings.Fields(strings.ToLower(name))
+	if len(names) == 0 {
+		return "", false
+	}
+
+	command, ok := registeredCommands[names[0]]
+	if !ok {
+		return "", false
+	}
+
+	for _, sub := range names[1:] {
+		var next *Command
+		for _, subcommand := range command.Subcommands {
+			if subcommand.Name == sub {
+				next = subcommand
+			}
+		}
+		if next == nil {
+			return "", false
+		}
+		command = next
+	}
+
+	return strings.Join(names, " "), true
+}
+
+// commandPermissionOptions parses the command, role and channel options shared by the permission subcommands into permissions.
+func commandPermissionOptions(c *CommandContext) (string, []dbCommandPermission, error) {
+	command, ok := findCommand(c.Options.String("command", ""))
+	if !ok {
+		return "", nil, commandErrorf("There is no command called `%s`. Give the full name of a command or subcommand, e.g. `poll create` or `Manage poll`.", c.Options.String("command", ""))
+	}
+
+	permissions := []dbCommandPermission{}
+	if role := c.Options.Role("role", ""); role != "" {
+		permissions = append(permissions, dbCommandPermission{Guild: c.Interaction.GuildID, Command: command, Kind: PermissionKindRole, Target: role})
+	}
+	if channel := c.Options.Channel("channel", ""); channel != "" {
+		permissions = append(permissions, dbCommandPermission{Guild: c.Interaction.GuildID, Command: command, Kind: PermissionKindChannel, Target: channel})
+	}
+
+	return command, permissions, nil
+}
+
+// configPermissionsViewCmd is the handler for the permissions view subcommand of the config command
+func configPermissionsViewCmd(c *CommandContext) error {
+	permissions, err := databaseCommandPermissions(c.Interaction.GuildID)
+	if err != nil {
+		return err
+	}
+
+	if len(permissions) == 0 {
+		return c.Reply("No command permissions are set up, so anyone with the right Discord permissions can use every command.")
+	}
+
+	// Group the permissions by command, which they are already ordered by
+	lines := []string{}
+	for start := 0; start < len(permissions); {
+		command := permissions[start].Command
+		roles := []string{}
+		channels := []string{}
+
+		end := start
+		for ; end < len(permissions) && permissions[end].Command == command; end++ {
+			if permissions[end].Kind == PermissionKindRole {
+				roles = append(roles, permissions[end].Target)
+			} else {
+				channels = append(channels, permissions[end].Target)
+			}
+		}
+		start = end
+
+		line := fmt.Sprintf("`/%s`", command)
+		if len(roles) > 0 {
+			line += " - roles: " + formatMentions(PermissionKindRole, roles)
+		}
+		if len(channels) > 0 {
+			line += " - channels: " + formatMentions(PermissionKindChannel, channels)
+		}
+		lines = append(lines, line)
+	}
+
+	return c.Respond(&discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{{
+			Title:       "Command permissions",
+			Description: joinLinesLimit(lines, 4096),
+			Color:       DiscordBlurple,
+			Footer:      &discordgo.MessageEmbedFooter{Text: "Administrators can always use every command."},
+		}},
+	})
+}
+
+// configPermissionsAllowCmd is the handler for the permissions allow subcommand of the config command
+func configPermissionsAllowCmd(c *CommandContext) error {
+	command, permissions, err := commandPermissionOptions(c)
+	if err != nil {
+		return err
+	}
+	if len(permissions) == 0 {
+		return commandErrorf("Give a role or a channel to allow.")
+	}
+
+	lines := []string{}
+	for _, permission := range permissions {
+		if err := databaseCommandPermissionAdd(permission); err != nil {
+			return err
+		}
+
+		if permission.Kind == PermissionKindRole {
+			lines = append(lines, fmt.Sprintf("Members with <@&%s> can now use `/%s`.", permission.Target, command))
+		} else {
+			lines = append(lines, fmt.Sprintf("`/%s` can now be used in <#%s>.", command, permission.Target))
+		}
+	}
+
+	return c.Reply(strings.Join(lines, "\n"))
+}
+
+// configPermissionsRemoveCmd is the handler for the permissions remove subcommand of the config command
+func configPermissionsRemoveCmd(c *CommandContext) error {
+	command, permissions, err := commandPermissionOptions(c)
+	if err != nil {
+		return err
+	}
+	if len(permissions) == 0 {
+		return commandErrorf("Give a role or a channel to remove.")
+	}
+
+	lines := []string{}
+	for _, permission := range permissions {
+		removed, err := databaseCommandPermissionRemove(permission)
+		if err != nil {
+			return err
+		}
+
+		mention := formatMentions(permission.Kind, []string{permission.Target})
+		if !removed {
+			lines = append(lines, fmt.Sprintf("%s wasn't allowed to use `/%s`.", mention, command))
+		} else {
+			lines = append(lines, fmt.Sprintf("Removed %s from `/%s`.", mention, command))
+		}
+	}
+
+	return c.Reply(strings.Join(lines, "\n"))
+}
+
+// configPermissionsResetCmd is the handler for the permissions reset subcommand of the config command
+func configPermissionsResetCmd(c *CommandContext) error {
+	command, _, err := commandPermissionOptions(c)
+	if err != nil {
+		return err
+	}
+
+	removed, err := databaseCommandPermissionsReset(c.Interaction.GuildID, command)
+	if err != nil {
+		return err
+	}
+
+	return c.Reply(fmt.Sprintf("Removed %d permission%s from `/%s`, anyone with the right Discord permissions can use it now.", removed, plural(removed), command))
+}
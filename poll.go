@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,87 +15,124 @@ import (
 	"github.com/segmentio/ksuid"
 )
 
-func handlePollCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	switch i.ApplicationCommandData().Options[0].Name {
-	case "create":
-		createPollCmd(s, i)
-	case "end":
-		endPollCmd(s, i)
-	}
-}
+const (
+	// MaxPollOptions is the most options a poll can have, limited by the number of options in a select menu.
+	MaxPollOptions = 25
+	// MaxPollButtons is the most options a poll can have before its buttons are replaced with a select menu.
+	MaxPollButtons = 5
+	// MaxOptionLength is the longest an option can be, limited by the length of a button label.
+	MaxOptionLength = 80
+)
+
+// PollMode is the voting system used by a poll.
+type PollMode string
+
+const (
+	PollModeSingle PollMode = "single"
+	PollModeRanked PollMode = "ranked"
+)
+
+// PollStatus is the lifecycle state of a poll.
+type PollStatus string
+
+const (
+	PollStatusActive PollStatus = "active"
+	PollStatusEnded  PollStatus = "ended"
+)
 
 // createPollCmd is the handler for the create subcommand of the poll command
-func createPollCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{
-			Flags: discordgo.MessageFlagsEphemeral,
-		},
-	})
+func createPollCmd(c *CommandContext) error {
+	s, i := c.Session, c.Interaction
 
-	// Check if the user already has a poll running in this guild.
-	if databasePollCheckUser(i.Member.User.ID, i.GuildID) {
-		s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-			Content: ptr("You already have a poll running in this server!"),
-		})
-		return
+	settings, err := databaseGuildSettings(i.GuildID)
+	if err != nil {
+		return fmt.Errorf("error getting guild settings: %w", err)
+	}
+
+	// Check if the user already has as many polls running in this guild as they are allowed.
+	running, err := databasePollCountUser(c.User().ID, i.GuildID)
+	if err != nil {
+		return fmt.Errorf("error counting polls: %w", err)
+	}
+	if running >= settings.MaxPollsPerUser {
+		if settings.MaxPollsPerUser == 1 {
+			return commandErrorf("You already have a poll running in this server!")
+		}
+		return commandErrorf("You already have %d polls running in this server!", running)
 	}
 
 	id := ksuid.New().String()
-	options := i.ApplicationCommandData().Options[0].Options
 
-	question := options[0].StringValue()
-	duration := DefaultDuration
+	question := c.Options.String("question", "")
+	mode := PollMode(c.Options.String("mode", string(PollModeSingle)))
+	maxChoices := c.Options.Int("max_choices", 1)
+	anonymous := c.Options.Bool("anonymous", false)
+	hideResults := c.Options.Bool("hide_results", false)
+	remindRole := c.Options.Role("remind_role", "")
+
+	duration, err := c.Options.Duration("duration", settings.DefaultDuration)
+	if err != nil {
+		return commandErrorf("Failed to create poll: invalid duration")
+	}
+	if duration > settings.MaxDuration {
+		return commandErrorf("Failed to create poll: duration cannot exceed %s", formatDuration(settings.MaxDuration))
+	}
+
+	remindBefore, err := c.Options.Duration("remind_before", 0)
+	if err != nil {
+		return commandErrorf("Failed to create poll: invalid reminder time")
+	}
+	if remindBefore >= duration {
+		return commandErrorf("Failed to create poll: the reminder must be before the poll ends")
+	}
+	if remindRole != "" && remindBefore == 0 {
+		return commandErrorf("Failed to create poll: a reminder role needs a reminder time")
+	}
 
 	// Parse the options
-	choices := make([]discordgo.MessageComponent, 0, len(options))
-	choicesString := make([]string, 0, len(options))
-	for n, option := range options[1:] {
-		if strings.HasPrefix(option.Name, "option") {
-			// Make sure the option doesn't exceed 80 characters
-			if len(option.StringValue()) > 80 {
-				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-					Content: ptr(fmt.Sprintf("Failed to create poll: option %d exceeds 80 characters", n+1)),
-				})
-				return
-			}
+	choicesString := []string{}
+	for n := 1; n <= MaxPollButtons; n++ {
+		if choice := c.Options.String(fmt.Sprintf("option%d", n), ""); choice != "" {
+			choicesString = append(choicesString, choice)
+		}
+	}
+	for _, choice := range strings.Split(c.Options.String("options", ""), ";") {
+		if choice = strings.TrimSpace(choice); choice != "" {
+			choicesString = append(choicesString, choice)
+		}
+	}
 
-			choices = append(choices, discordgo.Button{
-				Label:    option.StringValue(),
-				CustomID: fmt.Sprintf("poll|%s|%d", id, n),
-				Style:    discordgo.SuccessButton,
-			})
+	if len(choicesString) < 2 {
+		return commandErrorf("Failed to create poll: a poll needs at least 2 options")
+	}
+	if len(choicesString) > MaxPollOptions {
+		return commandErrorf("Failed to create poll: a poll cannot have more than %d options", MaxPollOptions)
+	}
+	for n, choice := range choicesString {
+		// Make sure the option doesn't exceed the length of a button label
+		if len(choice) > MaxOptionLength {
+			return commandErrorf("Failed to create poll: option %d exceeds %d characters", n+1, MaxOptionLength)
+		}
+	}
 
-			choicesString = append(choicesString, option.StringValue())
-		} else if option.Name == "duration" {
-			var err error
-			duration, err = parseDuration(option.StringValue())
-			if err != nil {
-				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-					Content: ptr("Failed to create poll: invalid duration"),
-				})
-				return
-			}
-			if duration > MaxDuration {
-				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-					Content: ptr(fmt.Sprintf("Failed to create poll: duration cannot exceed %.f hours", MaxDuration.Hours())),
-				})
-				return
-			}
+	if maxChoices > 1 {
+		if mode == PollModeRanked {
+			return commandErrorf("Failed to create poll: max choices cannot be used with ranked choice polls")
+		}
+		if maxChoices > len(choicesString) {
+			return commandErrorf("Failed to create poll: max choices cannot exceed the number of options (%d)", len(choicesString))
 		}
 	}
 
 	creationTime, err := discordgo.SnowflakeTimestamp(i.ID)
 	if err != nil {
-		logger.Print("Failed to get creation time: ", err)
-		return
+		return fmt.Errorf("error getting creation time: %w", err)
 	}
 
 	// Create a dummy message to edit later
 	msg, err := s.ChannelMessageSend(i.ChannelID, "Creating poll...")
 	if err != nil {
-		logger.Print("Failed to send message: ", err)
-		return
+		return fmt.Errorf("error sending message: %w", err)
 	}
 
 	// Add the poll to the database
@@ -102,20 +144,22 @@ func createPollCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		Question:    question,
 		Options:     choicesString,
 		Votes:       nil,
-		Creator:     i.Member.User.ID,
+		Creator:     c.User().ID,
 		CreatedTime: creationTime,
 		EndTime:     creationTime.Add(duration),
+		Mode:        mode,
+		MaxChoices:  maxChoices,
+		Anonymous:   anonymous,
+		HideResults: hideResults,
+		Colour:      settings.PollColour,
 	})
-
 	if err != nil {
-		logger.Print("Failed to create poll: ", err)
-		return
+		return fmt.Errorf("error creating poll: %w", err)
 	}
 
 	poll, err := databasePollGet(id)
 	if err != nil {
-		logger.Print("Failed to get poll: ", err)
-		return
+		return fmt.Errorf("error getting poll: %w", err)
 	}
 
 	_, err = s.ChannelMessageEditComplex(&discordgo.MessageEdit{
@@ -123,145 +167,212 @@ func createPollCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		Channel: i.ChannelID,
 		Content: ptr(""),
 		Embeds: []*discordgo.MessageEmbed{
-			ptr(generatePollEmbed(poll, i.Member.User)),
-		},
-		Components: []discordgo.MessageComponent{
-			discordgo.ActionsRow{
-				Components: choices,
-			},
+			ptr(generatePollEmbed(poll, c.User())),
 		},
+		Components: generatePollComponents(poll),
 	})
 	if err != nil {
-		logger.Print("Failed to send message: ", err)
-		return
+		return fmt.Errorf("error editing message: %w", err)
 	}
 
-	// Update the interaction response to say that the poll was created
-	s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-		Content: ptr(fmt.Sprintf("Poll created! It will end at %s.", Timestamp(poll.EndTime, TimestampShortDateTime))),
-	})
+	// Schedule the poll to be ended
+	if err := scheduler.Schedule(JobEndPoll, id, poll.EndTime); err != nil {
+		loggerFrom(c.Context).Error("Failed to schedule poll end", "poll", id, "error", err)
+	}
 
-	// Start a goroutine to end the poll
-	time.AfterFunc(time.Until(poll.EndTime), func() {
-		endPoll(s, id)
-	})
+	content := fmt.Sprintf("Poll created! It will end at %s.", Timestamp(poll.EndTime, TimestampShortDateTime))
+
+	// Schedule the reminder
+	if remindBefore > 0 {
+		remindAt := poll.EndTime.Add(-remindBefore)
+		if err := scheduler.SchedulePayload(JobPollReminder, id, remindAt, remindRole); err != nil {
+			loggerFrom(c.Context).Error("Failed to schedule poll reminder", "poll", id, "error", err)
+		} else {
+			content += fmt.Sprintf(" A reminder will be posted at %s.", Timestamp(remindAt, TimestampShortTime))
+		}
+	}
+
+	guildLog(s, i.GuildID, fmt.Sprintf("<@%s> created a poll in <#%s>: %s %s", poll.Creator, poll.Channel, truncate(poll.Question, 200), pollMessageURL(poll)))
+
+	// Update the interaction response to say that the poll was created
+	return c.Reply(content)
 }
 
 // endPollCmd is the handler for the end subcommand of the poll command
-func endPollCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{
-			Flags: discordgo.MessageFlagsEphemeral,
-		},
-	})
+func endPollCmd(c *CommandContext) error {
+	// Moderators can end anyone's poll by giving it, see managePoll
+	if c.Options.Has("poll") {
+		return managePollCmd(c, PollManageEnd)
+	}
 
 	// Check if the user has a poll running in this guild.
-	poll, err := databasePollGetUser(i.Member.User.ID, i.GuildID)
-	if err != nil {
-		s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-			Content: ptr("You don't have a poll running in this server."),
-		})
-		return
+	poll, err := databasePollGetUser(c.User().ID, c.Interaction.GuildID)
+	if errors.Is(err, errPollNotFound) {
+		return commandErrorf("You don't have a poll running in this server.")
+	} else if err != nil {
+		return err
 	}
 
-	// End the poll
-	endPoll(s, poll.ID)
+	// End the poll now instead of at its end time
+	if err := scheduler.Schedule(JobEndPoll, poll.ID, time.Now()); err != nil {
+		return fmt.Errorf("error scheduling poll end: %w", err)
+	}
 
 	// Update the interaction response to say that the poll was ended
-	s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-		Content: ptr("Poll ended."),
+	return c.Reply("Poll ended.")
+}
+
+// setupScheduler creates the scheduler and registers the jobs it runs. Commands schedule jobs as soon as the session opens,
+// so this happens before then, while the scheduler only starts once startupPolls has run.
+func setupScheduler(s Session) {
+	scheduler = newScheduler(store)
+	registerPollJobs(s)
+}
+
+// registerPollJobs sets up the scheduler to end polls and send their results.
+func registerPollJobs(s Session) {
+	scheduler.Handle(JobEndPoll, func(job dbJob) error {
+		return endPoll(s, job.Target)
+	})
+	scheduler.Handle(JobPollResults, func(job dbJob) error {
+		return sendPollResults(s, job.Target)
+	})
+	scheduler.Handle(JobPollReminder, func(job dbJob) error {
+		return sendPollReminder(s, job.Target, job.Payload)
+	})
+	scheduler.Handle(JobPollAnnounce, func(job dbJob) error {
+		return announcePollResults(s, job.Target)
 	})
 }
 
-// endPoll removes the poll from the database and edits the message to show the results
-func endPoll(s *discordgo.Session, pollId string) {
-	poll, err := databasePollEnd(pollId)
-	if err != nil {
-		logger.Print("Failed to end poll: ", err)
-		return
+// startupPolls makes sure every active poll has a job to end it, for polls created before the scheduler existed.
+func startupPolls() {
+	for poll := range databasePollGetAll() {
+		if err := scheduler.Ensure(JobEndPoll, poll.ID, poll.EndTime); err != nil {
+			logger.Error("Failed to schedule poll end", "poll", poll.ID, "error", err)
+		}
 	}
+}
 
-	// Get the total number of votes
-	totalVotes := 0
-	highestVotes := 0
-	for _, votes := range poll.Votes {
-		totalVotes += votes.Len()
-
-		if votes.Len() > highestVotes {
-			highestVotes = votes.Len()
+// endPoll marks the poll as ended, queues the results to be sent to the creator and edits the message to show them.
+// It is safe to run again after a failure, a poll that has already ended just has its message updated.
+func endPoll(s Session, pollId string) error {
+	poll, err := databasePollEnd(pollId)
+	if err == nil {
+		// Only the run that ended the poll sends the results, so that they aren't sent again when the edit is retried
+		if err := schedulePollResults(poll.ID); err != nil {
+			return err
 		}
+	} else if errors.Is(err, errPollNotFound) {
+		// The poll may have been ended by an earlier attempt
+		poll, err = databasePollGet(pollId)
+		if errors.Is(err, errPollNotFound) {
+			// The poll was deleted, there's nothing left to do
+			return nil
+		}
+		if err == nil && poll.Status != PollStatusEnded {
+			return fmt.Errorf("poll %s is %s", pollId, poll.Status)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error ending poll: %w", err)
 	}
 
 	// Create the message
 	user, err := s.User(poll.Creator)
 	if err != nil {
-		logger.Print("Failed to get user: ", err)
-		return
+		logger.Warn("Failed to get poll creator", "poll", poll.ID, "user", poll.Creator, "error", err)
+		user = nil
 	}
 
-	embed := generatePollEmbed(poll, user)
-
-	embed.Description = fmt.Sprintf("Poll ended (%d vote%s)", totalVotes, plural(totalVotes))
-	embed.Color = DiscordRed
-
-	// Update the message
+	// Update the message, replacing the chart from an earlier attempt
+	charts := pollChartFiles(poll)
 	_, err = s.ChannelMessageEditComplex(&discordgo.MessageEdit{
 		ID:      poll.Message,
 		Channel: poll.Channel,
 		Embeds: []*discordgo.MessageEmbed{
-			&embed,
+			ptr(generatePollEndedEmbed(poll, user, len(charts) > 0)),
 		},
-		Components: []discordgo.MessageComponent{},
+		Components:  []discordgo.MessageComponent{},
+		Files:       charts,
+		Attachments: &[]*discordgo.MessageAttachment{},
 	})
-	if err != nil {
-		logger.Print("Failed to edit message: ", err)
-		return
+	if isDiscordNotFound(err) {
+		// The message or channel was deleted, but the creator should still get the results
+		logger.Warn("Poll message is gone", "poll", poll.ID, "guild", poll.Guild, "channel", poll.Channel, "error", err)
+	} else if err != nil {
+		return fmt.Errorf("error editing message: %w", err)
 	}
+	return nil
+}
 
-	// Send the results to the creator
-	channel, err := s.UserChannelCreate(poll.Creator)
-	if err != nil {
-		logger.Print("Failed to create DM channel: ", err)
-		return
+// schedulePollResults queues the results of a poll that has just ended to be announced and sent to its creator.
+func schedulePollResults(pollId string) error {
+	if err := scheduler.Schedule(JobPollAnnounce, pollId, time.Now()); err != nil {
+		return err
 	}
+	return scheduler.Schedule(JobPollResults, pollId, time.Now())
+}
 
-	// Sort the options
-	entries := make([]struct {
-		string
-		int
-	}, 0, len(poll.Options))
-
-	for n, option := range poll.Options {
-		entries = append(entries, struct {
-			string
-			int
-		}{
-			string: option,
-			int:    poll.Votes[n].Len(),
-		})
+// sendPollReminder replies to a poll's message to remind people that it is about to end, optionally pinging a role.
+func sendPollReminder(s Session, pollId, roleId string) error {
+	poll, err := databasePollGet(pollId)
+	if errors.Is(err, errPollNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The poll may have been ended early
+	if poll.Status != PollStatusActive {
+		return nil
+	}
+
+	voters := pollVoterCount(poll)
+	turnout := fmt.Sprintf("%d people have", voters)
+	if voters == 1 {
+		turnout = "1 person has"
+	}
+	content := fmt.Sprintf("This poll ends %s, %s voted so far.", Timestamp(poll.EndTime, TimestampRelative), turnout)
+
+	mentions := &discordgo.MessageAllowedMentions{}
+	if roleId != "" {
+		content = fmt.Sprintf("<@&%s> %s", roleId, content)
+		mentions.Roles = []string{roleId}
 	}
 
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].int > entries[j].int
+	_, err = s.ChannelMessageSendComplex(poll.Channel, &discordgo.MessageSend{
+		Content:         content,
+		Reference:       &discordgo.MessageReference{MessageID: poll.Message, ChannelID: poll.Channel, GuildID: poll.Guild},
+		AllowedMentions: mentions,
 	})
+	if isDiscordNotFound(err) || isDiscordForbidden(err) {
+		// The channel is gone or the bot can no longer post in it, retrying won't help
+		logger.Warn("Failed to send poll reminder", "poll", poll.ID, "guild", poll.Guild, "channel", poll.Channel, "error", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error sending reminder: %w", err)
+	}
+	return nil
+}
 
-	// Generate the results fields
-	fields := make([]*discordgo.MessageEmbedField, 0, len(poll.Options))
-	for _, entry := range entries {
-		fields = append(fields, &discordgo.MessageEmbedField{
-			Name:  entry.string,
-			Value: formatVoteString(entry.int, totalVotes),
-		})
+// sendPollResults sends the results of an ended poll to its creator.
+func sendPollResults(s Session, pollId string) error {
+	poll, err := databasePollGet(pollId)
+	if errors.Is(err, errPollNotFound) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	embed.Fields = fields
-	embed.Footer = nil
-	embed.Color = DiscordBlurple
+	channel, err := s.UserChannelCreate(poll.Creator)
+	if err != nil {
+		return fmt.Errorf("error creating DM channel: %w", err)
+	}
 
 	guild, err := s.Guild(poll.Guild)
 	if err != nil {
-		logger.Print("Failed to get guild name: ", err)
+		logger.Warn("Failed to get guild name", "poll", poll.ID, "guild", poll.Guild, "error", err)
 		guild = nil
 	}
 
@@ -270,41 +381,110 @@ func endPoll(s *discordgo.Session, pollId string) {
 		content = fmt.Sprintf("The results for your poll in %s are available below.", guild.Name)
 	}
 
+	charts := pollChartFiles(poll)
 	_, err = s.ChannelMessageSendComplex(channel.ID, &discordgo.MessageSend{
 		Content: content,
-		Embed:   &embed,
+		Embed:   ptr(generatePollResultsEmbed(poll, len(charts) > 0)),
+		Files:   charts,
 	})
+	if isDiscordForbidden(err) {
+		// The creator doesn't accept DMs from the bot, retrying won't help
+		logger.Warn("Failed to send poll results", "poll", poll.ID, "user", poll.Creator, "error", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return nil
+}
+
+// announcePollResults posts the results of an ended poll in its guild's announcement channel, if it has one, and logs that it ended.
+func announcePollResults(s Session, pollId string) error {
+	poll, err := databasePollGet(pollId)
+	if errors.Is(err, errPollNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	settings, err := databaseGuildSettings(poll.Guild)
 	if err != nil {
-		logger.Print("Failed to send message: ", err)
-		return
+		return fmt.Errorf("error getting guild settings: %w", err)
 	}
+
+	if settings.AnnounceChannel != "" {
+		charts := pollChartFiles(poll)
+		_, err = s.ChannelMessageSendComplex(settings.AnnounceChannel, &discordgo.MessageSend{
+			Content:         fmt.Sprintf("A poll by <@%s> has ended: %s", poll.Creator, pollMessageURL(poll)),
+			Embed:           ptr(generatePollResultsEmbed(poll, len(charts) > 0)),
+			Files:           charts,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if isDiscordNotFound(err) || isDiscordForbidden(err) {
+			// The channel is gone or the bot can no longer post in it, retrying won't help
+			logger.Warn("Failed to announce poll results", "poll", poll.ID, "guild", poll.Guild, "channel", settings.AnnounceChannel, "error", err)
+		} else if err != nil {
+			return fmt.Errorf("error announcing results: %w", err)
+		}
+	}
+
+	guildLog(s, poll.Guild, fmt.Sprintf("The poll by <@%s> in <#%s> has ended: %s %s", poll.Creator, poll.Channel, truncate(poll.Question, 200), pollMessageURL(poll)))
+	return nil
+}
+
+// pollMessageURL gets a link to the message of a poll.
+func pollMessageURL(poll dbPoll) string {
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", poll.Guild, poll.Channel, poll.Message)
 }
 
 // Helpers
 func generatePollEmbed(poll dbPoll, creator *discordgo.User) discordgo.MessageEmbed {
 	fields := []*discordgo.MessageEmbedField{}
 
+	counts := pollVoteCounts(poll)
 	totalVotes := 0
 	highestVotes := 0
-	for _, voteOption := range poll.Votes {
-		totalVotes += voteOption.Len()
-		if voteOption.Len() > highestVotes {
-			highestVotes = voteOption.Len()
+	for _, votes := range counts {
+		totalVotes += votes
+		if votes > highestVotes {
+			highestVotes = votes
 		}
 	}
 
+	hidden := poll.HideResults && poll.Status == PollStatusActive
 	for i, option := range poll.Options {
+		if hidden {
+			fields = append(fields, &discordgo.MessageEmbedField{
+				Name:   option,
+				Value:  "Hidden until the poll ends",
+				Inline: true,
+			})
+			continue
+		}
+
 		str := option
-		if highestVotes > 0 && highestVotes == poll.Votes[i].Len() {
+		if highestVotes > 0 && highestVotes == counts[i] {
 			str = fmt.Sprintf(":medal: %s", option)
 		}
 		fields = append(fields, &discordgo.MessageEmbedField{
 			Name:   str,
-			Value:  formatVoteString(poll.Votes[i].Len(), totalVotes),
+			Value:  formatVoteString(counts[i], totalVotes),
 			Inline: true,
 		})
 	}
 
+	description := "Poll ends " + Timestamp(poll.EndTime, TimestampRelative)
+	if hidden {
+		description = fmt.Sprintf("%d vote%s so far. Results are hidden until the poll ends.\n", totalVotes, plural(totalVotes)) + description
+	}
+	if poll.Anonymous {
+		description = "Anonymous poll: votes can't be traced back to voters.\n" + description
+	}
+	if poll.Mode == PollModeRanked {
+		description = "Ranked choice: click the options in order of preference. Tallies show first preferences.\n" + description
+	} else if poll.MaxChoices > 1 {
+		description = fmt.Sprintf("Each voter has %d picks. Click an option again to take back a pick.\n", poll.MaxChoices) + description
+	}
+
 	footer := discordgo.MessageEmbedFooter{}
 	if creator != nil {
 		footer.Text = fmt.Sprintf("Poll created by %s", creator.Username)
@@ -313,14 +493,277 @@ func generatePollEmbed(poll dbPoll, creator *discordgo.User) discordgo.MessageEm
 
 	return discordgo.MessageEmbed{
 		Title:       poll.Question,
-		Description: "Poll ends " + Timestamp(poll.EndTime, TimestampRelative),
-		Color:       DiscordYellow,
+		Description: description,
+		Color:       poll.Colour,
 		Footer:      &footer,
 		Timestamp:   poll.CreatedTime.Format(time.RFC3339),
 		Fields:      fields,
 	}
 }
 
+// generatePollComponents creates the voting components for a poll message.
+// Polls with only a few options get a button for each option, larger polls get a select menu.
+func generatePollComponents(poll dbPoll) []discordgo.MessageComponent {
+	var components []discordgo.MessageComponent
+
+	if len(poll.Options) <= MaxPollButtons {
+		choices := make([]discordgo.MessageComponent, 0, len(poll.Options))
+		for n, option := range poll.Options {
+			choices = append(choices, discordgo.Button{
+				Label:    option,
+				CustomID: pollVoteRoute.CustomID(pollVotePayload{Poll: poll.ID, Action: PollActionVote, Option: n}),
+				Style:    discordgo.SuccessButton,
+			})
+		}
+
+		components = append(components, discordgo.ActionsRow{
+			Components: choices,
+		})
+	} else {
+		choices := make([]discordgo.SelectMenuOption, 0, len(poll.Options))
+		for n, option := range poll.Options {
+			choices = append(choices, discordgo.SelectMenuOption{
+				Label: option,
+				Value: strconv.Itoa(n),
+			})
+		}
+
+		menu := discordgo.SelectMenu{
+			CustomID:    pollVoteRoute.CustomID(pollVotePayload{Poll: poll.ID, Action: PollActionSelect}),
+			Placeholder: "Choose an option",
+			MinValues:   ptr(1),
+			MaxValues:   1,
+			Options:     choices,
+		}
+		if poll.Mode == PollModeRanked {
+			menu.Placeholder = "Choose your next preference"
+		} else if poll.MaxChoices > 1 {
+			menu.Placeholder = fmt.Sprintf("Choose up to %d options", poll.MaxChoices)
+			menu.MinValues = ptr(0)
+			menu.MaxValues = poll.MaxChoices
+		}
+
+		components = append(components, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{menu},
+		})
+	}
+
+	if poll.Mode == PollModeRanked {
+		components = append(components, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Clear ranking",
+					CustomID: pollVoteRoute.CustomID(pollVotePayload{Poll: poll.ID, Action: PollActionClear}),
+					Style:    discordgo.SecondaryButton,
+				},
+			},
+		})
+	}
+
+	return components
+}
+
+// PollAction is what a component on a poll message does.
+type PollAction string
+
+const (
+	// PollActionVote votes for the option of a button.
+	PollActionVote PollAction = "vote"
+	// PollActionSelect votes for the options picked in a select menu.
+	PollActionSelect PollAction = "select"
+	// PollActionClear clears the user's ranking in a ranked-choice poll.
+	PollActionClear PollAction = "clear"
+)
+
+// pollVotePayload is the payload of the components on a poll message.
+type pollVotePayload struct {
+	Poll   string
+	Action PollAction
+	// Option is the option to vote for, only used by PollActionVote.
+	Option int
+}
+
+// pollVoteRoute routes the components on poll messages.
+// Version 1 custom IDs are poll|<poll ID>|<option, select or clear>, version 2 custom IDs are poll@2|<poll ID>|<action>[|<option>].
+var pollVoteRoute = &ComponentRoute[pollVotePayload]{
+	Prefix:  "poll",
+	Version: 2,
+	Encode: func(payload pollVotePayload) []string {
+		if payload.Action == PollActionVote {
+			return []string{payload.Poll, string(payload.Action), strconv.Itoa(payload.Option)}
+		}
+		return []string{payload.Poll, string(payload.Action)}
+	},
+	Decode: func(version int, fields []string) (pollVotePayload, error) {
+		if version == 1 {
+			if len(fields) != 2 {
+				return pollVotePayload{}, errInvalidPayload
+			}
+			if fields[1] == string(PollActionSelect) || fields[1] == string(PollActionClear) {
+				return pollVotePayload{Poll: fields[0], Action: PollAction(fields[1])}, nil
+			}
+			fields = []string{fields[0], string(PollActionVote), fields[1]}
+		}
+
+		if len(fields) < 2 {
+			return pollVotePayload{}, errInvalidPayload
+		}
+
+		payload := pollVotePayload{Poll: fields[0], Action: PollAction(fields[1])}
+		switch payload.Action {
+		case PollActionVote:
+			if len(fields) != 3 {
+				return pollVotePayload{}, errInvalidPayload
+			}
+			option, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return pollVotePayload{}, fmt.Errorf("invalid option: %w", err)
+			}
+			payload.Option = option
+		case PollActionSelect, PollActionClear:
+			if len(fields) != 2 {
+				return pollVotePayload{}, errInvalidPayload
+			}
+		default:
+			return pollVotePayload{}, fmt.Errorf("unknown poll action %q", payload.Action)
+		}
+		return payload, nil
+	},
+}
+
+func init() {
+	pollVoteRoute.Handle(handlePollComponent)
+}
+
+// pollVoterKey returns the key a user's votes are stored under.
+// For anonymous polls this is a salted hash of the user's ID so votes can be deduplicated without storing who cast them.
+func pollVoterKey(poll dbPoll, userId string) string {
+	if !poll.Anonymous {
+		return userId
+	}
+
+	mac := hmac.New(sha256.New, []byte(poll.Salt))
+	mac.Write([]byte(userId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pollVoteCounts returns the number of votes for each option of a poll.
+// For ranked-choice polls this is the number of first preferences.
+func pollVoteCounts(poll dbPoll) []int {
+	counts := make([]int, len(poll.Options))
+	if poll.Mode == PollModeRanked {
+		for _, ranking := range poll.Rankings {
+			if len(ranking) > 0 && ranking[0] < len(counts) {
+				counts[ranking[0]]++
+			}
+		}
+		return counts
+	}
+
+	for n := range counts {
+		counts[n] = poll.Votes[n].Len()
+	}
+	return counts
+}
+
+// pollVoterCount gets the number of users who have voted in a poll.
+func pollVoterCount(poll dbPoll) int {
+	if poll.Mode == PollModeRanked {
+		return len(poll.Rankings)
+	}
+
+	voters := map[string]bool{}
+	for _, votes := range poll.Votes {
+		for _, voter := range votes.Values() {
+			voters[voter] = true
+		}
+	}
+	return len(voters)
+}
+
+// generatePollEndedEmbed creates the embed that replaces the poll message once the poll has ended.
+// With a chart the embed shows the attached chart instead of text bars, see pollChartFiles.
+func generatePollEndedEmbed(poll dbPoll, creator *discordgo.User, chart bool) discordgo.MessageEmbed {
+	embed := generatePollEmbed(poll, creator)
+
+	counts := pollVoteCounts(poll)
+	totalVotes := 0
+	for _, votes := range counts {
+		totalVotes += votes
+	}
+
+	embed.Description = fmt.Sprintf("Poll ended (%d vote%s)", totalVotes, plural(totalVotes))
+	embed.Color = DiscordRed
+	if chart {
+		// The results of an ended poll are never hidden, so there is a field for each option
+		for n, field := range embed.Fields {
+			field.Value = formatVoteCount(counts[n], totalVotes)
+		}
+		embed.Image = &discordgo.MessageEmbedImage{URL: "attachment://" + PollChartName}
+	}
+	embed.Fields = withRunoffFields(poll, embed.Fields)
+	return embed
+}
+
+// generatePollResultsEmbed creates the final results of a poll, with the options sorted by the number of votes.
+// With a chart the embed shows the attached chart instead of text bars, see pollChartFiles.
+func generatePollResultsEmbed(poll dbPoll, chart bool) discordgo.MessageEmbed {
+	counts := pollVoteCounts(poll)
+	totalVotes := 0
+	for _, votes := range counts {
+		totalVotes += votes
+	}
+
+	// Sort the options
+	order := make([]int, len(poll.Options))
+	for n := range order {
+		order[n] = n
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+
+	// Generate the results fields
+	fields := make([]*discordgo.MessageEmbedField, 0, len(poll.Options))
+	for _, n := range order {
+		value := formatVoteString(counts[n], totalVotes)
+		if chart {
+			value = formatVoteCount(counts[n], totalVotes)
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  poll.Options[n],
+			Value: value,
+		})
+	}
+
+	embed := discordgo.MessageEmbed{
+		Title:       poll.Question,
+		Description: fmt.Sprintf("Poll ended %s (%d vote%s)", Timestamp(poll.EndedAt, TimestampShortDateTime), totalVotes, plural(totalVotes)),
+		Color:       DiscordBlurple,
+		Timestamp:   poll.CreatedTime.Format(time.RFC3339),
+		Fields:      withRunoffFields(poll, fields),
+	}
+	if chart {
+		embed.Image = &discordgo.MessageEmbedImage{URL: "attachment://" + PollChartName}
+	}
+	return embed
+}
+
+// withRunoffFields adds the rounds of a ranked-choice poll to its option fields, dropping the option fields if there
+// isn't room for both. The first round already shows the first preference for every option.
+func withRunoffFields(poll dbPoll, fields []*discordgo.MessageEmbedField) []*discordgo.MessageEmbedField {
+	if poll.Mode != PollModeRanked {
+		return fields
+	}
+
+	runoffFields := generateRunoffFields(poll, instantRunoff(poll))
+	if len(fields)+len(runoffFields) > MaxEmbedFields {
+		return runoffFields
+	}
+	return append(fields, runoffFields...)
+}
+
 func formatVoteBar(votes, totalVotes int) string {
 	if totalVotes == 0 {
 		return strings.Repeat("░", 10)
@@ -341,6 +784,10 @@ func formatVotePercentage(votes, totalVotes int) string {
 	return fmt.Sprintf(" (%.2f%%)", float64(votes)/float64(totalVotes)*100)
 }
 
+func formatVoteCount(votes, totalVotes int) string {
+	return fmt.Sprintf("%d vote%s%s", votes, plural(votes), formatVotePercentage(votes, totalVotes))
+}
+
 func formatVoteString(votes, totalVotes int) string {
-	return fmt.Sprintf("%s %d vote%s%s", formatVoteBar(votes, totalVotes), votes, plural(votes), formatVotePercentage(votes, totalVotes))
+	return fmt.Sprintf("%s %s", formatVoteBar(votes, totalVotes), formatVoteCount(votes, totalVotes))
 }
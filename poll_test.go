@@ -0,0 +1,479 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// createTestPoll creates a poll with /poll create and returns it.
+func createTestPoll(t *testing.T, s *fakeSession, member *discordgo.Member, options ...*discordgo.ApplicationCommandInteractionDataOption) dbPoll {
+	t.Helper()
+
+	if len(options) == 0 {
+		options = []*discordgo.ApplicationCommandInteractionDataOption{
+			stringOption("question", "What's for lunch?"),
+			stringOption("option1", "Pizza"),
+			stringOption("option2", "Salad"),
+		}
+	}
+	mustInteract(t, s, commandInteraction(member, "poll", subcommand("create", options...)))
+
+	poll, err := databasePollGetUser(member.User.ID, testGuild)
+	if err != nil {
+		t.Fatalf("poll wasn't created: %v", err)
+	}
+	return poll
+}
+
+// vote clicks the button for an option on a poll's message.
+func vote(t *testing.T, s *fakeSession, member *discordgo.Member, poll dbPoll, option int) {
+	t.Helper()
+	mustInteract(t, s, componentInteraction(member, pollVoteRoute.CustomID(pollVotePayload{Poll: poll.ID, Action: PollActionVote, Option: option})))
+}
+
+func TestCreatePoll(t *testing.T) {
+	s := setupTest(t)
+	member := testMember("1", 0)
+
+	i := commandInteraction(member, "poll", subcommand("create",
+		stringOption("question", "What's for lunch?"),
+		stringOption("option1", "Pizza"),
+		stringOption("option2", "Salad"),
+		stringOption("options", "Soup; Curry"),
+		stringOption("duration", "2h"),
+	))
+	mustInteract(t, s, i)
+
+	poll, err := databasePollGetUser("1", testGuild)
+	if err != nil {
+		t.Fatalf("poll wasn't created: %v", err)
+	}
+	if want := []string{"Pizza", "Salad", "Soup", "Curry"}; strings.Join(poll.Options, ",") != strings.Join(want, ",") {
+		t.Errorf("options = %v, want %v", poll.Options, want)
+	}
+	if got := poll.EndTime.Sub(poll.CreatedTime); got != 2*time.Hour {
+		t.Errorf("poll lasts %s, want 2h", got)
+	}
+
+	// The poll message shows the question with a button for each option
+	message, ok := s.message(poll.Message)
+	if !ok {
+		t.Fatal("poll message wasn't sent")
+	}
+	if message.ChannelID != testChannel || len(message.Embeds) != 1 || message.Embeds[0].Title != "What's for lunch?" {
+		t.Errorf("poll message = %+v, want an embed with the question in the test channel", message)
+	}
+	if message.Embeds[0].Color != DiscordYellow {
+		t.Errorf("poll colour = %06X, want the default %06X", message.Embeds[0].Color, DiscordYellow)
+	}
+	row := message.Components[0].(discordgo.ActionsRow)
+	if len(row.Components) != 4 {
+		t.Errorf("poll message has %d buttons, want 4", len(row.Components))
+	}
+
+	if reply := s.reply(i); !strings.HasPrefix(reply, "Poll created!") {
+		t.Errorf("reply = %q, want the poll to be created", reply)
+	}
+
+	// The poll is scheduled to end
+	job, ok, err := store.NextJob()
+	if err != nil || !ok {
+		t.Fatalf("no job was scheduled: %v", err)
+	}
+	if job.Kind != JobEndPoll || job.Target != poll.ID || !job.RunAt.Equal(poll.EndTime) {
+		t.Errorf("scheduled job = %+v, want the poll to end at %s", job, poll.EndTime)
+	}
+}
+
+func TestCreatePollValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []*discordgo.ApplicationCommandInteractionDataOption
+		want    string
+	}{
+		{
+			name:    "one option",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "Q"), stringOption("option1", "A")},
+			want:    "at least 2 options",
+		},
+		{
+			name:    "too long",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "Q"), stringOption("options", "A;B"), stringOption("duration", "25h")},
+			want:    "duration cannot exceed 24h",
+		},
+		{
+			name:    "invalid duration",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "Q"), stringOption("options", "A;B"), stringOption("duration", "soon")},
+			want:    "invalid duration",
+		},
+		{
+			name:    "reminder after end",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "Q"), stringOption("options", "A;B"), stringOption("duration", "1h"), stringOption("remind_before", "2h")},
+			want:    "reminder must be before the poll ends",
+		},
+		{
+			name:    "too many choices",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{stringOption("question", "Q"), stringOption("options", "A;B"), intOption("max_choices", 3)},
+			want:    "max choices cannot exceed the number of options",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := setupTest(t)
+			i := commandInteraction(testMember("1", 0), "poll", subcommand("create", test.options...))
+
+			err := interact(s, i)
+			var cmdErr *commandError
+			if !errors.As(err, &cmdErr) {
+				t.Fatalf("got error %v, want the poll to be rejected", err)
+			}
+			if reply := s.reply(i); !strings.Contains(reply, test.want) {
+				t.Errorf("reply = %q, want it to contain %q", reply, test.want)
+			}
+			if messages := s.channelMessages(testChannel); len(messages) != 0 {
+				t.Errorf("%d messages were sent, want none", len(messages))
+			}
+		})
+	}
+}
+
+func TestCreatePollLimit(t *testing.T) {
+	s := setupTest(t)
+	member := testMember("1", 0)
+	createTestPoll(t, s, member)
+
+	i := commandInteraction(member, "poll", subcommand("create", stringOption("question", "Again?"), stringOption("options", "Yes;No")))
+	if err := interact(s, i); err == nil {
+		t.Fatal("a second poll was created, want it to be rejected")
+	}
+	if reply := s.reply(i); !strings.Contains(reply, "already have a poll running") {
+		t.Errorf("reply = %q, want the user to be told they already have a poll", reply)
+	}
+
+	// Servers can let members run more polls at once
+	if err := databaseGuildSettingSet(testGuild, "max_polls_per_user", "2"); err != nil {
+		t.Fatal(err)
+	}
+	mustInteract(t, s, commandInteraction(member, "poll", subcommand("create", stringOption("question", "Again?"), stringOption("options", "Yes;No"))))
+	if count, _ := databasePollCountUser("1", testGuild); count != 2 {
+		t.Errorf("user has %d polls running, want 2", count)
+	}
+}
+
+func TestVote(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	voter := testMember("2", 0)
+
+	vote(t, s, voter, poll, 1)
+	poll, _ = databasePollGet(poll.ID)
+	if !poll.Votes[1].Has("2") {
+		t.Fatalf("votes = %v, want user 2 to have voted for option 1", poll.Votes)
+	}
+
+	// Voting for another option in a single choice poll moves the vote
+	i := componentInteraction(voter, pollVoteRoute.CustomID(pollVotePayload{Poll: poll.ID, Action: PollActionVote, Option: 0}))
+	mustInteract(t, s, i)
+	poll, _ = databasePollGet(poll.ID)
+	if !poll.Votes[0].Has("2") || poll.Votes[1].Has("2") {
+		t.Errorf("votes = %v, want user 2's vote to have moved to option 0", poll.Votes)
+	}
+
+	// The message is updated with the new tally
+	edits := s.interactions[i.ID].Edits
+	if len(edits) != 1 || edits[0].Embeds == nil {
+		t.Fatalf("got %d edits of the poll message, want 1 with the updated embed", len(edits))
+	}
+	if got := (*edits[0].Embeds)[0].Fields[0].Value; !strings.Contains(got, "1 vote") {
+		t.Errorf("tally of option 0 = %q, want 1 vote", got)
+	}
+}
+
+func TestVoteLegacyCustomID(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+
+	// Messages sent before custom IDs were versioned still have poll|<poll ID>|<option> buttons
+	mustInteract(t, s, componentInteraction(testMember("2", 0), "poll|"+poll.ID+"|1"))
+	poll, _ = databasePollGet(poll.ID)
+	if !poll.Votes[1].Has("2") {
+		t.Errorf("votes = %v, want user 2 to have voted for option 1", poll.Votes)
+	}
+}
+
+func TestVoteEndedPoll(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	if err := endPoll(s, poll.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	i := componentInteraction(testMember("2", 0), pollVoteRoute.CustomID(pollVotePayload{Poll: poll.ID, Action: PollActionVote, Option: 0}))
+	interact(s, i)
+	if reply := s.reply(i); reply != "This poll has ended." {
+		t.Errorf("reply = %q, want the user to be told the poll has ended", reply)
+	}
+	poll, _ = databasePollGet(poll.ID)
+	if poll.Votes[0].Has("2") {
+		t.Error("a vote was counted on an ended poll")
+	}
+}
+
+func TestVoteMultipleChoice(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0),
+		stringOption("question", "Toppings?"),
+		stringOption("options", "Cheese;Ham;Olives"),
+		intOption("max_choices", 2),
+	)
+	voter := testMember("2", 0)
+
+	vote(t, s, voter, poll, 0)
+	vote(t, s, voter, poll, 1)
+
+	i := componentInteraction(voter, pollVoteRoute.CustomID(pollVotePayload{Poll: poll.ID, Action: PollActionVote, Option: 2}))
+	if err := interact(s, i); err == nil {
+		t.Fatal("a third pick was accepted, want it to be rejected")
+	}
+	if reply := s.reply(i); !strings.Contains(reply, "all 2 of your picks") {
+		t.Errorf("reply = %q, want the user to be told they are out of picks", reply)
+	}
+
+	// Clicking a picked option takes the pick back
+	vote(t, s, voter, poll, 0)
+	poll, _ = databasePollGet(poll.ID)
+	if poll.Votes[0].Has("2") || !poll.Votes[1].Has("2") {
+		t.Errorf("votes = %v, want user 2 to have only picked option 1", poll.Votes)
+	}
+}
+
+func TestEndPoll(t *testing.T) {
+	s := setupTest(t)
+	creator := testMember("1", 0)
+	poll := createTestPoll(t, s, creator)
+	vote(t, s, testMember("2", 0), poll, 0)
+	vote(t, s, testMember("3", 0), poll, 0)
+
+	i := commandInteraction(creator, "poll", subcommand("end"))
+	mustInteract(t, s, i)
+	if reply := s.reply(i); reply != "Poll ended." {
+		t.Errorf("reply = %q, want the poll to be ended", reply)
+	}
+
+	// Ending the poll is left to the scheduler
+	scheduler.runDue()
+
+	poll, _ = databasePollGet(poll.ID)
+	if poll.Status != PollStatusEnded {
+		t.Fatalf("poll is %s, want it to have ended", poll.Status)
+	}
+
+	message, _ := s.message(poll.Message)
+	if len(message.Components) != 0 {
+		t.Errorf("poll message still has %d component rows, want the buttons removed", len(message.Components))
+	}
+	if message.Embeds[0].Color != DiscordRed {
+		t.Errorf("ended poll colour = %06X, want %06X", message.Embeds[0].Color, DiscordRed)
+	}
+	checkChart(t, message)
+
+	// The creator gets the results in a DM
+	dms := s.channelMessages("dm-1")
+	if len(dms) != 1 || len(dms[0].Embeds) != 1 {
+		t.Fatalf("creator got %d DMs, want 1 with the results", len(dms))
+	}
+	if !strings.Contains(dms[0].Content, "Test Server") {
+		t.Errorf("results DM = %q, want it to name the server", dms[0].Content)
+	}
+	checkChart(t, dms[0])
+
+	if _, ok, _ := store.NextJob(); ok {
+		t.Error("jobs are left over after the poll ended")
+	}
+
+	// The creator can start a new poll now
+	createTestPoll(t, s, creator)
+}
+
+func TestEndPollWithoutPoll(t *testing.T) {
+	s := setupTest(t)
+
+	i := commandInteraction(testMember("1", 0), "poll", subcommand("end"))
+	if err := interact(s, i); err == nil {
+		t.Fatal("ending a poll that doesn't exist succeeded")
+	}
+	if reply := s.reply(i); !strings.Contains(reply, "don't have a poll running") {
+		t.Errorf("reply = %q, want the user to be told they have no poll", reply)
+	}
+}
+
+func TestEndPollMessageDeleted(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+
+	// Someone deleted the poll message
+	s.messages = nil
+
+	if err := endPoll(s, poll.ID); err != nil {
+		t.Fatalf("ending a poll without a message failed: %v", err)
+	}
+	scheduler.runDue()
+
+	if dms := s.channelMessages("dm-1"); len(dms) != 1 {
+		t.Errorf("creator got %d DMs, want the results even though the poll message is gone", len(dms))
+	}
+}
+
+func TestEndPollRetried(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+
+	// Discord is down when the poll ends
+	s.errors["ChannelMessageEditComplex"] = discordError(500)
+	if err := endPoll(s, poll.ID); err == nil {
+		t.Fatal("ending the poll succeeded even though the message couldn't be edited")
+	}
+
+	// Running it again once Discord is back finishes the job, without the poll being ended twice
+	delete(s.errors, "ChannelMessageEditComplex")
+	if err := endPoll(s, poll.ID); err != nil {
+		t.Fatalf("retrying the poll end failed: %v", err)
+	}
+	message, _ := s.message(poll.Message)
+	if len(message.Components) != 0 {
+		t.Error("poll message wasn't updated when the end was retried")
+	}
+	scheduler.runDue()
+
+	// Running it once more replaces the chart instead of adding another
+	if err := endPoll(s, poll.ID); err != nil {
+		t.Fatalf("ending the poll again failed: %v", err)
+	}
+	message, _ = s.message(poll.Message)
+	checkChart(t, message)
+
+	// The results were only queued by the attempt that ended the poll
+	scheduler.runDue()
+	if dms := s.channelMessages("dm-1"); len(dms) != 1 {
+		t.Errorf("creator got %d DMs, want the results once", len(dms))
+	}
+}
+
+func TestAnnounceResults(t *testing.T) {
+	s := setupTest(t)
+	admin := testMember("9", discordgo.PermissionManageServer)
+	s.channels["500"] = &discordgo.Channel{ID: "500", GuildID: testGuild, Type: discordgo.ChannelTypeGuildText}
+
+	i := commandInteraction(admin, "config", subcommand("set", stringOption("setting", "announce_channel"), stringOption("value", "<#500>")))
+	mustInteract(t, s, i)
+	if reply := s.reply(i); !strings.Contains(reply, "<#500>") {
+		t.Errorf("reply = %q, want the announcement channel to be set", reply)
+	}
+
+	poll := createTestPoll(t, s, testMember("1", 0))
+	if err := scheduler.Schedule(JobEndPoll, poll.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.runDue()
+
+	announcements := s.channelMessages("500")
+	if len(announcements) != 1 || len(announcements[0].Embeds) != 1 {
+		t.Fatalf("got %d announcements, want 1 with the results", len(announcements))
+	}
+	if !strings.Contains(announcements[0].Content, pollMessageURL(poll)) {
+		t.Errorf("announcement = %q, want it to link to the poll", announcements[0].Content)
+	}
+}
+
+func TestStartupRecovery(t *testing.T) {
+	s := setupTest(t)
+	now := time.Now()
+
+	// Polls left by an earlier run that had no jobs, one of which ended while the bot was offline
+	overdue := startupTestPoll(t, s, "overdue", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	running := startupTestPoll(t, s, "running", now.Add(-time.Hour), now.Add(time.Hour))
+
+	startupPolls()
+	scheduler.runDue()
+
+	if poll, _ := databasePollGet(overdue.ID); poll.Status != PollStatusEnded {
+		t.Errorf("overdue poll is %s, want it to have ended", poll.Status)
+	}
+	if dms := s.channelMessages("dm-1"); len(dms) != 1 {
+		t.Errorf("creator of the overdue poll got %d DMs, want the results", len(dms))
+	}
+
+	if poll, _ := databasePollGet(running.ID); poll.Status != PollStatusActive {
+		t.Errorf("running poll is %s, want it to still be active", poll.Status)
+	}
+	job, ok, _ := store.NextJob()
+	if !ok || job.Target != running.ID || !job.RunAt.Equal(running.EndTime) {
+		t.Errorf("next job = %+v, want the running poll to end at %s", job, running.EndTime)
+	}
+
+	// Running startup again doesn't reschedule polls that already have jobs
+	if err := scheduler.Schedule(JobEndPoll, running.ID, now.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	startupPolls()
+	if job, _, _ := store.NextJob(); !job.RunAt.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("startup moved the end of the running poll to %s", job.RunAt)
+	}
+}
+
+func TestInteractionBeforeStartup(t *testing.T) {
+	s := setupTest(t)
+	creator := testMember("1", 0)
+
+	// Interactions can arrive while commands are registered, before startup has run and the scheduler has started
+	scheduler = nil
+	setupScheduler(s)
+	poll := createTestPoll(t, s, creator)
+	mustInteract(t, s, commandInteraction(creator, "poll", subcommand("end")))
+
+	job, ok, _ := store.NextJob()
+	if !ok || job.Kind != JobEndPoll || job.Target != poll.ID {
+		t.Fatalf("next job = %+v, want the poll to be ended", job)
+	}
+
+	startupPolls()
+	scheduler.runDue()
+	if poll, _ := databasePollGet(poll.ID); poll.Status != PollStatusEnded {
+		t.Errorf("poll is %s, want it to have ended", poll.Status)
+	}
+	if dms := s.channelMessages("dm-1"); len(dms) != 1 {
+		t.Errorf("creator got %d DMs, want the results", len(dms))
+	}
+}
+
+// startupTestPoll adds a poll by user 1 straight to the store, as if it had been created by an earlier run.
+func startupTestPoll(t *testing.T, s *fakeSession, id string, created, end time.Time) dbPoll {
+	t.Helper()
+
+	message, err := s.ChannelMessageSend(testChannel, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll := dbPoll{
+		ID:          id,
+		Guild:       testGuild,
+		Channel:     testChannel,
+		Message:     message.ID,
+		Question:    "Left over?",
+		Options:     []string{"Yes", "No"},
+		Creator:     "1",
+		CreatedTime: created,
+		EndTime:     end,
+		Colour:      DiscordYellow,
+	}
+	if err := databasePollCreate(poll); err != nil {
+		t.Fatal(err)
+	}
+	return poll
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"discordhelperbot/set"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// exportTimeFormat is the format of times in CSV exports, which spreadsheets recognise. Times are in UTC.
+const exportTimeFormat = "2006-01-02 15:04:05"
+
+var messageLinkRegex = regexp.MustCompile(`^https://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/channels/(?:\d+|@me)/\d+/(\d+)$`)
+
+// findGuildPoll finds a poll in a guild from a link to its message, the message's ID or the poll's ID.
+func findGuildPoll(guildId, ref string) (dbPoll, error) {
+	ref = strings.Trim(strings.TrimSpace(ref), "<>")
+
+	var (
+		poll dbPoll
+		err  error
+	)
+	if match := messageLinkRegex.FindStringSubmatch(ref); match != nil {
+		poll, err = databasePollGetMessage(match[1])
+	} else if _, parseErr := strconv.ParseUint(ref, 10, 64); parseErr == nil {
+		poll, err = databasePollGetMessage(ref)
+	} else {
+		poll, err = databasePollGet(ref)
+	}
+
+	// Polls in other guilds are treated as missing
+	if errors.Is(err, errPollNotFound) || (err == nil && poll.Guild != guildId) {
+		return dbPoll{}, commandErrorf("Couldn't find that poll in this server. Give a link to the poll's message, or its ID.")
+	} else if err != nil {
+		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
+	}
+	return poll, nil
+}
+
+// exportPollCmd is the handler for the export subcommand of the poll command
+func exportPollCmd(c *CommandContext) error {
+	poll, err := findGuildPoll(c.Interaction.GuildID, c.Options.String("poll", ""))
+	if err != nil {
+		return err
+	}
+
+	// Voter IDs aren't shown anywhere else, so only the creator and the server's managers can see them
+	member := c.Interaction.Member
+	if poll.Creator != c.User().ID && member.Permissions&discordgo.PermissionManageServer == 0 {
+		return commandErrorf("Only the person who created a poll and people with the Manage Server permission can export it.")
+	}
+	if poll.Status == PollStatusActive && poll.HideResults {
+		return commandErrorf("The results of this poll are hidden until it ends.")
+	}
+
+	votes, err := databasePollVotes(poll.ID)
+	if err != nil {
+		return fmt.Errorf("error getting votes: %w", err)
+	}
+
+	var buf bytes.Buffer
+	format := c.Options.String("format", "csv")
+	switch format {
+	case "csv":
+		err = writePollCSV(&buf, poll, votes)
+	case "json":
+		err = writePollJSON(&buf, poll, votes)
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("error exporting poll: %w", err)
+	}
+
+	content := fmt.Sprintf("Results of **%s**", poll.Question)
+	if poll.Status == PollStatusActive {
+		content += " so far, the poll is still running"
+	}
+	if poll.Anonymous {
+		content += ". The poll is anonymous, so who voted for what isn't included"
+	}
+
+	return c.Respond(&discordgo.InteractionResponseData{
+		Content: content + ".",
+		Files: []*discordgo.File{
+			{
+				Name:        fmt.Sprintf("poll-%s.%s", poll.ID, format),
+				ContentType: map[string]string{"csv": "text/csv", "json": "application/json"}[format],
+				Reader:      &buf,
+			},
+		},
+		Flags: discordgo.MessageFlagsEphemeral,
+	})
+}
+
+// writePollCSV writes a poll's results as CSV, in sections separated by blank lines: details of the poll, the votes for each option,
+// and for polls that aren't anonymous the votes of each voter.
+func writePollCSV(w io.Writer, poll dbPoll, votes []dbVote) error {
+	out := csv.NewWriter(w)
+
+	out.Write([]string{"Question", poll.Question})
+	out.Write([]string{"Mode", string(poll.Mode)})
+	out.Write([]string{"Status", string(poll.Status)})
+	out.Write([]string{"Created (UTC)", poll.CreatedTime.UTC().Format(exportTimeFormat)})
+	if poll.Status == PollStatusEnded {
+		out.Write([]string{"Ended (UTC)", poll.EndedAt.UTC().Format(exportTimeFormat)})
+	} else {
+		out.Write([]string{"Ends (UTC)", poll.EndTime.UTC().Format(exportTimeFormat)})
+	}
+	out.Write([]string{"Voters", strconv.Itoa(pollVoterCount(poll))})
+	out.Write(nil)
+
+	counts := pollVoteCounts(poll)
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+
+	votesHeader := "Votes"
+	if poll.Mode == PollModeRanked {
+		votesHeader = "First preferences"
+	}
+	out.Write([]string{"Option", votesHeader, "Percentage"})
+	for n, option := range poll.Options {
+		percentage := 0.0
+		if total > 0 {
+			percentage = float64(counts[n]) / float64(total) * 100
+		}
+		out.Write([]string{option, strconv.Itoa(counts[n]), fmt.Sprintf("%.2f%%", percentage)})
+	}
+
+	if !poll.Anonymous {
+		out.Write(nil)
+		out.Write([]string{"Voter ID", "Option", "Rank", "Voted (UTC)"})
+		for _, vote := range exportedVotes(poll, votes) {
+			rank := ""
+			if vote.Rank > 0 {
+				rank = strconv.Itoa(vote.Rank)
+			}
+			out.Write([]string{vote.User, poll.Options[vote.Option], rank, vote.VotedAt.UTC().Format(exportTimeFormat)})
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// exportedVotes leaves out votes for options a poll doesn't have, so both export formats list the same votes.
+func exportedVotes(poll dbPoll, votes []dbVote) []dbVote {
+	valid := make([]dbVote, 0, len(votes))
+	for _, vote := range votes {
+		if vote.Option >= 0 && vote.Option < len(poll.Options) {
+			valid = append(valid, vote)
+		}
+	}
+	return valid
+}
+
+// pollResultsExport is a poll's results as exported to JSON.
+type pollResultsExport struct {
+	ID        string     `json:"id"`
+	Question  string     `json:"question"`
+	Mode      PollMode   `json:"mode"`
+	Status    PollStatus `json:"status"`
+	Anonymous bool       `json:"anonymous"`
+	Created   time.Time  `json:"created"`
+	Ends      time.Time  `json:"ends"`
+	Ended     *time.Time `json:"ended,omitempty"`
+	Voters    int        `json:"voters"`
+	// Options hold the number of votes for each option, or of first preferences for ranked-choice polls.
+	Options []optionResultExport `json:"options"`
+	// Votes is every vote cast, left out for anonymous polls.
+	Votes []voteExport `json:"votes,omitempty"`
+}
+
+type optionResultExport struct {
+	Name  string `json:"name"`
+	Votes int    `json:"votes"`
+	// Voters is who voted for the option, or ranked it for ranked-choice polls.
+	Voters *set.Set[string] `json:"voters,omitempty"`
+}
+
+type voteExport struct {
+	User   string `json:"user"`
+	Option int    `json:"option"`
+	// Rank is the position of the option in the user's ranking, starting from 1, for ranked-choice polls.
+	Rank    int       `json:"rank,omitempty"`
+	VotedAt time.Time `json:"voted_at"`
+}
+
+// writePollJSON writes a poll's results as JSON, see pollResultsExport.
+func writePollJSON(w io.Writer, poll dbPoll, votes []dbVote) error {
+	export := pollResultsExport{
+		ID:        poll.ID,
+		Question:  poll.Question,
+		Mode:      poll.Mode,
+		Status:    poll.Status,
+		Anonymous: poll.Anonymous,
+		Created:   poll.CreatedTime,
+		Ends:      poll.EndTime,
+		Voters:    pollVoterCount(poll),
+		Options:   make([]optionResultExport, len(poll.Options)),
+	}
+	if poll.Status == PollStatusEnded {
+		export.Ended = ptr(poll.EndedAt)
+	}
+
+	counts := pollVoteCounts(poll)
+	for n, option := range poll.Options {
+		export.Options[n] = optionResultExport{Name: option, Votes: counts[n]}
+		if !poll.Anonymous {
+			export.Options[n].Voters = &poll.Votes[n]
+		}
+	}
+
+	if !poll.Anonymous {
+		export.Votes = make([]voteExport, 0, len(votes))
+		for _, vote := range exportedVotes(poll, votes) {
+			export.Votes = append(export.Votes, voteExport{User: vote.User, Option: vote.Option, Rank: vote.Rank, VotedAt: vote.VotedAt})
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(export)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// exportedFile runs /poll export and returns the attached file.
+func exportedFile(t *testing.T, s *fakeSession, member *discordgo.Member, options ...*discordgo.ApplicationCommandInteractionDataOption) (*discordgo.File, string) {
+	t.Helper()
+
+	i := commandInteraction(member, "poll", subcommand("export", options...))
+	mustInteract(t, s, i)
+
+	edits := s.interactions[i.ID].Edits
+	if len(edits) != 1 || len(edits[0].Files) != 1 {
+		t.Fatalf("reply = %q, want a file", s.reply(i))
+	}
+	data, err := io.ReadAll(edits[0].Files[0].Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return edits[0].Files[0], string(data)
+}
+
+func TestExportPollCSV(t *testing.T) {
+	s := setupTest(t)
+	creator := testMember("1", 0)
+	poll := createTestPoll(t, s, creator)
+	vote(t, s, testMember("2", 0), poll, 0)
+	vote(t, s, testMember("3", 0), poll, 0)
+	vote(t, s, testMember("4", 0), poll, 1)
+
+	// The poll can be found from a link to its message
+	file, data := exportedFile(t, s, creator, stringOption("poll", pollMessageURL(poll)))
+	if file.Name != "poll-"+poll.ID+".csv" || file.ContentType != "text/csv" {
+		t.Errorf("file is %s (%s), want a CSV named after the poll", file.Name, file.ContentType)
+	}
+
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("export isn't valid CSV: %v\n%s", err, data)
+	}
+
+	rows := map[string][]string{}
+	voters := 0
+	for _, record := range records {
+		rows[record[0]] = record
+		if len(record) == 4 && record[0] != "Voter ID" {
+			voters++
+		}
+	}
+	if got := rows["Question"]; len(got) != 2 || got[1] != poll.Question {
+		t.Errorf("question row = %v", got)
+	}
+	if got := rows["Pizza"]; len(got) != 3 || got[1] != "2" || got[2] != "66.67%" {
+		t.Errorf("Pizza row = %v, want 2 votes", got)
+	}
+	if got := rows["4"]; len(got) != 4 || got[1] != "Salad" || got[3] == "" {
+		t.Errorf("row of voter 4 = %v, want their vote for Salad with its time", got)
+	}
+	if voters != 3 {
+		t.Errorf("export has %d votes, want 3:\n%s", voters, data)
+	}
+}
+
+func TestExportPollJSON(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0),
+		stringOption("question", "Secret?"),
+		stringOption("options", "Yes;No"),
+		boolOption("anonymous", true),
+	)
+	vote(t, s, testMember("2", 0), poll, 0)
+
+	// Server managers can export anyone's poll, by its ID
+	admin := testMember("9", discordgo.PermissionManageServer)
+	_, data := exportedFile(t, s, admin, stringOption("poll", poll.ID), stringOption("format", "json"))
+
+	var export pollResultsExport
+	if err := json.Unmarshal([]byte(data), &export); err != nil {
+		t.Fatalf("export isn't valid JSON: %v\n%s", err, data)
+	}
+	if export.Question != "Secret?" || len(export.Options) != 2 || export.Options[0].Votes != 1 || export.Voters != 1 {
+		t.Errorf("export = %+v, want the question and 1 vote for Yes", export)
+	}
+
+	// Anonymous polls don't say who voted
+	if export.Votes != nil || strings.Contains(data, "voters\":{") {
+		t.Errorf("export of an anonymous poll includes voters:\n%s", data)
+	}
+}
+
+func TestExportPollDenied(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	hidden := createTestPoll(t, s, testMember("2", 0),
+		stringOption("question", "Hidden?"),
+		stringOption("options", "Yes;No"),
+		boolOption("hide_results", true),
+	)
+
+	tests := []struct {
+		name   string
+		member *discordgo.Member
+		poll   string
+		want   string
+	}{
+		{"someone else's poll", testMember("5", 0), poll.ID, "Only the person who created a poll"},
+		{"results hidden", testMember("2", 0), hidden.ID, "hidden until it ends"},
+		{"unknown poll", testMember("1", 0), "123456789", "Couldn't find that poll"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := commandInteraction(test.member, "poll", subcommand("export", stringOption("poll", test.poll)))
+			if err := interact(s, i); err == nil {
+				t.Fatal("export succeeded")
+			}
+			if reply := s.reply(i); !strings.Contains(reply, test.want) {
+				t.Errorf("reply = %q, want it to contain %q", reply, test.want)
+			}
+		})
+	}
+}
+
+func TestExportPollSkipsInvalidVotes(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	votes := []dbVote{
+		{User: "2", Option: 0, VotedAt: poll.CreatedTime},
+		{User: "3", Option: len(poll.Options), VotedAt: poll.CreatedTime},
+	}
+
+	var csvOut, jsonOut strings.Builder
+	if err := writePollCSV(&csvOut, poll, votes); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePollJSON(&jsonOut, poll, votes); err != nil {
+		t.Fatal(err)
+	}
+
+	var export pollResultsExport
+	if err := json.Unmarshal([]byte(jsonOut.String()), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Votes) != 1 || export.Votes[0].User != "2" {
+		t.Errorf("JSON votes = %+v, want only the vote for an option the poll has", export.Votes)
+	}
+	if strings.Contains(csvOut.String(), "\n3,") {
+		t.Errorf("CSV includes the vote for an option the poll doesn't have:\n%s", csvOut.String())
+	}
+}
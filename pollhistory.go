@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// HistoryPageSize is the number of polls shown on each page of the poll history.
+const HistoryPageSize = 10
+
+// historyPollCmd is the handler for the history subcommand of the poll command
+func historyPollCmd(c *CommandContext) error {
+	embed, components, err := generateHistoryPage(c.Interaction.GuildID, c.Options.Int("page", 1))
+	if err != nil {
+		return fmt.Errorf("error getting poll history: %w", err)
+	}
+
+	return c.Respond(&discordgo.InteractionResponseData{
+		Embeds:     []*discordgo.MessageEmbed{&embed},
+		Components: components,
+	})
+}
+
+// historyPayload is the payload of the components on a page of the poll history.
+type historyPayload struct {
+	// View is set for the select menu that shows the results of a poll, otherwise the component is a button that shows Page.
+	View bool
+	Page int
+}
+
+// historyRoute routes the components on pages of the poll history. Custom IDs are history|page|<page> or history|view.
+var historyRoute = &ComponentRoute[historyPayload]{
+	Prefix:  "history",
+	Version: 1,
+	Encode: func(payload historyPayload) []string {
+		if payload.View {
+			return []string{"view"}
+		}
+		return []string{"page", strconv.Itoa(payload.Page)}
+	},
+	Decode: func(version int, fields []string) (historyPayload, error) {
+		if len(fields) == 1 && fields[0] == "view" {
+			return historyPayload{View: true}, nil
+		}
+		if len(fields) != 2 || fields[0] != "page" {
+			return historyPayload{}, errInvalidPayload
+		}
+
+		page, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return historyPayload{}, fmt.Errorf("invalid page: %w", err)
+		}
+		return historyPayload{Page: page}, nil
+	},
+}
+
+func init() {
+	historyRoute.Handle(handleHistoryComponent)
+}
+
+// handleHistoryComponent handles the page buttons and poll select menu of the poll history.
+func handleHistoryComponent(c *ComponentContext, payload historyPayload) error {
+	if !payload.View {
+		embed, components, err := generateHistoryPage(c.Interaction.GuildID, payload.Page)
+		if err != nil {
+			return fmt.Errorf("error getting poll history: %w", err)
+		}
+
+		return c.UpdateMessage(&discordgo.InteractionResponseData{
+			Embeds:     []*discordgo.MessageEmbed{&embed},
+			Components: components,
+		})
+	}
+
+	values := c.Values()
+	if len(values) != 1 {
+		return nil
+	}
+
+	poll, err := databasePollGet(values[0])
+	if errors.Is(err, errPollNotFound) {
+		return commandErrorf("That poll could not be found.")
+	} else if err != nil {
+		return fmt.Errorf("error getting poll: %w", err)
+	}
+
+	// Polls from other guilds and polls that are still running aren't in the history
+	if poll.Guild != c.Interaction.GuildID || poll.Status != PollStatusEnded {
+		return commandErrorf("That poll could not be found.")
+	}
+
+	return c.Respond(&discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{ptr(generatePollResultsEmbed(poll, false))},
+		Flags:  discordgo.MessageFlagsEphemeral,
+	})
+}
+
+// generateHistoryPage creates the embed and components for a page of the poll history of a guild.
+func generateHistoryPage(guildId string, page int) (discordgo.MessageEmbed, []discordgo.MessageComponent, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	polls, total, err := databasePollHistory(guildId, (page-1)*HistoryPageSize, HistoryPageSize)
+	if err != nil {
+		return discordgo.MessageEmbed{}, nil, err
+	}
+
+	pages := (total + HistoryPageSize - 1) / HistoryPageSize
+	if pages == 0 {
+		pages = 1
+	}
+
+	embed := discordgo.MessageEmbed{
+		Title:  "Poll history",
+		Color:  DiscordBlurple,
+		Footer: &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("Page %d of %d (%d poll%s)", page, pages, total, plural(total))},
+	}
+
+	if len(polls) == 0 {
+		embed.Description = "There are no ended polls to show."
+		return embed, []discordgo.MessageComponent{}, nil
+	}
+
+	lines := make([]string, 0, len(polls))
+	choices := make([]discordgo.SelectMenuOption, 0, len(polls))
+	for n, poll := range polls {
+		lines = append(lines, fmt.Sprintf("%d. **%s** - ended %s", (page-1)*HistoryPageSize+n+1, truncate(poll.Question, 200), Timestamp(poll.EndedAt, TimestampShortDate)))
+
+		choices = append(choices, discordgo.SelectMenuOption{
+			Label:       truncate(poll.Question, 100),
+			Value:       poll.ID,
+			Description: "Ended " + poll.EndedAt.Format("2 Jan 2006"),
+		})
+	}
+	embed.Description = strings.Join(lines, "\n")
+
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:    historyRoute.CustomID(historyPayload{View: true}),
+					Placeholder: "View the results of a poll",
+					Options:     choices,
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Previous",
+					CustomID: historyRoute.CustomID(historyPayload{Page: page - 1}),
+					Style:    discordgo.SecondaryButton,
+					Disabled: page <= 1,
+				},
+				discordgo.Button{
+					Label:    "Next",
+					CustomID: historyRoute.CustomID(historyPayload{Page: page + 1}),
+					Style:    discordgo.SecondaryButton,
+					Disabled: page >= pages,
+				},
+			},
+		},
+	}
+
+	return embed, components, nil
+}
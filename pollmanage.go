@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// PollListPageSize is the number of polls shown on each page of the list of active polls.
+const PollListPageSize = 10
+
+// PollManageAction is something the creator of a poll or a moderator can do to it.
+type PollManageAction string
+
+const (
+	// PollManageEnd ends a poll early, with its results posted as usual.
+	PollManageEnd PollManageAction = "end"
+	// PollManageCancel discards a poll and its votes without results, leaving its message to say it was cancelled.
+	PollManageCancel PollManageAction = "cancel"
+	// PollManageDelete discards a poll and its votes and deletes its message.
+	PollManageDelete PollManageAction = "delete"
+)
+
+// isPollModerator checks if a member can manage every poll in a guild. Members with the Manage Messages permission
+// and the guild's moderator role are moderators.
+func isPollModerator(member *discordgo.Member, settings GuildSettings) bool {
+	if member.Permissions&(discordgo.PermissionManageMessages|discordgo.PermissionAdministrator) != 0 {
+		return true
+	}
+	return settings.ModeratorRole != "" && containsAny(member.Roles, []string{settings.ModeratorRole})
+}
+
+// checkManagePoll checks that a member may end, cancel or delete a poll, which its creator and moderators can do.
+func checkManagePoll(member *discordgo.Member, poll dbPoll) error {
+	if member.User.ID == poll.Creator {
+		return nil
+	}
+
+	settings, err := databaseGuildSettings(poll.Guild)
+	if err != nil {
+		return fmt.Errorf("error getting guild settings: %w", err)
+	}
+	if !isPollModerator(member, settings) {
+		return commandErrorf("Only the person who created a poll and moderators can manage it.")
+	}
+	return nil
+}
+
+// managePoll ends, cancels or deletes a poll for a user who is allowed to, see checkManagePoll, and logs it in the guild's log channel.
+// It returns the message to reply to the user with.
+func managePoll(s Session, poll dbPoll, action PollManageAction, user *discordgo.User) (string, error) {
+	if poll.Status != PollStatusActive && action != PollManageDelete {
+		return "", commandErrorf("This poll has already ended, it can only be deleted.")
+	}
+
+	var verb, reply string
+	switch action {
+	case PollManageEnd:
+		// Ending the poll is left to the scheduler, which sends the results as if it had ended on time
+		if err := scheduler.Schedule(JobEndPoll, poll.ID, time.Now()); err != nil {
+			return "", fmt.Errorf("error scheduling poll end: %w", err)
+		}
+		verb, reply = "ended", "Poll ended."
+
+	case PollManageCancel:
+		if err := databasePollDelete(poll.ID); err != nil {
+			return "", fmt.Errorf("error deleting poll: %w", err)
+		}
+		verb, reply = "cancelled", "Poll cancelled, its votes were discarded."
+
+		_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:      poll.Message,
+			Channel: poll.Channel,
+			Embeds: []*discordgo.MessageEmbed{{
+				Title:       poll.Question,
+				Description: "This poll was cancelled.",
+				Color:       DiscordRed,
+				Timestamp:   poll.CreatedTime.Format(time.RFC3339),
+			}},
+			Components: []discordgo.MessageComponent{},
+		})
+		if err != nil && !isDiscordNotFound(err) {
+			logger.Warn("Failed to edit cancelled poll message", "poll", poll.ID, "guild", poll.Guild, "channel", poll.Channel, "error", err)
+			reply = "Poll cancelled, its votes were discarded, but I couldn't update its message."
+		}
+
+	case PollManageDelete:
+		if err := databasePollDelete(poll.ID); err != nil {
+			return "", fmt.Errorf("error deleting poll: %w", err)
+		}
+		verb, reply = "deleted", "Poll deleted."
+
+		err := s.ChannelMessageDelete(poll.Channel, poll.Message)
+		if err != nil && !isDiscordNotFound(err) {
+			logger.Warn("Failed to delete poll message", "poll", poll.ID, "guild", poll.Guild, "channel", poll.Channel, "error", err)
+			reply = "Poll deleted, but I couldn't delete its message. It no longer takes votes, and can be deleted by hand."
+		}
+
+	default:
+		return "", fmt.Errorf("unknown poll action %q", action)
+	}
+
+	guildLog(s, poll.Guild, fmt.Sprintf("<@%s> %s the poll by <@%s> in <#%s>: %s", user.ID, verb, poll.Creator, poll.Channel, truncate(poll.Question, 200)))
+	return reply, nil
+}
+
+// managePollCmd finds the poll given by the poll option of a command and manages it, see managePoll.
+func managePollCmd(c *CommandContext, action PollManageAction) error {
+	poll, err := findGuildPoll(c.Interaction.GuildID, c.Options.String("poll", ""))
+	if err != nil {
+		return err
+	}
+	if err := checkManagePoll(c.Interaction.Member, poll); err != nil {
+		return err
+	}
+
+	reply, err := managePoll(c.Session, poll, action, c.User())
+	if err != nil {
+		return err
+	}
+	return c.Reply(reply)
+}
+
+// cancelPollCmd is the handler for the cancel subcommand of the poll command
+func cancelPollCmd(c *CommandContext) error {
+	return managePollCmd(c, PollManageCancel)
+}
+
+// deletePollCmd is the handler for the delete subcommand of the poll command
+func deletePollCmd(c *CommandContext) error {
+	return managePollCmd(c, PollManageDelete)
+}
+
+// managePollMessageCmd is the handler for the Manage poll message command, which offers buttons to manage the poll posted as the message.
+func managePollMessageCmd(c *CommandContext) error {
+	poll, err := databasePollGetMessage(c.Interaction.ApplicationCommandData().TargetID)
+	if errors.Is(err, errPollNotFound) || (err == nil && poll.Guild != c.Interaction.GuildID) {
+		return commandErrorf("That message isn't a poll, or the poll has been deleted.")
+	} else if err != nil {
+		return fmt.Errorf("error getting poll: %w", err)
+	}
+	if err := checkManagePoll(c.Interaction.Member, poll); err != nil {
+		return err
+	}
+
+	status := "ends " + Timestamp(poll.EndTime, TimestampRelative)
+	buttons := []discordgo.MessageComponent{}
+	if poll.Status == PollStatusActive {
+		buttons = append(buttons,
+			discordgo.Button{
+				Label:    "End now",
+				CustomID: pollManageRoute.CustomID(pollManagePayload{Poll: poll.ID, Action: PollManageEnd}),
+				Style:    discordgo.PrimaryButton,
+			},
+			discordgo.Button{
+				Label:    "Cancel",
+				CustomID: pollManageRoute.CustomID(pollManagePayload{Poll: poll.ID, Action: PollManageCancel}),
+				Style:    discordgo.SecondaryButton,
+			},
+		)
+	} else {
+		status = "ended " + Timestamp(poll.EndedAt, TimestampRelative)
+	}
+	buttons = append(buttons, discordgo.Button{
+		Label:    "Delete",
+		CustomID: pollManageRoute.CustomID(pollManagePayload{Poll: poll.ID, Action: PollManageDelete}),
+		Style:    discordgo.DangerButton,
+	})
+
+	return c.Respond(&discordgo.InteractionResponseData{
+		Content: fmt.Sprintf("**%s** by <@%s> %s.\n"+
+			"Ending it now posts the results as usual. Cancelling it discards the votes and leaves the message saying it was cancelled. "+
+			"Deleting it discards the votes and deletes the message.", poll.Question, poll.Creator, status),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: buttons},
+		},
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+		Flags:           discordgo.MessageFlagsEphemeral,
+	})
+}
+
+// pollManagePayload is the payload of the buttons offered by the Manage poll message command.
+type pollManagePayload struct {
+	Poll   string
+	Action PollManageAction
+}
+
+// pollManageRoute routes the buttons offered by the Manage poll message command. Custom IDs are pollmanage|<poll ID>|<action>.
+var pollManageRoute = &ComponentRoute[pollManagePayload]{
+	Prefix:  "pollmanage",
+	Version: 1,
+	Encode: func(payload pollManagePayload) []string {
+		return []string{payload.Poll, string(payload.Action)}
+	},
+	Decode: func(version int, fields []string) (pollManagePayload, error) {
+		if len(fields) != 2 {
+			return pollManagePayload{}, errInvalidPayload
+		}
+
+		action := PollManageAction(fields[1])
+		if action != PollManageEnd && action != PollManageCancel && action != PollManageDelete {
+			return pollManagePayload{}, fmt.Errorf("unknown poll action %q", fields[1])
+		}
+		return pollManagePayload{Poll: fields[0], Action: action}, nil
+	},
+}
+
+func init() {
+	pollManageRoute.Handle(handlePollManageComponent)
+}
+
+// handlePollManageComponent handles the buttons offered by the Manage poll message command.
+// Whether the user may manage the poll is checked again, as it may have changed since the buttons were shown.
+func handlePollManageComponent(c *ComponentContext, payload pollManagePayload) error {
+	poll, err := databasePollGet(payload.Poll)
+	if errors.Is(err, errPollNotFound) || (err == nil && poll.Guild != c.Interaction.GuildID) {
+		return commandErrorf("This poll has already been deleted.")
+	} else if err != nil {
+		return fmt.Errorf("error getting poll: %w", err)
+	}
+	if err := checkManagePoll(c.Interaction.Member, poll); err != nil {
+		return err
+	}
+
+	reply, err := managePoll(c.Session, poll, payload.Action, c.User())
+	if err != nil {
+		return err
+	}
+	return c.UpdateMessage(&discordgo.InteractionResponseData{
+		Content:    reply,
+		Components: []discordgo.MessageComponent{},
+	})
+}
+
+// listPollCmd is the handler for the list subcommand of the poll command
+func listPollCmd(c *CommandContext) error {
+	embed, components, err := generatePollListPage(c.Interaction.GuildID, c.Options.Int("page", 1))
+	if err != nil {
+		return fmt.Errorf("error getting active polls: %w", err)
+	}
+
+	return c.Respond(&discordgo.InteractionResponseData{
+		Embeds:     []*discordgo.MessageEmbed{&embed},
+		Components: components,
+	})
+}
+
+// pollListRoute routes the page buttons of the list of active polls. Custom IDs are polllist|<page>.
+var pollListRoute = &ComponentRoute[int]{
+	Prefix:  "polllist",
+	Version: 1,
+	Encode: func(page int) []string {
+		return []string{strconv.Itoa(page)}
+	},
+	Decode: func(version int, fields []string) (int, error) {
+		if len(fields) != 1 {
+			return 0, errInvalidPayload
+		}
+
+		page, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return 0, fmt.Errorf("invalid page: %w", err)
+		}
+		return page, nil
+	},
+}
+
+func init() {
+	pollListRoute.Handle(handlePollListComponent)
+}
+
+// handlePollListComponent handles the page buttons of the list of active polls.
+func handlePollListComponent(c *ComponentContext, page int) error {
+	embed, components, err := generatePollListPage(c.Interaction.GuildID, page)
+	if err != nil {
+		return fmt.Errorf("error getting active polls: %w", err)
+	}
+
+	return c.UpdateMessage(&discordgo.InteractionResponseData{
+		Embeds:     []*discordgo.MessageEmbed{&embed},
+		Components: components,
+	})
+}
+
+// generatePollListPage creates the embed and components for a page of the active polls in a guild.
+// Each poll is listed with its ID, which the commands that manage polls take.
+func generatePollListPage(guildId string, page int) (discordgo.MessageEmbed, []discordgo.MessageComponent, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	polls, total, err := databasePollGuildActive(guildId, (page-1)*PollListPageSize, PollListPageSize)
+	if err != nil {
+		return discordgo.MessageEmbed{}, nil, err
+	}
+
+	pages := (total + PollListPageSize - 1) / PollListPageSize
+	if pages == 0 {
+		pages = 1
+	}
+
+	embed := discordgo.MessageEmbed{
+		Title:  "Active polls",
+		Color:  DiscordBlurple,
+		Footer: &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("Page %d of %d (%d poll%s)", page, pages, total, plural(total))},
+	}
+
+	if len(polls) == 0 {
+		embed.Description = "There are no polls running in this server."
+		return embed, []discordgo.MessageComponent{}, nil
+	}
+
+	lines := make([]string, 0, len(polls))
+	for n, poll := range polls {
+		lines = append(lines, fmt.Sprintf("%d. [%s](%s) by <@%s> - ends %s\n`%s`", (page-1)*PollListPageSize+n+1,
+			truncate(poll.Question, 200), pollMessageURL(poll), poll.Creator, Timestamp(poll.EndTime, TimestampRelative), poll.ID))
+	}
+	embed.Description = strings.Join(lines, "\n")
+
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Previous",
+					CustomID: pollListRoute.CustomID(page - 1),
+					Style:    discordgo.SecondaryButton,
+					Disabled: page <= 1,
+				},
+				discordgo.Button{
+					Label:    "Next",
+					CustomID: pollListRoute.CustomID(page + 1),
+					Style:    discordgo.SecondaryButton,
+					Disabled: page >= pages,
+				},
+			},
+		},
+	}
+
+	return embed, components, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestPollList(t *testing.T) {
+	s := setupTest(t)
+	member := testMember("1", 0)
+
+	i := commandInteraction(member, "poll", subcommand("list"))
+	mustInteract(t, s, i)
+	if got := (*s.interactions[i.ID].Edits[0].Embeds)[0].Description; !strings.Contains(got, "no polls running") {
+		t.Errorf("list of no polls = %q", got)
+	}
+
+	later := createTestPoll(t, s, testMember("2", 0), stringOption("question", "Later?"), stringOption("options", "Yes;No"), stringOption("duration", "2h"))
+	sooner := createTestPoll(t, s, testMember("3", 0), stringOption("question", "Sooner?"), stringOption("options", "Yes;No"), stringOption("duration", "1h"))
+	ended := createTestPoll(t, s, testMember("4", 0))
+	if err := endPoll(s, ended.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	i = commandInteraction(member, "poll", subcommand("list"))
+	mustInteract(t, s, i)
+	description := (*s.interactions[i.ID].Edits[0].Embeds)[0].Description
+
+	// Polls are listed with their IDs, ending soonest first
+	first, second := strings.Index(description, sooner.ID), strings.Index(description, later.ID)
+	if first < 0 || second < first {
+		t.Errorf("list = %q, want %s and then %s", description, sooner.ID, later.ID)
+	}
+	if strings.Contains(description, ended.ID) {
+		t.Errorf("list = %q, want the ended poll left out", description)
+	}
+}
+
+func TestManagePollDenied(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+
+	for _, action := range []string{"end", "cancel", "delete"} {
+		i := commandInteraction(testMember("5", 0), "poll", subcommand(action, stringOption("poll", poll.ID)))
+		if err := interact(s, i); err == nil {
+			t.Errorf("%s of someone else's poll succeeded", action)
+		}
+		if reply := s.reply(i); !strings.Contains(reply, "Only the person who created a poll and moderators") {
+			t.Errorf("reply to %s = %q, want the user to be told they can't", action, reply)
+		}
+	}
+
+	if got, _ := databasePollGet(poll.ID); got.Status != PollStatusActive {
+		t.Errorf("poll is %s, want it to still be running", got.Status)
+	}
+}
+
+func TestModeratorEndPoll(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+
+	i := commandInteraction(testMember("9", discordgo.PermissionManageMessages), "poll", subcommand("end", stringOption("poll", pollMessageURL(poll))))
+	mustInteract(t, s, i)
+	if reply := s.reply(i); reply != "Poll ended." {
+		t.Errorf("reply = %q, want the poll to be ended", reply)
+	}
+
+	// The poll ends as usual, with its creator getting the results
+	scheduler.runDue()
+	if got, _ := databasePollGet(poll.ID); got.Status != PollStatusEnded {
+		t.Errorf("poll is %s, want it to have ended", got.Status)
+	}
+	if dms := s.channelMessages("dm-1"); len(dms) != 1 {
+		t.Errorf("creator got %d DMs, want the results", len(dms))
+	}
+
+	// Ended polls can't be ended again or cancelled
+	for _, action := range []string{"end", "cancel"} {
+		i := commandInteraction(testMember("9", discordgo.PermissionManageMessages), "poll", subcommand(action, stringOption("poll", poll.ID)))
+		if err := interact(s, i); err == nil {
+			t.Errorf("%s of an ended poll succeeded", action)
+		}
+	}
+}
+
+func TestCancelPoll(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	vote(t, s, testMember("2", 0), poll, 0)
+
+	// Members with the moderator role are moderators
+	admin := testMember("9", discordgo.PermissionManageServer)
+	mustInteract(t, s, commandInteraction(admin, "config", subcommand("set", stringOption("setting", "moderator_role"), stringOption("value", "<@&77>"))))
+
+	i := commandInteraction(testMember("8", 0, "77"), "poll", subcommand("cancel", stringOption("poll", poll.ID)))
+	mustInteract(t, s, i)
+	if reply := s.reply(i); !strings.HasPrefix(reply, "Poll cancelled") {
+		t.Errorf("reply = %q, want the poll to be cancelled", reply)
+	}
+
+	if _, err := databasePollGet(poll.ID); err == nil {
+		t.Error("poll still exists after being cancelled")
+	}
+	if votes, _ := databasePollVotes(poll.ID); len(votes) != 0 {
+		t.Errorf("%d votes are left after the poll was cancelled", len(votes))
+	}
+
+	// The message says it was cancelled, without results
+	message, _ := s.message(poll.Message)
+	if len(message.Components) != 0 || len(message.Embeds) != 1 || len(message.Embeds[0].Fields) != 0 || !strings.Contains(message.Embeds[0].Description, "cancelled") {
+		t.Errorf("poll message = %+v, want it to say the poll was cancelled", message.Embeds[0])
+	}
+
+	// Nobody gets results
+	scheduler.runDue()
+	if dms := s.channelMessages("dm-1"); len(dms) != 0 {
+		t.Errorf("creator got %d DMs, want none for a cancelled poll", len(dms))
+	}
+	if _, ok, _ := store.NextJob(); ok {
+		t.Error("jobs are left over after the poll was cancelled")
+	}
+}
+
+func TestDeletePoll(t *testing.T) {
+	s := setupTest(t)
+	creator := testMember("1", 0)
+	poll := createTestPoll(t, s, creator)
+	if err := endPoll(s, poll.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Creators can delete their own polls, even once they have ended
+	i := commandInteraction(creator, "poll", subcommand("delete", stringOption("poll", poll.ID)))
+	mustInteract(t, s, i)
+	if reply := s.reply(i); reply != "Poll deleted." {
+		t.Errorf("reply = %q, want the poll to be deleted", reply)
+	}
+	if _, err := databasePollGet(poll.ID); err == nil {
+		t.Error("poll still exists after being deleted")
+	}
+	if _, ok := s.message(poll.Message); ok {
+		t.Error("poll message still exists after the poll was deleted")
+	}
+}
+
+func TestManagePollMessageCommand(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+	moderator := testMember("9", discordgo.PermissionManageMessages)
+
+	i := messageCommandInteraction(moderator, "Manage poll", poll.Message)
+	mustInteract(t, s, i)
+
+	edits := s.interactions[i.ID].Edits
+	if len(edits) != 1 || edits[0].Components == nil {
+		t.Fatalf("reply = %q, want buttons to manage the poll", s.reply(i))
+	}
+	buttons := map[string]string{}
+	for _, component := range (*edits[0].Components)[0].(discordgo.ActionsRow).Components {
+		button := component.(discordgo.Button)
+		buttons[button.Label] = button.CustomID
+	}
+	if len(buttons) != 3 {
+		t.Fatalf("got buttons %v, want end, cancel and delete", buttons)
+	}
+
+	// Someone who isn't a moderator can't use the buttons
+	if err := interact(s, componentInteraction(testMember("5", 0), buttons["Delete"])); err == nil {
+		t.Error("deleting with someone else's button succeeded")
+	}
+
+	click := componentInteraction(moderator, buttons["Delete"])
+	mustInteract(t, s, click)
+	if reply := s.reply(click); reply != "Poll deleted." {
+		t.Errorf("reply = %q, want the poll to be deleted", reply)
+	}
+	if _, err := databasePollGet(poll.ID); err == nil {
+		t.Error("poll still exists after being deleted")
+	}
+
+	// Messages that aren't polls are turned down
+	other, _ := s.ChannelMessageSend(testChannel, "Not a poll")
+	i = messageCommandInteraction(moderator, "Manage poll", other.ID)
+	if err := interact(s, i); err == nil {
+		t.Error("managing a message that isn't a poll succeeded")
+	}
+	if reply := s.reply(i); !strings.Contains(reply, "isn't a poll") {
+		t.Errorf("reply = %q, want the user to be told the message isn't a poll", reply)
+	}
+}
+
+func TestManagePollMessageCommandPermissions(t *testing.T) {
+	s := setupTest(t)
+	poll := createTestPoll(t, s, testMember("1", 0))
+
+	// The server limits the context menu command to a role
+	admin := testMember("9", discordgo.PermissionAdministrator)
+	allow := commandInteraction(admin, "config", subcommand("permissions", subcommand("allow", stringOption("command", "manage poll"), roleOption("role", "77"))))
+	mustInteract(t, s, allow)
+	if reply := s.reply(allow); !strings.Contains(reply, "Manage poll") {
+		t.Errorf("reply = %q, want the permission to be set on Manage poll", reply)
+	}
+
+	i := messageCommandInteraction(testMember("8", discordgo.PermissionManageMessages), "Manage poll", poll.Message)
+	if err := interact(s, i); err == nil {
+		t.Error("a moderator without the role used Manage poll")
+	}
+	if reply := s.reply(i); !strings.Contains(reply, "<@&77>") {
+		t.Errorf("reply = %q, want the user to be told which role they need", reply)
+	}
+
+	mustInteract(t, s, messageCommandInteraction(testMember("8", discordgo.PermissionManageMessages, "77"), "Manage poll", poll.Message))
+}
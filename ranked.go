@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// runoffRound is a single round of an instant-runoff count.
+type runoffRound struct {
+	// Counts holds the number of ballots counting towards each option this round.
+	Counts []int
+	// Active holds the options that were still in the running at the start of the round.
+	Active []int
+	// Exhausted is the number of ballots with no remaining active options.
+	Exhausted int
+	// Eliminated holds the options eliminated at the end of this round.
+	Eliminated []int
+	// Winner is the winning option, or -1 if the round did not produce a winner.
+	Winner int
+}
+
+// instantRunoff tallies a ranked-choice poll, eliminating the option with the fewest votes each round
+// until one option holds a majority of the ballots still in play.
+func instantRunoff(poll dbPoll) []runoffRound {
+	active := make([]int, len(poll.Options))
+	for n := range active {
+		active[n] = n
+	}
+
+	rounds := []runoffRound{}
+	for len(active) > 0 {
+		round := runoffRound{
+			Counts: make([]int, len(poll.Options)),
+			Active: active,
+			Winner: -1,
+		}
+
+		isActive := make(map[int]bool, len(active))
+		for _, option := range active {
+			isActive[option] = true
+		}
+
+		// Count each ballot towards its highest ranked option that is still active
+		total := 0
+		for _, ranking := range poll.Rankings {
+			counted := false
+			for _, option := range ranking {
+				if isActive[option] {
+					round.Counts[option]++
+					counted = true
+					break
+				}
+			}
+
+			if counted {
+				total++
+			} else {
+				round.Exhausted++
+			}
+		}
+
+		if total == 0 {
+			rounds = append(rounds, round)
+			break
+		}
+
+		// Check for a majority
+		lowest := round.Counts[active[0]]
+		for _, option := range active {
+			if round.Counts[option]*2 > total {
+				round.Winner = option
+			}
+			if round.Counts[option] < lowest {
+				lowest = round.Counts[option]
+			}
+		}
+
+		if round.Winner != -1 {
+			rounds = append(rounds, round)
+			break
+		}
+
+		// Eliminate every option tied for last place
+		remaining := make([]int, 0, len(active))
+		for _, option := range active {
+			if round.Counts[option] == lowest {
+				round.Eliminated = append(round.Eliminated, option)
+			} else {
+				remaining = append(remaining, option)
+			}
+		}
+
+		// If every option is tied there is nothing left to eliminate
+		if len(remaining) == 0 {
+			round.Eliminated = nil
+			rounds = append(rounds, round)
+			break
+		}
+
+		rounds = append(rounds, round)
+		active = remaining
+	}
+
+	return rounds
+}
+
+// generateRunoffFields creates an embed field for each round of an instant-runoff count.
+// Polls with many options only list the vote counts for the final round to keep the embed within Discord's limits.
+func generateRunoffFields(poll dbPoll, rounds []runoffRound) []*discordgo.MessageEmbedField {
+	fields := make([]*discordgo.MessageEmbedField, 0, len(rounds))
+	for n, round := range rounds {
+		active := make([]int, len(round.Active))
+		copy(active, round.Active)
+		sort.SliceStable(active, func(i, j int) bool {
+			return round.Counts[active[i]] > round.Counts[active[j]]
+		})
+
+		total := 0
+		for _, option := range active {
+			total += round.Counts[option]
+		}
+
+		var outcome string
+		switch {
+		case total == 0:
+			outcome = "No votes were cast"
+		case round.Winner != -1:
+			outcome = fmt.Sprintf(":medal: **%s** wins", poll.Options[round.Winner])
+		case len(round.Eliminated) > 0:
+			outcome = fmt.Sprintf("Eliminated: %s (%d vote%s)", joinOptions(poll, round.Eliminated), round.Counts[round.Eliminated[0]], plural(round.Counts[round.Eliminated[0]]))
+		default:
+			outcome = fmt.Sprintf("Tie between %s", joinOptions(poll, active))
+		}
+
+		lines := []string{}
+		if len(poll.Options) <= MaxPollButtons || n == len(rounds)-1 {
+			for _, option := range active {
+				lines = append(lines, fmt.Sprintf("%s: %d vote%s", poll.Options[option], round.Counts[option], plural(round.Counts[option])))
+			}
+		}
+
+		if round.Exhausted > 0 {
+			lines = append(lines, fmt.Sprintf("Exhausted: %d ballot%s", round.Exhausted, plural(round.Exhausted)))
+		}
+
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("Round %d", n+1),
+			Value: joinLinesLimit(append([]string{outcome}, lines...), MaxEmbedFieldValue),
+		})
+	}
+
+	return fields
+}
+
+// joinLinesLimit joins lines with newlines, leaving off as many lines as needed to stay within limit characters.
+func joinLinesLimit(lines []string, limit int) string {
+	out := strings.Join(lines, "\n")
+	for n := len(lines) - 1; len(out) > limit && n > 0; n-- {
+		out = strings.Join(lines[:n], "\n") + fmt.Sprintf("\n...and %d more", len(lines)-n)
+	}
+	return out
+}
+
+// formatRanking formats a user's ranking as a numbered list.
+func formatRanking(poll dbPoll, ranking []int) string {
+	if len(ranking) == 0 {
+		return "You haven't ranked any options."
+	}
+
+	lines := make([]string, 0, len(ranking))
+	for n, option := range ranking {
+		lines = append(lines, fmt.Sprintf("%d. %s", n+1, poll.Options[option]))
+	}
+	return "Your ranking:\n" + strings.Join(lines, "\n")
+}
+
+func joinOptions(poll dbPoll, options []int) string {
+	names := make([]string, 0, len(options))
+	for _, option := range options {
+		names = append(names, poll.Options[option])
+	}
+	return strings.Join(names, ", ")
+}
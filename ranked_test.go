@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rankedTestPoll adds a ranked-choice poll with the given number of options to the store, with a ballot for each ranking.
+func rankedTestPoll(t *testing.T, options int, ballots [][]int) dbPoll {
+	t.Helper()
+
+	poll := dbPoll{
+		ID:          "ranked",
+		Guild:       testGuild,
+		Channel:     testChannel,
+		Question:    "Which one?",
+		Creator:     "1",
+		CreatedTime: time.Now(),
+		EndTime:     time.Now().Add(time.Hour),
+		Mode:        PollModeRanked,
+		MaxChoices:  options,
+	}
+	for n := 0; n < options; n++ {
+		poll.Options = append(poll.Options, string(rune('A'+n)))
+	}
+	if err := databasePollCreate(poll); err != nil {
+		t.Fatal(err)
+	}
+
+	for n, ranking := range ballots {
+		for _, option := range ranking {
+			if _, err := store.Rank(poll.ID, strconv.Itoa(n+1), option); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	poll, err := databasePollGet(poll.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return poll
+}
+
+func TestInstantRunoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		options int
+		ballots [][]int
+		// eliminated and exhausted are by round, winner is the winner of the last round
+		eliminated [][]int
+		exhausted  []int
+		winner     int
+	}{
+		{
+			name:       "first round majority",
+			options:    3,
+			ballots:    [][]int{{0, 1}, {0, 2}, {1, 0}},
+			eliminated: [][]int{nil},
+			exhausted:  []int{0},
+			winner:     0,
+		},
+		{
+			name:       "every option tied for last is eliminated",
+			options:    4,
+			ballots:    [][]int{{0}, {0}, {0}, {1}, {1}, {2, 1}, {3, 1}},
+			eliminated: [][]int{{2, 3}, nil},
+			exhausted:  []int{0, 0},
+			winner:     1,
+		},
+		{
+			// Once C is eliminated its ballot has nothing left, so A's 3 of the 5 ballots still in play is a majority
+			name:       "exhausted ballots",
+			options:    3,
+			ballots:    [][]int{{0}, {0}, {0}, {1}, {1}, {2}},
+			eliminated: [][]int{{2}, nil},
+			exhausted:  []int{0, 1},
+			winner:     0,
+		},
+		{
+			name:       "tie at the end",
+			options:    3,
+			ballots:    [][]int{{0}, {0}, {1}, {1}, {2}},
+			eliminated: [][]int{{2}, nil},
+			exhausted:  []int{0, 1},
+			winner:     -1,
+		},
+		{
+			name:       "no ballots",
+			options:    2,
+			ballots:    nil,
+			eliminated: [][]int{nil},
+			exhausted:  []int{0},
+			winner:     -1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			rounds := instantRunoff(rankedTestPoll(t, test.options, test.ballots))
+
+			eliminated, exhausted := [][]int{}, []int{}
+			for _, round := range rounds {
+				eliminated = append(eliminated, round.Eliminated)
+				exhausted = append(exhausted, round.Exhausted)
+			}
+			if !reflect.DeepEqual(eliminated, test.eliminated) {
+				t.Errorf("eliminated %v by round, want %v", eliminated, test.eliminated)
+			}
+			if !reflect.DeepEqual(exhausted, test.exhausted) {
+				t.Errorf("exhausted ballots %v by round, want %v", exhausted, test.exhausted)
+			}
+			if winner := rounds[len(rounds)-1].Winner; winner != test.winner {
+				t.Errorf("winner = %d, want %d", winner, test.winner)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Kinds of job run by the scheduler
+const (
+	JobEndPoll      = "end_poll"
+	JobPollResults  = "poll_results"
+	JobPollReminder = "poll_reminder"
+	JobPollAnnounce = "poll_announce"
+)
+
+const (
+	// JobLease is how long a job is claimed for while it runs. If the bot stops while running a job it is run again once the lease is up.
+	JobLease = 5 * time.Minute
+	// JobMaxAttempts is how many times a job is tried before giving up on it.
+	JobMaxAttempts = 8
+	// JobRetryDelay is how long to wait before retrying a failed job. It doubles with each attempt up to JobMaxRetryDelay.
+	JobRetryDelay    = 10 * time.Second
+	JobMaxRetryDelay = 30 * time.Minute
+	// schedulerPollInterval is the longest the worker sleeps before checking for due jobs again.
+	// Checking regularly instead of sleeping until the next job keeps the scheduler on time if the system clock jumps,
+	// and picks up jobs added by other instances sharing the database.
+	schedulerPollInterval = 30 * time.Second
+)
+
+// JobHandler runs a job. A job may run more than once, for example if the bot stops part way through it, so handlers must be safe to repeat.
+// Returning an error retries the job with backoff.
+type JobHandler func(job dbJob) error
+
+// Scheduler runs the jobs in a JobStore when they are due, one at a time on a single worker goroutine.
+type Scheduler struct {
+	store    JobStore
+	handlers map[string]JobHandler
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// scheduler is the scheduler used by the bot, started in main.
+var scheduler *Scheduler
+
+func newScheduler(store JobStore) *Scheduler {
+	return &Scheduler{
+		store:    store,
+		handlers: map[string]JobHandler{},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Handle sets the handler for a kind of job. It must be called before Start.
+func (s *Scheduler) Handle(kind string, handler JobHandler) {
+	s.handlers[kind] = handler
+}
+
+// Schedule schedules a job to run at a time, replacing the job of the same kind for the target if there is one.
+func (s *Scheduler) Schedule(kind, target string, runAt time.Time) error {
+	return s.add(dbJob{Kind: kind, Target: target, RunAt: runAt}, true)
+}
+
+// SchedulePayload is like Schedule, but also stores a payload for the job's handler.
+func (s *Scheduler) SchedulePayload(kind, target string, runAt time.Time, payload string) error {
+	return s.add(dbJob{Kind: kind, Target: target, RunAt: runAt, Payload: payload}, true)
+}
+
+// Ensure schedules a job to run at a time unless there is already a job of the same kind for the target.
+func (s *Scheduler) Ensure(kind, target string, runAt time.Time) error {
+	return s.add(dbJob{Kind: kind, Target: target, RunAt: runAt}, false)
+}
+
+// Cancel removes every job for a target.
+func (s *Scheduler) Cancel(target string) error {
+	return s.store.CancelJobs(target)
+}
+
+func (s *Scheduler) add(job dbJob, replace bool) error {
+	if err := s.store.ScheduleJob(job, replace); err != nil {
+		return err
+	}
+
+	// Wake the worker in case the job is due before the one it is waiting for
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start starts the worker.
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+// Stop stops the worker, waiting for the job it is running to finish. If the context ends first the job is left running,
+// and is run again once its lease is up, see JobLease.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("job still running: %w", ctx.Err())
+	}
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	for {
+		timer := time.NewTimer(s.runDue())
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runDue runs every job that is due and returns how long to wait before checking again.
+func (s *Scheduler) runDue() time.Duration {
+	for {
+		select {
+		case <-s.stop:
+			return 0
+		default:
+		}
+
+		job, ok, err := s.store.NextJob()
+		if err != nil {
+			logger.Error("Failed to get next job", "error", err)
+			return schedulerPollInterval
+		}
+		if !ok {
+			return schedulerPollInterval
+		}
+
+		if wait := time.Until(job.RunAt); wait > 0 {
+			if wait > schedulerPollInterval {
+				return schedulerPollInterval
+			}
+			return wait
+		}
+
+		if err := s.runJob(job); err != nil {
+			logger.Error("Failed to run job", "error", err)
+			return schedulerPollInterval
+		}
+	}
+}
+
+// runJob claims and runs a job, then removes it or schedules a retry.
+// It only returns an error if the job store fails, errors from the job itself are retried.
+func (s *Scheduler) runJob(job dbJob) error {
+	due := job.RunAt
+	job, ok, err := s.store.ClaimJob(job, time.Now().Add(JobLease))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The job was changed or claimed by another instance since it was fetched
+		return nil
+	}
+
+	schedulerLag.WithLabelValues(job.Kind).Observe(time.Since(due).Seconds())
+
+	handler, ok := s.handlers[job.Kind]
+	if ok {
+		err = callJobHandler(handler, job)
+	} else {
+		err = fmt.Errorf("no handler for job kind %q", job.Kind)
+	}
+
+	if err == nil {
+		jobsRun.WithLabelValues(job.Kind, "ok").Inc()
+		return s.store.CompleteJob(job)
+	}
+
+	if job.Attempts >= JobMaxAttempts {
+		jobsRun.WithLabelValues(job.Kind, "failed").Inc()
+		logger.Error("Giving up on job", "job", job.Kind, "target", job.Target, "attempts", job.Attempts, "error", err)
+		return s.store.CompleteJob(job)
+	}
+
+	jobsRun.WithLabelValues(job.Kind, "retry").Inc()
+	delay := jobRetryDelay(job.Attempts)
+	logger.Warn("Job failed, retrying", "job", job.Kind, "target", job.Target, "attempt", job.Attempts, "retry_in", delay, "error", err)
+	return s.store.RetryJob(job, time.Now().Add(delay), err.Error())
+}
+
+// callJobHandler runs a job handler, turning a panic into an error so that it is retried like any other failure.
+func callJobHandler(handler JobHandler, job dbJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return handler(job)
+}
+
+// jobRetryDelay gets how long to wait before retrying a job that has failed a number of times.
+func jobRetryDelay(attempts int) time.Duration {
+	delay := JobRetryDelay
+	for n := 1; n < attempts && delay < JobMaxRetryDelay; n++ {
+		delay *= 2
+	}
+	if delay > JobMaxRetryDelay {
+		delay = JobMaxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeSession is a Session that keeps everything the bot sends in memory instead of calling Discord,
+// and records the name of every call made to it.
+type fakeSession struct {
+	mu    sync.Mutex
+	calls []string
+
+	// messages holds every message sent, in the order they were sent, with any edits applied.
+	messages []*discordgo.Message
+	// interactions holds what was sent in response to each interaction, by interaction ID.
+	interactions map[string]*fakeInteraction
+	// commands holds the registered commands of each scope, see GlobalScope.
+	commands map[string][]*discordgo.ApplicationCommand
+	// channels are the channels Channel finds, by ID.
+	channels map[string]*discordgo.Channel
+	// errors makes a method return an error instead of doing anything, by method name.
+	errors map[string]error
+}
+
+// fakeInteraction is what was sent in response to an interaction.
+type fakeInteraction struct {
+	Responses []*discordgo.InteractionResponse
+	Edits     []*discordgo.WebhookEdit
+	Followups []*discordgo.WebhookParams
+	Deleted   bool
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{
+		interactions: map[string]*fakeInteraction{},
+		commands:     map[string][]*discordgo.ApplicationCommand{},
+		channels:     map[string]*discordgo.Channel{},
+		errors:       map[string]error{},
+	}
+}
+
+// call records a call and returns the error set up for the method, if any. The caller must hold the lock.
+func (s *fakeSession) call(method string) error {
+	s.calls = append(s.calls, method)
+	return s.errors[method]
+}
+
+func (s *fakeSession) interaction(id string) *fakeInteraction {
+	if s.interactions[id] == nil {
+		s.interactions[id] = &fakeInteraction{}
+	}
+	return s.interactions[id]
+}
+
+func (s *fakeSession) User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("User"); err != nil {
+		return nil, err
+	}
+	return &discordgo.User{ID: userID, Username: "user" + userID}, nil
+}
+
+func (s *fakeSession) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("UserChannelCreate"); err != nil {
+		return nil, err
+	}
+	return &discordgo.Channel{ID: "dm-" + recipientID, Type: discordgo.ChannelTypeDM}, nil
+}
+
+func (s *fakeSession) Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("Guild"); err != nil {
+		return nil, err
+	}
+	return &discordgo.Guild{ID: guildID, Name: "Test Server"}, nil
+}
+
+func (s *fakeSession) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("Channel"); err != nil {
+		return nil, err
+	}
+	if channel, ok := s.channels[channelID]; ok {
+		return channel, nil
+	}
+	return nil, discordError(http.StatusNotFound)
+}
+
+func (s *fakeSession) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return s.send("ChannelMessageSend", channelID, &discordgo.MessageSend{Content: content})
+}
+
+func (s *fakeSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return s.send("ChannelMessageSendComplex", channelID, data)
+}
+
+func (s *fakeSession) send(method, channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call(method); err != nil {
+		return nil, err
+	}
+
+	message := &discordgo.Message{
+		ID:               snowflake(time.Now()),
+		ChannelID:        channelID,
+		Content:          data.Content,
+		Embeds:           data.Embeds,
+		Components:       data.Components,
+		MessageReference: data.Reference,
+	}
+	if data.Embed != nil {
+		message.Embeds = append(message.Embeds, data.Embed)
+	}
+	message.Attachments = fakeAttachments(data.Files)
+	s.messages = append(s.messages, message)
+
+	copied := *message
+	return &copied, nil
+}
+
+func (s *fakeSession) ChannelMessageEditComplex(m *discordgo.MessageEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("ChannelMessageEditComplex"); err != nil {
+		return nil, err
+	}
+
+	for _, message := range s.messages {
+		if message.ID != m.ID || message.ChannelID != m.Channel {
+			continue
+		}
+
+		if m.Content != nil {
+			message.Content = *m.Content
+		}
+		if m.Embeds != nil {
+			message.Embeds = m.Embeds
+		}
+		if m.Components != nil {
+			message.Components = m.Components
+		}
+		if m.Attachments != nil {
+			message.Attachments = *m.Attachments
+		}
+		message.Attachments = append(message.Attachments, fakeAttachments(m.Files)...)
+
+		copied := *message
+		return &copied, nil
+	}
+	return nil, discordError(http.StatusNotFound)
+}
+
+func (s *fakeSession) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("ChannelMessageDelete"); err != nil {
+		return err
+	}
+
+	for n, message := range s.messages {
+		if message.ID == messageID && message.ChannelID == channelID {
+			s.messages = append(s.messages[:n], s.messages[n+1:]...)
+			return nil
+		}
+	}
+	return discordError(http.StatusNotFound)
+}
+
+// fakeAttachments turns files sent with a message into its attachments, which hold the files' data in their URL.
+func fakeAttachments(files []*discordgo.File) []*discordgo.MessageAttachment {
+	var attachments []*discordgo.MessageAttachment
+	for _, file := range files {
+		data, _ := io.ReadAll(file.Reader)
+		attachments = append(attachments, &discordgo.MessageAttachment{
+			ID:          snowflake(time.Now()),
+			Filename:    file.Name,
+			ContentType: file.ContentType,
+			URL:         string(data),
+			Size:        len(data),
+		})
+	}
+	return attachments
+}
+
+func (s *fakeSession) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("InteractionRespond"); err != nil {
+		return err
+	}
+
+	// Discord only accepts one response to each interaction
+	recorded := s.interaction(interaction.ID)
+	if len(recorded.Responses) > 0 {
+		return discordError(http.StatusBadRequest)
+	}
+	recorded.Responses = append(recorded.Responses, resp)
+	return nil
+}
+
+func (s *fakeSession) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("InteractionResponseEdit"); err != nil {
+		return nil, err
+	}
+
+	recorded := s.interaction(interaction.ID)
+	if len(recorded.Responses) == 0 {
+		return nil, discordError(http.StatusNotFound)
+	}
+	recorded.Edits = append(recorded.Edits, newresp)
+	return &discordgo.Message{ID: snowflake(time.Now()), ChannelID: interaction.ChannelID}, nil
+}
+
+func (s *fakeSession) InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("InteractionResponseDelete"); err != nil {
+		return err
+	}
+
+	s.interaction(interaction.ID).Deleted = true
+	return nil
+}
+
+func (s *fakeSession) FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("FollowupMessageCreate"); err != nil {
+		return nil, err
+	}
+
+	recorded := s.interaction(interaction.ID)
+	if len(recorded.Responses) == 0 {
+		return nil, discordError(http.StatusNotFound)
+	}
+	recorded.Followups = append(recorded.Followups, data)
+	return &discordgo.Message{ID: snowflake(time.Now()), ChannelID: interaction.ChannelID, Content: data.Content}, nil
+}
+
+func (s *fakeSession) ApplicationCommands(appID, guildID string, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("ApplicationCommands"); err != nil {
+		return nil, err
+	}
+	return s.commands[guildID], nil
+}
+
+func (s *fakeSession) ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("ApplicationCommandBulkOverwrite"); err != nil {
+		return nil, err
+	}
+	s.commands[guildID] = commands
+	return commands, nil
+}
+
+// countCalls counts the calls made to a method.
+func (s *fakeSession) countCalls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, call := range s.calls {
+		if call == method {
+			n++
+		}
+	}
+	return n
+}
+
+// channelMessages gets copies of the messages sent in a channel, oldest first.
+func (s *fakeSession) channelMessages(channelID string) []discordgo.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := []discordgo.Message{}
+	for _, message := range s.messages {
+		if message.ChannelID == channelID {
+			messages = append(messages, *message)
+		}
+	}
+	return messages
+}
+
+// message gets a copy of a message by ID.
+func (s *fakeSession) message(id string) (discordgo.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, message := range s.messages {
+		if message.ID == id {
+			return *message, true
+		}
+	}
+	return discordgo.Message{}, false
+}
+
+// reply gets the content the user sees in response to an interaction: the last edit or followup, or the response itself.
+func (s *fakeSession) reply(i *discordgo.InteractionCreate) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorded := s.interaction(i.ID)
+	switch {
+	case len(recorded.Followups) > 0:
+		return recorded.Followups[len(recorded.Followups)-1].Content
+	case len(recorded.Edits) > 0:
+		edit := recorded.Edits[len(recorded.Edits)-1]
+		if edit.Content != nil {
+			return *edit.Content
+		}
+	case len(recorded.Responses) > 0 && recorded.Responses[0].Data != nil:
+		return recorded.Responses[0].Data.Content
+	}
+	return ""
+}
+
+// discordError creates an error like the ones discordgo returns for a failed request.
+func discordError(status int) error {
+	return &discordgo.RESTError{
+		Response: &http.Response{StatusCode: status, Status: http.StatusText(status)},
+		Message:  &discordgo.APIErrorMessage{Message: http.StatusText(status)},
+	}
+}
+
+var snowflakeSequence atomic.Int64
+
+// snowflake creates a unique snowflake ID for a time, which is how Discord timestamps IDs.
+func snowflake(t time.Time) string {
+	sequence := snowflakeSequence.Add(1) & 0xFFF
+	return strconv.FormatInt((t.UnixMilli()-1420070400000)<<22|sequence, 10)
+}
+
+const (
+	testGuild   = "100"
+	testChannel = "200"
+	testApp     = "300"
+)
+
+// testDriver is the database driver of the store setupTest opens. The tests run once with each driver, see TestMain.
+var testDriver string
+
+// TestMain runs the tests against SQLite, the default store, and then against the in-memory store,
+// so that the two can't drift apart unnoticed.
+func TestMain(m *testing.M) {
+	code := 0
+	for _, driver := range []string{"sqlite", "memory"} {
+		testDriver = driver
+		if result := m.Run(); result != 0 {
+			code = result
+		}
+	}
+	os.Exit(code)
+}
+
+// setupTest replaces the store and scheduler with fresh ones, see testDriver, and returns a fake session with the commands registered.
+// The scheduler isn't started, tests run due jobs with runDue.
+func setupTest(t *testing.T) *fakeSession {
+	t.Helper()
+
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	opened, err := openStore(testDriver, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("failed with the %s store", testDriver)
+		}
+		opened.Close()
+	})
+	store = opened
+	lifecycle = &Lifecycle{}
+
+	s := newFakeSession()
+	s.channels[testChannel] = &discordgo.Channel{ID: testChannel, GuildID: testGuild, Type: discordgo.ChannelTypeGuildText}
+	setupScheduler(s)
+	if err := registerCommands(s, testApp, nil); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// interact runs an interaction through the middleware and routers, like an interaction from the gateway.
+func interact(s Session, i *discordgo.InteractionCreate) error {
+	handler := chainInteractionMiddleware(dispatchInteraction, interactionMiddleware...)
+	return handler(context.Background(), s, i)
+}
+
+// testMember creates a member of the test guild with the given permissions.
+func testMember(userID string, permissions int64, roles ...string) *discordgo.Member {
+	return &discordgo.Member{
+		User:        &discordgo.User{ID: userID, Username: "user" + userID},
+		Permissions: permissions,
+		Roles:       roles,
+	}
+}
+
+// commandInteraction creates a slash command interaction in the test guild. The options after the command name select subcommands.
+func commandInteraction(member *discordgo.Member, name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        snowflake(time.Now()),
+		AppID:     testApp,
+		Type:      discordgo.InteractionApplicationCommand,
+		GuildID:   testGuild,
+		ChannelID: testChannel,
+		Member:    member,
+		Data: discordgo.ApplicationCommandInteractionData{
+			Name:    name,
+			Options: options,
+		},
+	}}
+}
+
+// messageCommandInteraction creates an interaction for a message context menu command used on a message in the test guild.
+func messageCommandInteraction(member *discordgo.Member, name, messageID string) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        snowflake(time.Now()),
+		AppID:     testApp,
+		Type:      discordgo.InteractionApplicationCommand,
+		GuildID:   testGuild,
+		ChannelID: testChannel,
+		Member:    member,
+		Data: discordgo.ApplicationCommandInteractionData{
+			Name:     name,
+			TargetID: messageID,
+		},
+	}}
+}
+
+// componentInteraction creates an interaction for a component on a message in the test guild.
+func componentInteraction(member *discordgo.Member, customID string, values ...string) *discordgo.InteractionCreate {
+	componentType := discordgo.ButtonComponent
+	if len(values) > 0 {
+		componentType = discordgo.SelectMenuComponent
+	}
+
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        snowflake(time.Now()),
+		AppID:     testApp,
+		Type:      discordgo.InteractionMessageComponent,
+		GuildID:   testGuild,
+		ChannelID: testChannel,
+		Member:    member,
+		Data: discordgo.MessageComponentInteractionData{
+			CustomID:      customID,
+			ComponentType: componentType,
+			Values:        values,
+		},
+	}}
+}
+
+func subcommand(name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Type: discordgo.ApplicationCommandOptionSubCommand, Name: name, Options: options}
+}
+
+func stringOption(name, value string) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Type: discordgo.ApplicationCommandOptionString, Name: name, Value: value}
+}
+
+func roleOption(name, roleID string) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Type: discordgo.ApplicationCommandOptionRole, Name: name, Value: roleID}
+}
+
+func intOption(name string, value int) *discordgo.ApplicationCommandInteractionDataOption {
+	// Discord sends numbers as JSON numbers, which decode into float64
+	return &discordgo.ApplicationCommandInteractionDataOption{Type: discordgo.ApplicationCommandOptionInteger, Name: name, Value: float64(value)}
+}
+
+func boolOption(name string, value bool) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Type: discordgo.ApplicationCommandOptionBoolean, Name: name, Value: value}
+}
+
+// mustInteract runs an interaction and fails the test if it returns an error.
+func mustInteract(t *testing.T, s Session, i *discordgo.InteractionCreate) {
+	t.Helper()
+	if err := interact(s, i); err != nil {
+		t.Fatalf("interaction %s failed: %v", interactionName(i), err)
+	}
+}
+
+func TestFakeSessionImplementsSession(t *testing.T) {
+	var s Session = newFakeSession()
+	if _, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{ID: "1", Channel: "2"}); !isDiscordNotFound(err) {
+		t.Errorf("editing a missing message: got %v, want a not found error", err)
+	}
+
+	message, err := s.ChannelMessageSend("2", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{ID: message.ID, Channel: "2", Content: ptr("edited")}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := s.(*fakeSession)
+	if got, _ := fake.message(message.ID); got.Content != "edited" {
+		t.Errorf("message content = %q, want %q", got.Content, "edited")
+	}
+	if got := fake.countCalls("ChannelMessageSend"); got != 1 {
+		t.Errorf("ChannelMessageSend called %d times, want 1", got)
+	}
+	if _, err := discordgo.SnowflakeTimestamp(message.ID); err != nil {
+		t.Errorf("message ID %s isn't a snowflake: %v", message.ID, err)
+	}
+}
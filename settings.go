@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// MaxGuildDuration is the longest a guild can let its polls last.
+	MaxGuildDuration = 7 * 24 * time.Hour
+	// MaxGuildPollsPerUser is the most polls a guild can let each member have running at once.
+	MaxGuildPollsPerUser = 10
+)
+
+// GuildSettings are the settings a guild can change with /config set.
+type GuildSettings struct {
+	// DefaultDuration is how long polls last when their creator doesn't give a duration.
+	DefaultDuration time.Duration
+	// MaxDuration is the longest a poll may last.
+	MaxDuration time.Duration
+	// MaxPollsPerUser is how many polls each member may have running at once.
+	MaxPollsPerUser int
+	// PollColour is the colour of the embed of active polls.
+	PollColour int
+	// LogChannel is where polls being created and ended are logged, if it is set.
+	LogChannel string
+	// AnnounceChannel is where the results of ended polls are posted, if it is set.
+	AnnounceChannel string
+	// ModeratorRole can manage every poll in the guild, along with members who have the Manage Messages permission.
+	ModeratorRole string
+}
+
+func defaultGuildSettings() GuildSettings {
+	return GuildSettings{
+		DefaultDuration: DefaultDuration,
+		MaxDuration:     MaxDuration,
+		MaxPollsPerUser: 1,
+		PollColour:      DiscordYellow,
+	}
+}
+
+// validate checks that the settings make sense together.
+func (s GuildSettings) validate() error {
+	if s.DefaultDuration > s.MaxDuration {
+		return fmt.Errorf("the default duration (%s) can't be longer than the maximum duration (%s)", formatDuration(s.DefaultDuration), formatDuration(s.MaxDuration))
+	}
+	return nil
+}
+
+// guildSetting is a setting that can be changed with /config set. Settings are stored as strings, see SettingsStore.
+type guildSetting struct {
+	Key  string
+	Name string
+	// set parses a value, either given by a user or stored, and sets it in settings.
+	set func(settings *GuildSettings, value string) error
+	// value gets the setting from settings in the form it is stored.
+	value func(settings GuildSettings) string
+	// show gets the setting from settings in the form it is shown to users.
+	show func(settings GuildSettings) string
+	// channel marks settings that hold a channel ID, which are checked to be in the guild before they are set.
+	channel bool
+}
+
+// guildSettings are the settings a guild can change, in the order they are shown.
+var guildSettings = []*guildSetting{
+	{
+		Key:  "default_duration",
+		Name: "Default duration",
+		set: func(settings *GuildSettings, value string) error {
+			d, err := parseSettingDuration(value)
+			settings.DefaultDuration = d
+			return err
+		},
+		value: func(settings GuildSettings) string { return formatDuration(settings.DefaultDuration) },
+		show:  func(settings GuildSettings) string { return formatDuration(settings.DefaultDuration) },
+	},
+	{
+		Key:  "max_duration",
+		Name: "Maximum duration",
+		set: func(settings *GuildSettings, value string) error {
+			d, err := parseSettingDuration(value)
+			settings.MaxDuration = d
+			return err
+		},
+		value: func(settings GuildSettings) string { return formatDuration(settings.MaxDuration) },
+		show:  func(settings GuildSettings) string { return formatDuration(settings.MaxDuration) },
+	},
+	{
+		Key:  "max_polls_per_user",
+		Name: "Polls per member",
+		set: func(settings *GuildSettings, value string) error {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || n < 1 || n > MaxGuildPollsPerUser {
+				return fmt.Errorf("give a number from 1 to %d", MaxGuildPollsPerUser)
+			}
+			settings.MaxPollsPerUser = n
+			return nil
+		},
+		value: func(settings GuildSettings) string { return strconv.Itoa(settings.MaxPollsPerUser) },
+		show:  func(settings GuildSettings) string { return strconv.Itoa(settings.MaxPollsPerUser) },
+	},
+	{
+		Key:  "poll_colour",
+		Name: "Poll colour",
+		set: func(settings *GuildSettings, value string) error {
+			colour, err := parseColour(value)
+			settings.PollColour = colour
+			return err
+		},
+		value: func(settings GuildSettings) string { return formatColour(settings.PollColour) },
+		show:  func(settings GuildSettings) string { return formatColour(settings.PollColour) },
+	},
+	{
+		Key:  "log_channel",
+		Name: "Log channel",
+		set: func(settings *GuildSettings, value string) error {
+			channel, err := parseChannel(value)
+			settings.LogChannel = channel
+			return err
+		},
+		value:   func(settings GuildSettings) string { return settings.LogChannel },
+		show:    func(settings GuildSettings) string { return showChannel(settings.LogChannel) },
+		channel: true,
+	},
+	{
+		Key:  "announce_channel",
+		Name: "Announcement channel",
+		set: func(settings *GuildSettings, value string) error {
+			channel, err := parseChannel(value)
+			settings.AnnounceChannel = channel
+			return err
+		},
+		value:   func(settings GuildSettings) string { return settings.AnnounceChannel },
+		show:    func(settings GuildSettings) string { return showChannel(settings.AnnounceChannel) },
+		channel: true,
+	},
+	{
+		Key:  "moderator_role",
+		Name: "Moderator role",
+		set: func(settings *GuildSettings, value string) error {
+			role, err := parseRole(value)
+			settings.ModeratorRole = role
+			return err
+		},
+		value: func(settings GuildSettings) string { return settings.ModeratorRole },
+		show:  func(settings GuildSettings) string { return showRole(settings.ModeratorRole) },
+	},
+}
+
+// findGuildSetting finds a setting by its key.
+func findGuildSetting(key string) (*guildSetting, bool) {
+	for _, setting := range guildSettings {
+		if setting.Key == key {
+			return setting, true
+		}
+	}
+	return nil, false
+}
+
+// guildSettingChoices are the choices of the setting option of the config commands.
+func guildSettingChoices() []*discordgo.ApplicationCommandOptionChoice {
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(guildSettings))
+	for _, setting := range guildSettings {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: setting.Name, Value: setting.Key})
+	}
+	return choices
+}
+
+// loadGuildSettings applies stored settings over the defaults. Stored values that are no longer valid,
+// for example because a limit was lowered, are logged and left at their defaults.
+func loadGuildSettings(values map[string]string) GuildSettings {
+	settings := defaultGuildSettings()
+	for _, setting := range guildSettings {
+		value, ok := values[setting.Key]
+		if !ok {
+			continue
+		}
+
+		loaded := settings
+		if err := setting.set(&loaded, value); err != nil {
+			logger.Warn("Ignoring invalid guild setting", "setting", setting.Key, "value", value, "error", err)
+			continue
+		}
+		settings = loaded
+	}
+
+	if err := settings.validate(); err != nil {
+		logger.Warn("Ignoring invalid guild settings", "error", err)
+		defaults := defaultGuildSettings()
+		settings.DefaultDuration, settings.MaxDuration = defaults.DefaultDuration, defaults.MaxDuration
+	}
+	return settings
+}
+
+func parseSettingDuration(value string) (time.Duration, error) {
+	d, err := parseDuration(strings.TrimSpace(value))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("give a duration like 1h30m")
+	}
+	if d > MaxGuildDuration {
+		return 0, fmt.Errorf("durations can't be longer than %s", formatDuration(MaxGuildDuration))
+	}
+	return d, nil
+}
+
+// namedColours are the colours that can be given by name instead of as a hex code.
+var namedColours = map[string]int{
+	"blurple": DiscordBlurple,
+	"green":   DiscordGreen,
+	"yellow":  DiscordYellow,
+	"fuchsia": DiscordFuscha,
+	"red":     DiscordRed,
+	"white":   DiscordWhite,
+	"black":   DiscordBlack,
+}
+
+// parseColour parses a colour given as a hex code such as #FEE75C, or by the name of a Discord colour.
+func parseColour(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if colour, ok := namedColours[value]; ok {
+		return colour, nil
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+	colour, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return 0, fmt.Errorf("give a hex code like #FEE75C or one of blurple, green, yellow, fuchsia, red, white or black")
+	}
+	return int(colour), nil
+}
+
+func formatColour(colour int) string {
+	return fmt.Sprintf("#%06X", colour)
+}
+
+var channelMentionRegex = regexp.MustCompile(`^<#(\d+)>$`)
+
+// parseChannel parses a channel given as a mention or an ID. An empty value means no channel.
+func parseChannel(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if match := channelMentionRegex.FindStringSubmatch(value); match != nil {
+		return match[1], nil
+	}
+	if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+		return "", fmt.Errorf("give a channel, e.g. #polls")
+	}
+	return value, nil
+}
+
+func showChannel(channel string) string {
+	if channel == "" {
+		return "Not set"
+	}
+	return "<#" + channel + ">"
+}
+
+var roleMentionRegex = regexp.MustCompile(`^<@&(\d+)>$`)
+
+// parseRole parses a role given as a mention or an ID. An empty value means no role.
+func parseRole(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if match := roleMentionRegex.FindStringSubmatch(value); match != nil {
+		return match[1], nil
+	}
+	if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+		return "", fmt.Errorf("give a role, e.g. @Moderators")
+	}
+	return value, nil
+}
+
+func showRole(role string) string {
+	if role == "" {
+		return "Not set"
+	}
+	return "<@&" + role + ">"
+}
+
+// guildLog posts a message in a guild's log channel, if it has one. Failures are only logged, as the log channel is a convenience.
+func guildLog(s Session, guildId, content string) {
+	settings, err := databaseGuildSettings(guildId)
+	if err != nil {
+		logger.Error("Failed to get guild settings", "guild", guildId, "error", err)
+		return
+	}
+	if settings.LogChannel == "" {
+		return
+	}
+
+	_, err = s.ChannelMessageSendComplex(settings.LogChannel, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		logger.Warn("Failed to send to log channel", "guild", guildId, "channel", settings.LogChannel, "error", err)
+	}
+}
+
+// configViewCmd is the handler for the view subcommand of the config command
+func configViewCmd(c *CommandContext) error {
+	settings, err := databaseGuildSettings(c.Interaction.GuildID)
+	if err != nil {
+		return err
+	}
+	defaults := defaultGuildSettings()
+
+	fields := make([]*discordgo.MessageEmbedField, 0, len(guildSettings))
+	for _, setting := range guildSettings {
+		value := setting.show(settings)
+		if setting.value(settings) == setting.value(defaults) {
+			value += " (default)"
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   setting.Name,
+			Value:  value,
+			Inline: true,
+		})
+	}
+
+	return c.Respond(&discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{{
+			Title:  "Server settings",
+			Color:  settings.PollColour,
+			Fields: fields,
+			Footer: &discordgo.MessageEmbedFooter{Text: "Change a setting with /config set, or put it back to its default with /config reset."},
+		}},
+	})
+}
+
+// configSetCmd is the handler for the set subcommand of the config command
+func configSetCmd(c *CommandContext) error {
+	guildId := c.Interaction.GuildID
+	setting, ok := findGuildSetting(c.Options.String("setting", ""))
+	if !ok {
+		return commandErrorf("There is no setting called `%s`.", c.Options.String("setting", ""))
+	}
+
+	settings, err := databaseGuildSettings(guildId)
+	if err != nil {
+		return err
+	}
+
+	// Leaving out the value clears channels and roles, other settings need one
+	value := c.Options.String("value", "")
+	if err := setting.set(&settings, value); err != nil {
+		return commandErrorf("Invalid value for %s: %s.", strings.ToLower(setting.Name), err)
+	}
+	if err := settings.validate(); err != nil {
+		return commandErrorf("Can't change %s: %s.", strings.ToLower(setting.Name), err)
+	}
+
+	if setting.channel && setting.value(settings) != "" {
+		channelId := setting.value(settings)
+		channel, err := c.Session.Channel(channelId)
+		if err != nil || channel.GuildID != guildId {
+			return commandErrorf("<#%s> isn't a channel in this server that I can see.", channelId)
+		}
+		if channel.Type != discordgo.ChannelTypeGuildText && channel.Type != discordgo.ChannelTypeGuildNews {
+			return commandErrorf("<#%s> isn't a text channel.", channelId)
+		}
+	}
+
+	if err := databaseGuildSettingSet(guildId, setting.Key, setting.value(settings)); err != nil {
+		return err
+	}
+
+	if setting.value(settings) == "" {
+		return c.Reply(fmt.Sprintf("%s is no longer set.", setting.Name))
+	}
+	return c.Reply(fmt.Sprintf("%s is now %s.", setting.Name, setting.show(settings)))
+}
+
+// configResetCmd is the handler for the reset subcommand of the config command
+func configResetCmd(c *CommandContext) error {
+	guildId := c.Interaction.GuildID
+	if !c.Options.Has("setting") {
+		removed, err := databaseGuildSettingsReset(guildId)
+		if err != nil {
+			return err
+		}
+		return c.Reply(fmt.Sprintf("All settings are back to their defaults, %d had been changed.", removed))
+	}
+
+	setting, ok := findGuildSetting(c.Options.String("setting", ""))
+	if !ok {
+		return commandErrorf("There is no setting called `%s`.", c.Options.String("setting", ""))
+	}
+
+	// Putting one of the durations back to its default could leave the default duration longer than the maximum
+	settings, err := databaseGuildSettings(guildId)
+	if err != nil {
+		return err
+	}
+	if err := setting.set(&settings, setting.value(defaultGuildSettings())); err != nil {
+		return err
+	}
+	if err := settings.validate(); err != nil {
+		return commandErrorf("Can't reset %s: %s.", strings.ToLower(setting.Name), err)
+	}
+
+	removed, err := databaseGuildSettingReset(guildId, setting.Key)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return c.Reply(fmt.Sprintf("%s is already the default, %s.", setting.Name, setting.show(settings)))
+	}
+	return c.Reply(fmt.Sprintf("%s is back to its default, %s.", setting.Name, setting.show(settings)))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestConfigClearSetting(t *testing.T) {
+	s := setupTest(t)
+	admin := testMember("9", discordgo.PermissionManageServer)
+	s.channels["500"] = &discordgo.Channel{ID: "500", GuildID: testGuild, Type: discordgo.ChannelTypeGuildText}
+
+	for _, key := range []string{"announce_channel", "log_channel"} {
+		mustInteract(t, s, commandInteraction(admin, "config", subcommand("set", stringOption("setting", key), stringOption("value", "<#500>"))))
+	}
+
+	// Leaving out the value clears a channel, without touching the other settings
+	i := commandInteraction(admin, "config", subcommand("set", stringOption("setting", "announce_channel")))
+	mustInteract(t, s, i)
+	if reply := s.reply(i); reply != "Announcement channel is no longer set." {
+		t.Errorf("reply = %q, want the announcement channel to be cleared", reply)
+	}
+	settings, _ := databaseGuildSettings(testGuild)
+	if settings.AnnounceChannel != "" || settings.LogChannel != "500" {
+		t.Errorf("announcement channel = %q, log channel = %q, want only the announcement channel cleared", settings.AnnounceChannel, settings.LogChannel)
+	}
+
+	// Resetting a single setting also clears it
+	i = commandInteraction(admin, "config", subcommand("reset", stringOption("setting", "log_channel")))
+	mustInteract(t, s, i)
+	if settings, _ := databaseGuildSettings(testGuild); settings.LogChannel != "" {
+		t.Errorf("log channel = %q after it was reset", settings.LogChannel)
+	}
+
+	// Settings that can't be empty need a value
+	i = commandInteraction(admin, "config", subcommand("set", stringOption("setting", "default_duration")))
+	if err := interact(s, i); err == nil {
+		t.Error("default duration was set without a value")
+	}
+	if reply := s.reply(i); !strings.Contains(reply, "Invalid value for default duration") {
+		t.Errorf("reply = %q, want the value to be asked for", reply)
+	}
+}
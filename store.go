@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PollStore persists polls and the votes cast in them.
+type PollStore interface {
+	// CreatePoll adds a new active poll.
+	CreatePoll(poll dbPoll) error
+	// GetPoll gets a poll along with its votes.
+	GetPoll(id string) (dbPoll, error)
+	// Vote records a user's vote for an option and returns how many options the user has voted for.
+	// For single choice polls this replaces the user's previous vote, otherwise it toggles the user's vote for the option.
+	Vote(pollId, userId string, option int) (int, error)
+	// SetVotes replaces all of a user's votes with votes for the given options and returns how many options the user has voted for.
+	SetVotes(pollId, userId string, options []int) (int, error)
+	// Rank appends an option to the end of a user's ranking for a ranked-choice poll and returns the user's updated ranking.
+	Rank(pollId, userId string, option int) ([]int, error)
+	// ClearRanking removes a user's ranking from a ranked-choice poll.
+	ClearRanking(pollId, userId string) error
+	// EndPoll marks an active poll as ended and returns it. The salt of an anonymous poll is discarded
+	// so the stored voter hashes can no longer be linked to users.
+	EndPoll(pollId string) (dbPoll, error)
+	// ImportPoll adds a poll exactly as given, including its status and votes, for example from an export.
+	ImportPoll(poll dbPoll, votes []dbVote) error
+	// DeletePoll removes a poll along with its votes and jobs.
+	DeletePoll(pollId string) error
+	// PollVotes gets every vote cast in a poll, ordered by user and then by rank.
+	PollVotes(pollId string) ([]dbVote, error)
+	// AllPolls gets every poll, active or ended, oldest first.
+	AllPolls() ([]dbPoll, error)
+	// ActivePolls gets every poll that hasn't ended.
+	ActivePolls() ([]dbPoll, error)
+	// PollHistory gets a page of the ended polls in a guild, most recently ended first, along with the total number of ended polls.
+	PollHistory(guildId string, offset, limit int) ([]dbPoll, int, error)
+	// GuildActivePolls gets a page of the active polls in a guild, ending soonest first, along with the total number of active polls.
+	GuildActivePolls(guildId string, offset, limit int) ([]dbPoll, int, error)
+	// MessagePoll gets the poll posted as a message.
+	MessagePoll(messageId string) (dbPoll, error)
+	// UserPoll gets the most recently created active poll a user created in a guild.
+	UserPoll(userId, guildId string) (dbPoll, error)
+	// CountUserPolls counts the active polls a user created in a guild.
+	CountUserPolls(userId, guildId string) (int, error)
+	// CountActivePolls counts the polls that haven't ended.
+	CountActivePolls() (int, error)
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// JobStore persists the jobs run by the scheduler. Jobs are identified by their kind and target,
+// so there is at most one job of each kind for a poll.
+type JobStore interface {
+	// ScheduleJob adds a job. An existing job with the same kind and target is replaced if replace is set and kept otherwise.
+	ScheduleJob(job dbJob, replace bool) error
+	// CancelJobs removes every job for a target.
+	CancelJobs(target string) error
+	// NextJob gets the job that is due to run soonest, if there are any.
+	NextJob() (dbJob, bool, error)
+	// ClaimJob leases a job to the caller by pushing its run time back to until, so that it isn't run twice at once.
+	// It returns false if the job was changed or removed since it was fetched.
+	ClaimJob(job dbJob, until time.Time) (dbJob, bool, error)
+	// CompleteJob removes a claimed job after it has run, unless it was rescheduled in the meantime.
+	CompleteJob(job dbJob) error
+	// RetryJob reschedules a claimed job that failed, unless it was rescheduled in the meantime.
+	RetryJob(job dbJob, runAt time.Time, lastError string) error
+}
+
+// PermissionStore persists who may use commands in each guild.
+type PermissionStore interface {
+	// CommandPermissions gets the command permissions set up in a guild, ordered by command.
+	CommandPermissions(guildId string) ([]dbCommandPermission, error)
+	// AddCommandPermission adds a command permission, doing nothing if it already exists.
+	AddCommandPermission(permission dbCommandPermission) error
+	// RemoveCommandPermission removes a command permission and returns whether it existed.
+	RemoveCommandPermission(permission dbCommandPermission) (bool, error)
+	// ResetCommandPermissions removes every permission for a command in a guild and returns how many there were.
+	ResetCommandPermissions(guildId, command string) (int, error)
+}
+
+// SettingsStore persists the settings of each guild as strings by key, see GuildSettings.
+type SettingsStore interface {
+	// GuildSettings gets the settings a guild has changed from their defaults.
+	GuildSettings(guildId string) (map[string]string, error)
+	// SetGuildSetting sets a setting in a guild, replacing its previous value.
+	SetGuildSetting(guildId, key, value string) error
+	// ResetGuildSetting removes a setting from a guild so it goes back to its default, and returns whether it was set.
+	ResetGuildSetting(guildId, key string) (bool, error)
+	// ResetGuildSettings removes every setting from a guild and returns how many there were.
+	ResetGuildSettings(guildId string) (int, error)
+}
+
+// Store is everything the bot persists.
+type Store interface {
+	PollStore
+	JobStore
+	PermissionStore
+	SettingsStore
+}
+
+var (
+	// errTooManyChoices is returned when a user tries to vote for more options than a poll allows.
+	errTooManyChoices = errors.New("too many choices")
+	// errPollNotFound is returned when a poll doesn't exist, or isn't in the state an operation needs.
+	errPollNotFound = errors.New("poll not found")
+	// errPollEnded is returned when voting in a poll that has ended.
+	errPollEnded = errors.New("poll has ended")
+)
+
+// openStore opens the poll store for a driver. The source is the file name for sqlite and the connection string for postgres,
+// and is ignored by the in-memory store.
+func openStore(driver, source string) (Store, error) {
+	switch driver {
+	case "", "sqlite":
+		if source == "" {
+			source = "database.db"
+		}
+		return openSQLiteStore(source)
+	case "postgres":
+		if source == "" {
+			return nil, fmt.Errorf("postgres needs a connection string")
+		}
+		return openPostgresStore(source)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
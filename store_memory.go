@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in memory, for tests and trying the bot out.
+// Nothing is persisted between runs.
+type memoryStore struct {
+	mu    sync.Mutex
+	polls map[string]dbPoll
+	// votes holds the votes of each poll, keyed by poll ID.
+	votes map[string][]dbVote
+	jobs  map[jobKey]dbJob
+	// permissions holds the command permissions of each guild, keyed by guild ID.
+	permissions map[string][]dbCommandPermission
+	// settings holds the settings of each guild, keyed by guild ID and then by setting.
+	settings map[string]map[string]string
+}
+
+type jobKey struct {
+	kind, target string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		polls:       map[string]dbPoll{},
+		votes:       map[string][]dbVote{},
+		jobs:        map[jobKey]dbJob{},
+		permissions: map[string][]dbCommandPermission{},
+		settings:    map[string]map[string]string{},
+	}
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// get returns a copy of a poll with its votes filled in. The caller must hold the lock.
+func (s *memoryStore) get(id string) (dbPoll, bool) {
+	poll, ok := s.polls[id]
+	if !ok {
+		return dbPoll{}, false
+	}
+
+	poll.Options = append([]string(nil), poll.Options...)
+	fillPollVotes(&poll, s.sortedVotes(id))
+	return poll, true
+}
+
+// sortedVotes returns a copy of the votes of a poll ordered by user and then by rank. The caller must hold the lock.
+func (s *memoryStore) sortedVotes(pollId string) []dbVote {
+	votes := append([]dbVote{}, s.votes[pollId]...)
+	sort.SliceStable(votes, func(i, j int) bool {
+		if votes[i].User != votes[j].User {
+			return votes[i].User < votes[j].User
+		}
+		return votes[i].Rank < votes[j].Rank
+	})
+	return votes
+}
+
+// votable returns the poll if it can still be voted on. The caller must hold the lock.
+func (s *memoryStore) votable(pollId string) (dbPoll, error) {
+	poll, ok := s.polls[pollId]
+	if !ok {
+		return dbPoll{}, errPollNotFound
+	}
+
+	if poll.Status != PollStatusActive || poll.EndTime.Before(time.Now()) {
+		return dbPoll{}, errPollEnded
+	}
+
+	return poll, nil
+}
+
+// userVotes returns the options a user has voted for in a poll, ordered by rank. The caller must hold the lock.
+func (s *memoryStore) userVotes(pollId, userId string) []int {
+	options := []int{}
+	for _, vote := range s.sortedVotes(pollId) {
+		if vote.User == userId {
+			options = append(options, vote.Option)
+		}
+	}
+	return options
+}
+
+// removeVotes removes the votes of a user in a poll that match a filter and returns how many were removed. The caller must hold the lock.
+func (s *memoryStore) removeVotes(pollId, userId string, remove func(option int) bool) int {
+	kept := s.votes[pollId][:0]
+	removed := 0
+	for _, vote := range s.votes[pollId] {
+		if vote.User == userId && remove(vote.Option) {
+			removed++
+		} else {
+			kept = append(kept, vote)
+		}
+	}
+	s.votes[pollId] = kept
+	return removed
+}
+
+// addVote adds a vote unless the user has already voted for the option. The caller must hold the lock.
+func (s *memoryStore) addVote(vote dbVote) {
+	for _, existing := range s.votes[vote.Poll] {
+		if existing.User == vote.User && existing.Option == vote.Option {
+			return
+		}
+	}
+	s.votes[vote.Poll] = append(s.votes[vote.Poll], vote)
+}
+
+func (s *memoryStore) CreatePoll(poll dbPoll) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.polls[poll.ID]; ok {
+		return fmt.Errorf("poll %s already exists", poll.ID)
+	}
+
+	poll, err := preparePoll(poll)
+	if err != nil {
+		return err
+	}
+
+	poll.Options = append([]string(nil), poll.Options...)
+	poll.Votes = nil
+	poll.Rankings = nil
+	s.polls[poll.ID] = poll
+	return nil
+}
+
+func (s *memoryStore) ImportPoll(poll dbPoll, votes []dbVote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.polls[poll.ID]; ok {
+		return fmt.Errorf("poll %s already exists", poll.ID)
+	}
+
+	poll.Options = append([]string(nil), poll.Options...)
+	poll.Votes = nil
+	poll.Rankings = nil
+	s.polls[poll.ID] = poll
+	for _, vote := range votes {
+		vote.Poll = poll.ID
+		s.addVote(vote)
+	}
+	return nil
+}
+
+func (s *memoryStore) DeletePoll(pollId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.polls[pollId]; !ok {
+		return errPollNotFound
+	}
+
+	delete(s.polls, pollId)
+	delete(s.votes, pollId)
+	for key := range s.jobs {
+		if key.target == pollId {
+			delete(s.jobs, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetPoll(id string) (dbPoll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, ok := s.get(id)
+	if !ok {
+		return dbPoll{}, errPollNotFound
+	}
+	return poll, nil
+}
+
+func (s *memoryStore) Vote(pollId, userId string, option int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, err := s.votable(pollId)
+	if err != nil {
+		return 0, err
+	}
+
+	if option < 0 || option >= len(poll.Options) {
+		return 0, fmt.Errorf("option %d is out of range", option)
+	}
+
+	if poll.MaxChoices <= 1 {
+		s.removeVotes(pollId, userId, func(voted int) bool { return voted != option })
+	} else if s.removeVotes(pollId, userId, func(voted int) bool { return voted == option }) > 0 {
+		return len(s.userVotes(pollId, userId)), nil
+	} else if picks := len(s.userVotes(pollId, userId)); picks >= poll.MaxChoices {
+		return picks, errTooManyChoices
+	}
+
+	s.addVote(dbVote{Poll: pollId, User: userId, Option: option, VotedAt: time.Now()})
+	return len(s.userVotes(pollId, userId)), nil
+}
+
+func (s *memoryStore) SetVotes(pollId, userId string, options []int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, err := s.votable(pollId)
+	if err != nil {
+		return 0, err
+	}
+
+	chosen := map[int]bool{}
+	for _, option := range options {
+		if option < 0 || option >= len(poll.Options) {
+			return 0, fmt.Errorf("option %d is out of range", option)
+		}
+		chosen[option] = true
+	}
+
+	if len(chosen) > poll.MaxChoices {
+		return 0, errTooManyChoices
+	}
+
+	s.removeVotes(pollId, userId, func(voted int) bool { return !chosen[voted] })
+
+	now := time.Now()
+	for option := range chosen {
+		s.addVote(dbVote{Poll: pollId, User: userId, Option: option, VotedAt: now})
+	}
+	return len(chosen), nil
+}
+
+func (s *memoryStore) Rank(pollId, userId string, option int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, err := s.votable(pollId)
+	if err != nil {
+		return nil, err
+	}
+
+	if poll.Mode != PollModeRanked {
+		return nil, fmt.Errorf("poll is not a ranked-choice poll")
+	}
+
+	if option < 0 || option >= len(poll.Options) {
+		return nil, fmt.Errorf("option %d is out of range", option)
+	}
+
+	ranking := s.userVotes(pollId, userId)
+	s.addVote(dbVote{Poll: pollId, User: userId, Option: option, Rank: len(ranking) + 1, VotedAt: time.Now()})
+	return s.userVotes(pollId, userId), nil
+}
+
+func (s *memoryStore) ClearRanking(pollId, userId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, err := s.votable(pollId)
+	if err != nil {
+		return err
+	}
+
+	if poll.Mode != PollModeRanked {
+		return fmt.Errorf("poll is not a ranked-choice poll")
+	}
+
+	s.removeVotes(pollId, userId, func(int) bool { return true })
+	return nil
+}
+
+func (s *memoryStore) EndPoll(pollId string) (dbPoll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, ok := s.polls[pollId]
+	if !ok || poll.Status != PollStatusActive {
+		return dbPoll{}, fmt.Errorf("poll %s is not active: %w", pollId, errPollNotFound)
+	}
+
+	poll.Status = PollStatusEnded
+	poll.EndedAt = time.Now()
+	poll.Salt = ""
+	s.polls[pollId] = poll
+
+	ended, _ := s.get(pollId)
+	return ended, nil
+}
+
+func (s *memoryStore) PollVotes(pollId string) ([]dbVote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedVotes(pollId), nil
+}
+
+// filter returns copies of the polls that match a condition. The caller must hold the lock.
+func (s *memoryStore) filter(match func(dbPoll) bool) []dbPoll {
+	polls := []dbPoll{}
+	for id, poll := range s.polls {
+		if match(poll) {
+			poll, _ = s.get(id)
+			polls = append(polls, poll)
+		}
+	}
+	return polls
+}
+
+func (s *memoryStore) AllPolls() ([]dbPoll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	polls := s.filter(func(poll dbPoll) bool { return true })
+	sort.Slice(polls, func(i, j int) bool {
+		return polls[i].CreatedTime.Before(polls[j].CreatedTime)
+	})
+	return polls, nil
+}
+
+func (s *memoryStore) ActivePolls() ([]dbPoll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.filter(func(poll dbPoll) bool {
+		return poll.Status == PollStatusActive
+	}), nil
+}
+
+func (s *memoryStore) MessagePoll(messageId string) (dbPoll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, poll := range s.polls {
+		if poll.Message == messageId {
+			poll, _ = s.get(id)
+			return poll, nil
+		}
+	}
+	return dbPoll{}, errPollNotFound
+}
+
+func (s *memoryStore) PollHistory(guildId string, offset, limit int) ([]dbPoll, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	polls := s.filter(func(poll dbPoll) bool {
+		return poll.Guild == guildId && poll.Status == PollStatusEnded
+	})
+
+	sort.Slice(polls, func(i, j int) bool {
+		return polls[i].EndedAt.After(polls[j].EndedAt)
+	})
+
+	total := len(polls)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	return polls[offset:end], total, nil
+}
+
+func (s *memoryStore) GuildActivePolls(guildId string, offset, limit int) ([]dbPoll, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	polls := s.filter(func(poll dbPoll) bool {
+		return poll.Guild == guildId && poll.Status == PollStatusActive
+	})
+
+	sort.Slice(polls, func(i, j int) bool {
+		return polls[i].EndTime.Before(polls[j].EndTime)
+	})
+
+	total := len(polls)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	return polls[offset:end], total, nil
+}
+
+func (s *memoryStore) UserPoll(userId, guildId string) (dbPoll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	polls := s.filter(func(poll dbPoll) bool {
+		return poll.Creator == userId && poll.Guild == guildId && poll.Status == PollStatusActive
+	})
+	if len(polls) == 0 {
+		return dbPoll{}, errPollNotFound
+	}
+
+	sort.Slice(polls, func(i, j int) bool {
+		return polls[i].CreatedTime.After(polls[j].CreatedTime)
+	})
+	return polls[0], nil
+}
+
+func (s *memoryStore) CountUserPolls(userId, guildId string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, poll := range s.polls {
+		if poll.Creator == userId && poll.Guild == guildId && poll.Status == PollStatusActive {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CountActivePolls() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, poll := range s.polls {
+		if poll.Status == PollStatusActive {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) ScheduleJob(job dbJob, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := jobKey{job.Kind, job.Target}
+	if _, ok := s.jobs[key]; ok && !replace {
+		return nil
+	}
+
+	job.Attempts = 0
+	job.LastError = ""
+	job.Token = newJobToken()
+	s.jobs[key] = job
+	return nil
+}
+
+func (s *memoryStore) CancelJobs(target string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.jobs {
+		if key.target == target {
+			delete(s.jobs, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) NextJob() (dbJob, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next dbJob
+	found := false
+	for _, job := range s.jobs {
+		if !found || job.RunAt.Before(next.RunAt) {
+			next = job
+			found = true
+		}
+	}
+	return next, found, nil
+}
+
+// claimed returns the stored job if its token still matches. The caller must hold the lock.
+func (s *memoryStore) claimed(job dbJob) (dbJob, bool) {
+	stored, ok := s.jobs[jobKey{job.Kind, job.Target}]
+	if !ok || stored.Token != job.Token {
+		return dbJob{}, false
+	}
+	return stored, true
+}
+
+func (s *memoryStore) ClaimJob(job dbJob, until time.Time) (dbJob, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.claimed(job)
+	if !ok {
+		return dbJob{}, false, nil
+	}
+
+	stored.RunAt = until
+	stored.Attempts++
+	stored.Token = newJobToken()
+	s.jobs[jobKey{job.Kind, job.Target}] = stored
+	return stored, true, nil
+}
+
+func (s *memoryStore) CompleteJob(job dbJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.claimed(job); ok {
+		delete(s.jobs, jobKey{job.Kind, job.Target})
+	}
+	return nil
+}
+
+func (s *memoryStore) RetryJob(job dbJob, runAt time.Time, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.claimed(job)
+	if !ok {
+		return nil
+	}
+
+	stored.RunAt = runAt
+	stored.LastError = lastError
+	stored.Token = newJobToken()
+	s.jobs[jobKey{job.Kind, job.Target}] = stored
+	return nil
+}
+
+func (s *memoryStore) CommandPermissions(guildId string) ([]dbCommandPermission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	permissions := append([]dbCommandPermission{}, s.permissions[guildId]...)
+	sort.Slice(permissions, func(i, j int) bool {
+		a, b := permissions[i], permissions[j]
+		if a.Command != b.Command {
+			return a.Command < b.Command
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Target < b.Target
+	})
+	return permissions, nil
+}
+
+func (s *memoryStore) AddCommandPermission(permission dbCommandPermission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.permissions[permission.Guild] {
+		if existing == permission {
+			return nil
+		}
+	}
+	s.permissions[permission.Guild] = append(s.permissions[permission.Guild], permission)
+	return nil
+}
+
+// removePermissions removes the permissions of a guild that match a filter and returns how many were removed. The caller must hold the lock.
+func (s *memoryStore) removePermissions(guildId string, remove func(dbCommandPermission) bool) int {
+	kept := s.permissions[guildId][:0]
+	removed := 0
+	for _, permission := range s.permissions[guildId] {
+		if remove(permission) {
+			removed++
+		} else {
+			kept = append(kept, permission)
+		}
+	}
+	s.permissions[guildId] = kept
+	return removed
+}
+
+func (s *memoryStore) RemoveCommandPermission(permission dbCommandPermission) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := s.removePermissions(permission.Guild, func(existing dbCommandPermission) bool {
+		return existing == permission
+	})
+	return removed > 0, nil
+}
+
+func (s *memoryStore) ResetCommandPermissions(guildId, command string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removePermissions(guildId, func(existing dbCommandPermission) bool {
+		return existing.Command == command
+	}), nil
+}
+
+func (s *memoryStore) GuildSettings(guildId string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settings := map[string]string{}
+	for key, value := range s.settings[guildId] {
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+func (s *memoryStore) SetGuildSetting(guildId, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.settings[guildId] == nil {
+		s.settings[guildId] = map[string]string{}
+	}
+	s.settings[guildId][key] = value
+	return nil
+}
+
+func (s *memoryStore) ResetGuildSetting(guildId, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.settings[guildId][key]
+	delete(s.settings[guildId], key)
+	return ok, nil
+}
+
+func (s *memoryStore) ResetGuildSettings(guildId string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := len(s.settings[guildId])
+	delete(s.settings, guildId)
+	return removed, nil
+}
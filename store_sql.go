@@ -0,0 +1,956 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"discordhelperbot/set"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/segmentio/ksuid"
+)
+
+// sqlStore is a Store backed by a SQL database. The same queries are used for every dialect,
+// written with ? placeholders and rewritten by rebind for dialects that number their placeholders.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// pollColumns is the column list used when selecting a full poll row, in the order expected by scanPoll.
+const pollColumns = `id, guild, channel, message, question, options, creator, createdtime, endtime, mode, max_choices, anonymous, salt, hide_results, status, ended_at, colour`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func openSQLiteStore(file string) (*sqlStore, error) {
+	// Secure delete overwrites deleted rows so that votes from finished anonymous polls can't be recovered.
+	// The busy timeout lets the admin commands write while the bot is running, instead of failing when it holds the lock.
+	db, err := sql.Open("sqlite3", file+"?_secure_delete=true&_foreign_keys=true&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	return newSQLStore(db, "sqlite")
+}
+
+func openPostgresStore(source string) (*sqlStore, error) {
+	db, err := sql.Open("postgres", source)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSQLStore(db, "postgres")
+}
+
+func newSQLStore(db *sql.DB, dialect string) (*sqlStore, error) {
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to database: %w", err)
+	}
+
+	if err := databaseMigrate(db, dialect); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db, dialect: dialect}, nil
+}
+
+// rebind rewrites the ? placeholders in a query into the placeholder style of a dialect.
+func rebind(dialect, query string) string {
+	if dialect != "postgres" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (s *sqlStore) q(query string) string {
+	return rebind(s.dialect, query)
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	// Ping only checks a connection can be made, which always works for sqlite, so run a query
+	var one int
+	return s.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// scanPoll scans a row selected with pollColumns into a dbPoll.
+// The votes of the poll are not loaded, see loadVotes.
+func scanPoll(row rowScanner) (dbPoll, error) {
+	var (
+		poll        dbPoll
+		optionsJSON []byte
+		mode        string
+		status      string
+		endedAt     sql.NullTime
+	)
+
+	err := row.Scan(&poll.ID, &poll.Guild, &poll.Channel, &poll.Message, &poll.Question, &optionsJSON, &poll.Creator, &poll.CreatedTime, &poll.EndTime, &mode, &poll.MaxChoices, &poll.Anonymous, &poll.Salt, &poll.HideResults, &status, &endedAt, &poll.Colour)
+	if err != nil {
+		return dbPoll{}, err
+	}
+
+	poll.Mode = PollMode(mode)
+	poll.Status = PollStatus(status)
+	if endedAt.Valid {
+		poll.EndedAt = endedAt.Time
+	}
+
+	err = json.Unmarshal(optionsJSON, &poll.Options)
+	if err != nil {
+		return dbPoll{}, fmt.Errorf("error unmarshalling options: %w", err)
+	}
+
+	return poll, nil
+}
+
+// loadVotes fills in the votes and rankings of a poll from the poll_votes table.
+func (s *sqlStore) loadVotes(q queryer, poll *dbPoll) error {
+	votes, err := s.queryVotes(q, poll.ID)
+	if err != nil {
+		return err
+	}
+
+	fillPollVotes(poll, votes)
+	return nil
+}
+
+// fillPollVotes builds the votes and rankings of a poll from its vote rows, which must be ordered by user and then by rank.
+func fillPollVotes(poll *dbPoll, votes []dbVote) {
+	poll.Votes = make([]set.Set[string], len(poll.Options))
+	poll.Rankings = map[string][]int{}
+	for _, vote := range votes {
+		if vote.Option < 0 || vote.Option >= len(poll.Options) {
+			continue
+		}
+
+		poll.Votes[vote.Option].Add(vote.User)
+		if vote.Rank > 0 {
+			poll.Rankings[vote.User] = append(poll.Rankings[vote.User], vote.Option)
+		}
+	}
+}
+
+func (s *sqlStore) PollVotes(pollId string) ([]dbVote, error) {
+	return s.queryVotes(s.db, pollId)
+}
+
+func (s *sqlStore) queryVotes(q queryer, pollId string) ([]dbVote, error) {
+	rows, err := q.Query(s.q(`SELECT poll_id, user_id, option, rank, voted_at FROM poll_votes WHERE poll_id = ? ORDER BY user_id, rank`), pollId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting votes: %w", err)
+	}
+	defer rows.Close()
+
+	votes := []dbVote{}
+	for rows.Next() {
+		var vote dbVote
+		if err := rows.Scan(&vote.Poll, &vote.User, &vote.Option, &vote.Rank, &vote.VotedAt); err != nil {
+			return nil, fmt.Errorf("error scanning vote: %w", err)
+		}
+		votes = append(votes, vote)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting votes: %w", err)
+	}
+
+	return votes, nil
+}
+
+// preparePoll fills in the defaults of a new poll, generating a salt for anonymous polls.
+func preparePoll(poll dbPoll) (dbPoll, error) {
+	if poll.Mode == "" {
+		poll.Mode = PollModeSingle
+	}
+
+	if poll.MaxChoices < 1 {
+		poll.MaxChoices = 1
+	}
+
+	// Anonymous polls need a salt to hash voter IDs with
+	if poll.Anonymous && poll.Salt == "" {
+		salt, err := newPollSalt()
+		if err != nil {
+			return dbPoll{}, err
+		}
+		poll.Salt = salt
+	}
+
+	poll.Status = PollStatusActive
+	poll.EndedAt = time.Time{}
+	return poll, nil
+}
+
+// newPollSalt generates a random salt for an anonymous poll, see pollVoterKey.
+func newPollSalt() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *sqlStore) CreatePoll(poll dbPoll) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	poll, err = preparePoll(poll)
+	if err != nil {
+		return err
+	}
+
+	// Marshal the options into JSON
+	optionsJSON, err := json.Marshal(poll.Options)
+	if err != nil {
+		return fmt.Errorf("error marshalling options: %w", err)
+	}
+
+	logger.Info("Creating poll",
+		"poll", poll.ID,
+		"guild", poll.Guild,
+		"channel", poll.Channel,
+		"message", poll.Message,
+		"question", poll.Question,
+		"options", string(optionsJSON),
+		"user", poll.Creator,
+		"created", poll.CreatedTime,
+		"ends", poll.EndTime,
+		"mode", poll.Mode,
+		"max_choices", poll.MaxChoices,
+		"anonymous", poll.Anonymous,
+		"hide_results", poll.HideResults)
+
+	// Add the poll to the database
+	if err := s.insertPoll(tx, poll, optionsJSON); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// insertPoll adds a poll row as is.
+func (s *sqlStore) insertPoll(tx *sql.Tx, poll dbPoll, optionsJSON []byte) error {
+	var endedAt any
+	if !poll.EndedAt.IsZero() {
+		endedAt = poll.EndedAt
+	}
+
+	_, err := tx.Exec(s.q(`INSERT INTO polls (`+pollColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		poll.ID,
+		poll.Guild,
+		poll.Channel,
+		poll.Message,
+		poll.Question,
+		optionsJSON,
+		poll.Creator,
+		poll.CreatedTime,
+		poll.EndTime,
+		poll.Mode,
+		poll.MaxChoices,
+		poll.Anonymous,
+		poll.Salt,
+		poll.HideResults,
+		poll.Status,
+		endedAt,
+		poll.Colour,
+	)
+	if err != nil {
+		return fmt.Errorf("error adding poll to database: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) ImportPoll(poll dbPoll, votes []dbVote) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	optionsJSON, err := json.Marshal(poll.Options)
+	if err != nil {
+		return fmt.Errorf("error marshalling options: %w", err)
+	}
+
+	if err := s.insertPoll(tx, poll, optionsJSON); err != nil {
+		return err
+	}
+
+	for _, vote := range votes {
+		_, err := tx.Exec(s.q(`INSERT INTO poll_votes (poll_id, user_id, option, rank, voted_at) VALUES (?, ?, ?, ?, ?)`), poll.ID, vote.User, vote.Option, vote.Rank, vote.VotedAt)
+		if err != nil {
+			return fmt.Errorf("error adding vote to database: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) DeletePoll(pollId string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Votes are deleted along with the poll
+	result, err := tx.Exec(s.q(`DELETE FROM polls WHERE id = ?`), pollId)
+	if err != nil {
+		return fmt.Errorf("error deleting poll: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error deleting poll: %w", err)
+	} else if affected == 0 {
+		return errPollNotFound
+	}
+
+	if _, err := tx.Exec(s.q(`DELETE FROM scheduled_jobs WHERE target = ?`), pollId); err != nil {
+		return fmt.Errorf("error cancelling jobs: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) GetPoll(id string) (dbPoll, error) {
+	poll, err := scanPoll(s.db.QueryRow(s.q(`SELECT `+pollColumns+` FROM polls WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return dbPoll{}, errPollNotFound
+	} else if err != nil {
+		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
+	}
+
+	if poll.ID != id {
+		return dbPoll{}, fmt.Errorf("got poll %s when asking for poll %s", poll.ID, id)
+	}
+
+	if err := s.loadVotes(s.db, &poll); err != nil {
+		return dbPoll{}, err
+	}
+
+	return poll, nil
+}
+
+// votable gets the number of options, the choice limit and the mode of a poll,
+// returning an error if the poll can no longer be voted on.
+// The poll is locked until the transaction ends, so that votes counted against the choice limit can't change in the meantime.
+func (s *sqlStore) votable(tx *sql.Tx, pollId string) (int, int, PollMode, error) {
+	var (
+		optionsJSON []byte
+		endtime     time.Time
+		maxChoices  int
+		mode        string
+		status      string
+	)
+
+	query := `SELECT options, endtime, max_choices, mode, status FROM polls WHERE id = ?`
+	if s.dialect == "postgres" {
+		// sqlite has no row locks, but only lets one transaction write at a time
+		query += ` FOR UPDATE`
+	}
+	err := tx.QueryRow(s.q(query), pollId).Scan(&optionsJSON, &endtime, &maxChoices, &mode, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, "", errPollNotFound
+	} else if err != nil {
+		return 0, 0, "", fmt.Errorf("error getting poll: %w", err)
+	}
+
+	// Check if the poll has ended
+	if PollStatus(status) != PollStatusActive || endtime.Before(time.Now()) {
+		return 0, 0, "", errPollEnded
+	}
+
+	var options []string
+	err = json.Unmarshal(optionsJSON, &options)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("error unmarshalling options: %w", err)
+	}
+
+	return len(options), maxChoices, PollMode(mode), nil
+}
+
+// countPicks counts the options a user has voted for in a poll.
+func (s *sqlStore) countPicks(tx *sql.Tx, pollId, userId string) (int, error) {
+	var picks int
+	err := tx.QueryRow(s.q(`SELECT COUNT(*) FROM poll_votes WHERE poll_id = ? AND user_id = ?`), pollId, userId).Scan(&picks)
+	if err != nil {
+		return 0, fmt.Errorf("error counting votes: %w", err)
+	}
+	return picks, nil
+}
+
+func (s *sqlStore) Vote(pollId, userId string, option int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	options, maxChoices, _, err := s.votable(tx, pollId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check if the option is past the number of options
+	if option < 0 || option >= options {
+		return 0, fmt.Errorf("option %d is out of range", option)
+	}
+
+	// Update the voting status for the user
+	if maxChoices <= 1 {
+		_, err = tx.Exec(s.q(`DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ? AND option != ?`), pollId, userId, option)
+		if err != nil {
+			return 0, fmt.Errorf("error removing vote: %w", err)
+		}
+	} else {
+		result, err := tx.Exec(s.q(`DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ? AND option = ?`), pollId, userId, option)
+		if err != nil {
+			return 0, fmt.Errorf("error removing vote: %w", err)
+		}
+
+		if removed, err := result.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("error removing vote: %w", err)
+		} else if removed > 0 {
+			option = -1
+		} else if picks, err := s.countPicks(tx, pollId, userId); err != nil {
+			return 0, err
+		} else if picks >= maxChoices {
+			return picks, errTooManyChoices
+		}
+	}
+
+	if option != -1 {
+		_, err = tx.Exec(s.q(`INSERT INTO poll_votes (poll_id, user_id, option, rank, voted_at) VALUES (?, ?, ?, 0, ?) ON CONFLICT DO NOTHING`), pollId, userId, option, time.Now())
+		if err != nil {
+			return 0, fmt.Errorf("error adding vote: %w", err)
+		}
+	}
+
+	picks, err := s.countPicks(tx, pollId, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return picks, nil
+}
+
+func (s *sqlStore) SetVotes(pollId, userId string, options []int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	optionCount, maxChoices, _, err := s.votable(tx, pollId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check the options are valid
+	chosen := set.Set[int]{}
+	for _, option := range options {
+		if option < 0 || option >= optionCount {
+			return 0, fmt.Errorf("option %d is out of range", option)
+		}
+		chosen.Add(option)
+	}
+
+	if chosen.Len() > maxChoices {
+		return 0, errTooManyChoices
+	}
+
+	// Update the voting status for the user, keeping the time of votes that haven't changed
+	now := time.Now()
+	for option := 0; option < optionCount; option++ {
+		if chosen.Has(option) {
+			_, err = tx.Exec(s.q(`INSERT INTO poll_votes (poll_id, user_id, option, rank, voted_at) VALUES (?, ?, ?, 0, ?) ON CONFLICT DO NOTHING`), pollId, userId, option, now)
+		} else {
+			_, err = tx.Exec(s.q(`DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ? AND option = ?`), pollId, userId, option)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error updating votes: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return chosen.Len(), nil
+}
+
+func (s *sqlStore) Rank(pollId, userId string, option int) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	options, _, mode, err := s.votable(tx, pollId)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != PollModeRanked {
+		return nil, fmt.Errorf("poll is not a ranked-choice poll")
+	}
+
+	if option < 0 || option >= options {
+		return nil, fmt.Errorf("option %d is out of range", option)
+	}
+
+	// Add the option after the user's lowest ranked option, unless they have already ranked it
+	_, err = tx.Exec(s.q(`INSERT INTO poll_votes (poll_id, user_id, option, rank, voted_at)
+		SELECT ?, ?, ?, COALESCE(MAX(rank), 0) + 1, ? FROM poll_votes WHERE poll_id = ? AND user_id = ?
+		ON CONFLICT DO NOTHING`), pollId, userId, option, time.Now(), pollId, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error adding ranking: %w", err)
+	}
+
+	rows, err := tx.Query(s.q(`SELECT option FROM poll_votes WHERE poll_id = ? AND user_id = ? ORDER BY rank`), pollId, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting ranking: %w", err)
+	}
+	defer rows.Close()
+
+	ranking := []int{}
+	for rows.Next() {
+		var ranked int
+		if err := rows.Scan(&ranked); err != nil {
+			return nil, fmt.Errorf("error scanning ranking: %w", err)
+		}
+		ranking = append(ranking, ranked)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting ranking: %w", err)
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return ranking, nil
+}
+
+func (s *sqlStore) ClearRanking(pollId, userId string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, _, mode, err := s.votable(tx, pollId)
+	if err != nil {
+		return err
+	}
+
+	if mode != PollModeRanked {
+		return fmt.Errorf("poll is not a ranked-choice poll")
+	}
+
+	_, err = tx.Exec(s.q(`DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?`), pollId, userId)
+	if err != nil {
+		return fmt.Errorf("error clearing ranking: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) EndPoll(pollId string) (dbPoll, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return dbPoll{}, err
+	}
+	defer tx.Rollback()
+
+	// End the poll
+	result, err := tx.Exec(s.q(`UPDATE polls SET status = ?, ended_at = ?, salt = '' WHERE id = ? AND status = ?`), PollStatusEnded, time.Now(), pollId, PollStatusActive)
+	if err != nil {
+		return dbPoll{}, fmt.Errorf("error ending poll: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return dbPoll{}, fmt.Errorf("error ending poll: %w", err)
+	} else if affected == 0 {
+		return dbPoll{}, fmt.Errorf("poll %s is not active: %w", pollId, errPollNotFound)
+	}
+
+	// Get the poll
+	poll, err := scanPoll(tx.QueryRow(s.q(`SELECT `+pollColumns+` FROM polls WHERE id = ?`), pollId))
+	if err != nil {
+		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
+	}
+
+	if err := s.loadVotes(tx, &poll); err != nil {
+		return dbPoll{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbPoll{}, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return poll, nil
+}
+
+// queryPolls gets the polls selected by a query on pollColumns, along with their votes.
+func (s *sqlStore) queryPolls(query string, args ...any) ([]dbPoll, error) {
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting polls: %w", err)
+	}
+	defer rows.Close()
+
+	polls := []dbPoll{}
+	for rows.Next() {
+		poll, err := scanPoll(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning poll: %w", err)
+		}
+		polls = append(polls, poll)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting polls: %w", err)
+	}
+	rows.Close()
+
+	for n := range polls {
+		if err := s.loadVotes(s.db, &polls[n]); err != nil {
+			return nil, err
+		}
+	}
+
+	return polls, nil
+}
+
+func (s *sqlStore) PollHistory(guildId string, offset, limit int) ([]dbPoll, int, error) {
+	var total int
+	err := s.db.QueryRow(s.q(`SELECT COUNT(*) FROM polls WHERE guild = ? AND status = ?`), guildId, PollStatusEnded).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting polls: %w", err)
+	}
+
+	polls, err := s.queryPolls(`SELECT `+pollColumns+` FROM polls WHERE guild = ? AND status = ? ORDER BY ended_at DESC LIMIT ? OFFSET ?`, guildId, PollStatusEnded, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return polls, total, nil
+}
+
+func (s *sqlStore) GuildActivePolls(guildId string, offset, limit int) ([]dbPoll, int, error) {
+	var total int
+	err := s.db.QueryRow(s.q(`SELECT COUNT(*) FROM polls WHERE guild = ? AND status = ?`), guildId, PollStatusActive).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting polls: %w", err)
+	}
+
+	polls, err := s.queryPolls(`SELECT `+pollColumns+` FROM polls WHERE guild = ? AND status = ? ORDER BY endtime LIMIT ? OFFSET ?`, guildId, PollStatusActive, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return polls, total, nil
+}
+
+func (s *sqlStore) AllPolls() ([]dbPoll, error) {
+	return s.queryPolls(`SELECT ` + pollColumns + ` FROM polls ORDER BY createdtime`)
+}
+
+func (s *sqlStore) ActivePolls() ([]dbPoll, error) {
+	return s.queryPolls(`SELECT `+pollColumns+` FROM polls WHERE status = ?`, PollStatusActive)
+}
+
+func (s *sqlStore) MessagePoll(messageId string) (dbPoll, error) {
+	var pollId string
+	err := s.db.QueryRow(s.q(`SELECT id FROM polls WHERE message = ?`), messageId).Scan(&pollId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return dbPoll{}, errPollNotFound
+	} else if err != nil {
+		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
+	}
+
+	return s.GetPoll(pollId)
+}
+
+func (s *sqlStore) UserPoll(userId, guildId string) (dbPoll, error) {
+	// Find a poll ID
+	var pollId string
+	err := s.db.QueryRow(s.q(`SELECT id FROM polls WHERE guild = ? AND creator = ? AND status = ? ORDER BY createdtime DESC LIMIT 1`), guildId, userId, PollStatusActive).Scan(&pollId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return dbPoll{}, errPollNotFound
+	} else if err != nil {
+		return dbPoll{}, fmt.Errorf("error getting poll: %w", err)
+	}
+
+	return s.GetPoll(pollId)
+}
+
+func (s *sqlStore) CountUserPolls(userId, guildId string) (int, error) {
+	var count int
+	err := s.db.QueryRow(s.q(`SELECT COUNT(*) FROM polls WHERE guild = ? AND creator = ? AND status = ?`), guildId, userId, PollStatusActive).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting polls: %w", err)
+	}
+	return count, nil
+}
+
+func (s *sqlStore) CountActivePolls() (int, error) {
+	var count int
+	err := s.db.QueryRow(s.q(`SELECT COUNT(*) FROM polls WHERE status = ?`), PollStatusActive).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting polls: %w", err)
+	}
+	return count, nil
+}
+
+// jobColumns is the column list used when selecting a full job row, in the order expected by scanJob.
+// Job times are stored in UTC as SQLite compares timestamps as text.
+const jobColumns = `kind, target, payload, run_at, attempts, last_error, token`
+
+func scanJob(row rowScanner) (dbJob, error) {
+	var job dbJob
+	err := row.Scan(&job.Kind, &job.Target, &job.Payload, &job.RunAt, &job.Attempts, &job.LastError, &job.Token)
+	return job, err
+}
+
+// newJobToken generates a new token for a job, see dbJob.Token.
+func newJobToken() string {
+	return ksuid.New().String()
+}
+
+func (s *sqlStore) ScheduleJob(job dbJob, replace bool) error {
+	conflict := `DO NOTHING`
+	if replace {
+		conflict = `DO UPDATE SET payload = excluded.payload, run_at = excluded.run_at, attempts = 0, last_error = '', token = excluded.token`
+	}
+
+	_, err := s.db.Exec(s.q(`INSERT INTO scheduled_jobs (`+jobColumns+`) VALUES (?, ?, ?, ?, 0, '', ?) ON CONFLICT (kind, target) `+conflict), job.Kind, job.Target, job.Payload, job.RunAt.UTC(), newJobToken())
+	if err != nil {
+		return fmt.Errorf("error scheduling job: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) CancelJobs(target string) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM scheduled_jobs WHERE target = ?`), target)
+	if err != nil {
+		return fmt.Errorf("error cancelling jobs: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) NextJob() (dbJob, bool, error) {
+	job, err := scanJob(s.db.QueryRow(`SELECT ` + jobColumns + ` FROM scheduled_jobs ORDER BY run_at LIMIT 1`))
+	if errors.Is(err, sql.ErrNoRows) {
+		return dbJob{}, false, nil
+	} else if err != nil {
+		return dbJob{}, false, fmt.Errorf("error getting next job: %w", err)
+	}
+	return job, true, nil
+}
+
+// updateJob runs an update on a job if its token still matches, returning false if it doesn't.
+func (s *sqlStore) updateJob(job dbJob, query string, args ...any) (bool, error) {
+	args = append(args, job.Kind, job.Target, job.Token)
+	result, err := s.db.Exec(s.q(query+` WHERE kind = ? AND target = ? AND token = ?`), args...)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) ClaimJob(job dbJob, until time.Time) (dbJob, bool, error) {
+	token := newJobToken()
+	ok, err := s.updateJob(job, `UPDATE scheduled_jobs SET run_at = ?, attempts = attempts + 1, token = ?`, until.UTC(), token)
+	if err != nil {
+		return dbJob{}, false, fmt.Errorf("error claiming job: %w", err)
+	}
+
+	job.RunAt = until
+	job.Attempts++
+	job.Token = token
+	return job, ok, nil
+}
+
+func (s *sqlStore) CompleteJob(job dbJob) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM scheduled_jobs WHERE kind = ? AND target = ? AND token = ?`), job.Kind, job.Target, job.Token)
+	if err != nil {
+		return fmt.Errorf("error completing job: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) RetryJob(job dbJob, runAt time.Time, lastError string) error {
+	_, err := s.updateJob(job, `UPDATE scheduled_jobs SET run_at = ?, last_error = ?, token = ?`, runAt.UTC(), lastError, newJobToken())
+	if err != nil {
+		return fmt.Errorf("error rescheduling job: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) CommandPermissions(guildId string) ([]dbCommandPermission, error) {
+	rows, err := s.db.Query(s.q(`SELECT guild_id, command, kind, target_id FROM command_permissions WHERE guild_id = ? ORDER BY command, kind, target_id`), guildId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting command permissions: %w", err)
+	}
+	defer rows.Close()
+
+	permissions := []dbCommandPermission{}
+	for rows.Next() {
+		var permission dbCommandPermission
+		var kind string
+		if err := rows.Scan(&permission.Guild, &permission.Command, &kind, &permission.Target); err != nil {
+			return nil, fmt.Errorf("error scanning command permission: %w", err)
+		}
+		permission.Kind = PermissionKind(kind)
+		permissions = append(permissions, permission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting command permissions: %w", err)
+	}
+
+	return permissions, nil
+}
+
+func (s *sqlStore) AddCommandPermission(permission dbCommandPermission) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO command_permissions (guild_id, command, kind, target_id) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`), permission.Guild, permission.Command, permission.Kind, permission.Target)
+	if err != nil {
+		return fmt.Errorf("error adding command permission: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveCommandPermission(permission dbCommandPermission) (bool, error) {
+	result, err := s.db.Exec(s.q(`DELETE FROM command_permissions WHERE guild_id = ? AND command = ? AND kind = ? AND target_id = ?`), permission.Guild, permission.Command, permission.Kind, permission.Target)
+	if err != nil {
+		return false, fmt.Errorf("error removing command permission: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error removing command permission: %w", err)
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) ResetCommandPermissions(guildId, command string) (int, error) {
+	result, err := s.db.Exec(s.q(`DELETE FROM command_permissions WHERE guild_id = ? AND command = ?`), guildId, command)
+	if err != nil {
+		return 0, fmt.Errorf("error resetting command permissions: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error resetting command permissions: %w", err)
+	}
+	return int(affected), nil
+}
+
+func (s *sqlStore) GuildSettings(guildId string) (map[string]string, error) {
+	rows, err := s.db.Query(s.q(`SELECT key, value FROM guild_settings WHERE guild_id = ?`), guildId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting guild settings: %w", err)
+	}
+	defer rows.Close()
+
+	settings := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("error scanning guild setting: %w", err)
+		}
+		settings[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error getting guild settings: %w", err)
+	}
+
+	return settings, nil
+}
+
+func (s *sqlStore) SetGuildSetting(guildId, key, value string) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO guild_settings (guild_id, key, value) VALUES (?, ?, ?) ON CONFLICT (guild_id, key) DO UPDATE SET value = excluded.value`), guildId, key, value)
+	if err != nil {
+		return fmt.Errorf("error setting guild setting: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) ResetGuildSetting(guildId, key string) (bool, error) {
+	result, err := s.db.Exec(s.q(`DELETE FROM guild_settings WHERE guild_id = ? AND key = ?`), guildId, key)
+	if err != nil {
+		return false, fmt.Errorf("error resetting guild setting: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error resetting guild setting: %w", err)
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStore) ResetGuildSettings(guildId string) (int, error) {
+	result, err := s.db.Exec(s.q(`DELETE FROM guild_settings WHERE guild_id = ?`), guildId)
+	if err != nil {
+		return 0, fmt.Errorf("error resetting guild settings: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error resetting guild settings: %w", err)
+	}
+	return int(affected), nil
+}